@@ -1,6 +1,11 @@
 package socketio
 
-import "sync"
+import (
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
 
 // BroadcastAdaptor is the adaptor to handle broadcasts.
 type BroadcastAdaptor interface {
@@ -13,6 +18,47 @@ type BroadcastAdaptor interface {
 
 	// Send will send an event with args to the room. If "ignore" is not nil, the event will be excluded from being sent to "ignore".
 	Send(ignore Socket, room, event string, args ...interface{}) error
+
+	// Members returns the sockets currently in the room.
+	Members(room string) ([]Socket, error)
+}
+
+// RoomsJoiner is implemented by the adaptors able to join several rooms at
+// once, used by Socket.JoinAll.
+type RoomsJoiner interface {
+
+	// JoinAll causes the socket to join all rooms, or none of them on error.
+	JoinAll(rooms []string, socket Socket) error
+}
+
+// RoomSampler is implemented by the adaptors able to send an event to a random
+// subset of a room, used by BroadcastToSample.
+type RoomSampler interface {
+
+	// SendSample sends an event with args to a random fraction of the sockets
+	// of the room, except "except" if not nil. A fraction <= 0 sends to none
+	// of them, >= 1 to all of them.
+	SendSample(except Socket, room, event string, fraction float64, args ...interface{}) error
+}
+
+// RoomsSender is implemented by the adaptors able to send an event once to the
+// sockets in any of several rooms, used by To and BroadcastToRooms.
+type RoomsSender interface {
+
+	// SendRooms sends an event with args to the sockets in any of the rooms,
+	// once per socket, except "except" if not nil.
+	SendRooms(except Socket, rooms []string, event string, args ...interface{}) error
+}
+
+// LocalAdaptor is implemented by the adaptors whose members are all the
+// sockets reached by their broadcasts, like the default one, so the acks of a
+// broadcast can be collected from them, used by BroadcastToWithAck. An adaptor
+// wrapping the default one forwards Local to it.
+type LocalAdaptor interface {
+
+	// Local reports whether the broadcasts only reach the sockets of this
+	// process.
+	Local() bool
 }
 
 var newBroadcast = newBroadcastDefault
@@ -20,14 +66,54 @@ var newBroadcast = newBroadcastDefault
 type broadcast struct {
 	m map[string]map[string]Socket
 	sync.RWMutex
+	// rnd picks the sockets of SendSample.
+	rnd *rand.Rand
 }
 
 func newBroadcastDefault() BroadcastAdaptor {
 	return &broadcast{
-		m: make(map[string]map[string]Socket),
+		m:   make(map[string]map[string]Socket),
+		rnd: newLockedRand(time.Now().UnixNano()),
 	}
 }
 
+// NewLocalBroadcastAdaptor returns the default adaptor of the server, which
+// keeps the rooms in memory and sends to the sockets of this process. Adaptors
+// relaying broadcasts between nodes keep the rooms of their node with it.
+func NewLocalBroadcastAdaptor() BroadcastAdaptor {
+	return newBroadcastDefault()
+}
+
+// sampleRand picks the sockets of BroadcastToSample for the adaptors which
+// aren't RoomSampler.
+var sampleRand = newLockedRand(time.Now().UnixNano())
+
+// lockedSource is a rand.Source safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func newLockedRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	s.src.Seed(seed)
+	s.mu.Unlock()
+}
+
+func (b *broadcast) Local() bool {
+	return true
+}
+
 func (b *broadcast) Join(room string, socket Socket) error {
 	b.Lock()
 	sockets, ok := b.m[room]
@@ -40,6 +126,20 @@ func (b *broadcast) Join(room string, socket Socket) error {
 	return nil
 }
 
+func (b *broadcast) JoinAll(rooms []string, socket Socket) error {
+	b.Lock()
+	for _, room := range rooms {
+		sockets, ok := b.m[room]
+		if !ok {
+			sockets = make(map[string]Socket)
+			b.m[room] = sockets
+		}
+		sockets[socket.Id()] = socket
+	}
+	b.Unlock()
+	return nil
+}
+
 func (b *broadcast) Leave(room string, socket Socket) error {
 	b.Lock()
 	defer b.Unlock()
@@ -59,12 +159,136 @@ func (b *broadcast) Leave(room string, socket Socket) error {
 func (b *broadcast) Send(ignore Socket, room, event string, args ...interface{}) error {
 	b.RLock()
 	sockets := b.m[room]
+	e := newRoomEmitter(event, args)
 	for id, s := range sockets {
 		if ignore != nil && ignore.Id() == id {
 			continue
 		}
-		s.Emit(event, args...)
+		e.emit(s)
 	}
 	b.RUnlock()
-	return nil
+	return e.err
+}
+
+func (b *broadcast) SendRooms(except Socket, rooms []string, event string, args ...interface{}) error {
+	b.RLock()
+	defer b.RUnlock()
+	sent := make(map[string]bool)
+	if except != nil {
+		sent[except.Id()] = true
+	}
+	e := newRoomEmitter(event, args)
+	for _, room := range rooms {
+		for id, s := range b.m[room] {
+			if sent[id] {
+				continue
+			}
+			sent[id] = true
+			e.emit(s)
+		}
+	}
+	return e.err
+}
+
+func (b *broadcast) SendSample(except Socket, room, event string, fraction float64, args ...interface{}) error {
+	members, err := b.Members(room)
+	if err != nil {
+		return err
+	}
+	e := newRoomEmitter(event, args)
+	for _, s := range sampleSockets(b.rnd, members, except, fraction) {
+		e.emit(s)
+	}
+	return e.err
+}
+
+// sampleSockets returns a random fraction of the sockets other than except,
+// rounded to the nearest count. It shuffles sockets.
+func sampleSockets(rnd *rand.Rand, sockets []Socket, except Socket, fraction float64) []Socket {
+	if except != nil {
+		kept := sockets[:0]
+		for _, s := range sockets {
+			if s.Id() != except.Id() {
+				kept = append(kept, s)
+			}
+		}
+		sockets = kept
+	}
+	if fraction <= 0 {
+		return nil
+	}
+	if fraction >= 1 {
+		return sockets
+	}
+	n := int(fraction*float64(len(sockets)) + 0.5)
+	for i := 0; i < n; i++ {
+		j := i + rnd.Intn(len(sockets)-i)
+		sockets[i], sockets[j] = sockets[j], sockets[i]
+	}
+	return sockets[:n]
+}
+
+func (b *broadcast) Members(room string) ([]Socket, error) {
+	b.RLock()
+	sockets := b.m[room]
+	ret := make([]Socket, 0, len(sockets))
+	for _, s := range sockets {
+		ret = append(ret, s)
+	}
+	b.RUnlock()
+	return ret, nil
+}
+
+// roomEmitter emits an event to the sockets of a room, which are in the same
+// namespace, encoding it once for all of them rather than once per socket.
+type roomEmitter struct {
+	event string
+	args  []interface{}
+	raw   *RawEvent
+	// slow is set when the event is emitted by Emit of every socket, like
+	// events with an ack callback.
+	slow bool
+	// err is the error of the outgoing hook, which aborts the broadcast.
+	err error
+}
+
+func newRoomEmitter(event string, args []interface{}) *roomEmitter {
+	e := &roomEmitter{
+		event: event,
+		args:  args,
+		slow:  event == "disconnect",
+	}
+	if l := len(args); l > 0 && reflect.ValueOf(args[l-1]).Kind() == reflect.Func {
+		e.slow = true
+	}
+	return e
+}
+
+func (e *roomEmitter) emit(so Socket) {
+	if e.err != nil {
+		return
+	}
+	ns, ok := so.(*nspSocket)
+	if !ok || e.slow {
+		so.Emit(e.event, e.args...)
+		return
+	}
+	if e.raw == nil {
+		// the sockets of the room share the outgoing hook of the server.
+		args, err := ns.outgoingArgs(e.event, e.args)
+		if err != nil {
+			e.err = err
+			return
+		}
+		raw, err := EncodeEvent(ns.name, e.event, args...)
+		if err != nil {
+			e.slow = true
+			so.Emit(e.event, e.args...)
+			return
+		}
+		e.raw = raw
+	}
+	if err := ns.EmitRaw(e.raw); err == errRawNamespace || err == errRawCodec {
+		so.Emit(e.event, e.args...)
+	}
 }
@@ -0,0 +1,181 @@
+package socketio
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBroadcastMembers(t *testing.T) {
+
+	Convey("Members lists the sockets joined to a room", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		a := newSocket(NewPipeConn("a"), ns).namespace("")
+		b := newSocket(NewPipeConn("b"), ns).namespace("")
+		So(a.Join("room"), ShouldBeNil)
+		So(b.Join("room"), ShouldBeNil)
+		So(b.Join("other"), ShouldBeNil)
+
+		members, err := a.RoomMembers("room")
+		So(err, ShouldBeNil)
+		ids := []string{}
+		for _, m := range members {
+			ids = append(ids, m.Id())
+		}
+		sort.Strings(ids)
+		So(ids, ShouldResemble, []string{"a", "b"})
+
+		So(b.Leave("room"), ShouldBeNil)
+		members, err = ns.RoomMembers("room")
+		So(err, ShouldBeNil)
+		So(len(members), ShouldEqual, 1)
+		So(members[0].Id(), ShouldEqual, "a")
+
+		members, err = ns.RoomMembers("none")
+		So(err, ShouldBeNil)
+		So(members, ShouldBeEmpty)
+	})
+}
+
+func TestEmitRaw(t *testing.T) {
+
+	Convey("Events encoded once are emitted to the sockets of their namespace", t, func() {
+		root := newNamespace(newBroadcastDefault())
+		root.Of("/chat")
+		conn := NewPipeConn("a")
+		so := newSocket(conn, root)
+		ev, err := EncodeEvent("/chat", "ev", []byte{1}, 2)
+		So(err, ShouldBeNil)
+		So(so.namespace("/chat").EmitRaw(ev), ShouldEqual, ErrNamespaceNotConnected)
+		so.namespace("/chat").connected = true
+		So(so.namespace("/chat").EmitRaw(ev), ShouldBeNil)
+		So(so.namespace("/chat").EmitRaw(ev), ShouldBeNil)
+		So(so.namespace("").EmitRaw(ev), ShouldEqual, errRawNamespace)
+		frame := `51-/chat,["ev",{"_placeholder":true,"num":0},2]`
+		So(conn.Frames(), ShouldResemble, []string{frame, "\x01", frame, "\x01"})
+	})
+
+	Convey("Broadcasts are encoded once for the members of the room", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		conns := []*PipeConn{NewPipeConn("a"), NewPipeConn("b"), NewPipeConn("c")}
+		for _, conn := range conns {
+			So(newSocket(conn, ns).namespace("").Join("room"), ShouldBeNil)
+		}
+		So(ns.BroadcastTo("room", "ev", "data"), ShouldBeNil)
+		for _, conn := range conns {
+			So(conn.Frames(), ShouldResemble, []string{`2["ev","data"]`})
+		}
+	})
+}
+
+// discardConn drops the frames written to it.
+type discardConn struct {
+	FakeSockConnection
+	id string
+}
+
+func (c *discardConn) Id() string {
+	return c.id
+}
+
+func benchmarkRoom(b *testing.B) (*namespace, []Socket) {
+	ns := newNamespace(newBroadcastDefault())
+	for i := 0; i < 1000; i++ {
+		so := newSocket(&discardConn{id: fmt.Sprint(i)}, ns).namespace("")
+		if err := so.Join("room"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	members, err := ns.RoomMembers("room")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return ns, members
+}
+
+func BenchmarkBroadcastRoom(b *testing.B) {
+	ns, _ := benchmarkRoom(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ns.BroadcastTo("room", "ev", "data", i)
+	}
+}
+
+func BenchmarkBroadcastRoomEmit(b *testing.B) {
+	_, members := benchmarkRoom(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, so := range members {
+			so.Emit("ev", "data", i)
+		}
+	}
+}
+
+func TestBroadcastToSample(t *testing.T) {
+
+	Convey("Samples reach a fraction of the room", t, func() {
+		adaptor := newBroadcastDefault().(*broadcast)
+		adaptor.rnd = rand.New(rand.NewSource(1))
+		ns := newNamespace(adaptor)
+		var conns []*PipeConn
+		for i := 0; i < 100; i++ {
+			conn := NewPipeConn(fmt.Sprint(i))
+			So(newSocket(conn, ns).namespace("").Join("room"), ShouldBeNil)
+			conns = append(conns, conn)
+		}
+		received := func() int {
+			n := 0
+			for _, conn := range conns {
+				n += len(conn.Frames())
+			}
+			return n
+		}
+		const runs = 5
+		for i := 0; i < runs; i++ {
+			So(ns.BroadcastToSample("room", "ev", 0.3), ShouldBeNil)
+		}
+		So(received(), ShouldEqual, runs*30)
+		counts := map[int]bool{}
+		for _, conn := range conns {
+			counts[len(conn.Frames())] = true
+		}
+		So(len(counts), ShouldBeGreaterThan, 1)
+
+		So(ns.BroadcastToSample("room", "ev", 0), ShouldBeNil)
+		So(received(), ShouldEqual, runs*30)
+		So(ns.BroadcastToSample("room", "ev", 1.5), ShouldBeNil)
+		So(received(), ShouldEqual, runs*30+100)
+	})
+
+	Convey("Samples skip the sender", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		a, b := NewPipeConn("a"), NewPipeConn("b")
+		sender := newSocket(a, ns).namespace("")
+		So(sender.Join("room"), ShouldBeNil)
+		So(newSocket(b, ns).namespace("").Join("room"), ShouldBeNil)
+		So(sender.BroadcastToSample("room", "ev", 1), ShouldBeNil)
+		So(a.Frames(), ShouldBeEmpty)
+		So(len(b.Frames()), ShouldEqual, 1)
+	})
+
+	Convey("Adaptors without sampling send to a sample of the members", t, func() {
+		ns := newNamespace(&failingJoinAdaptor{BroadcastAdaptor: newBroadcastDefault()})
+		var conns []*PipeConn
+		for i := 0; i < 10; i++ {
+			conn := NewPipeConn(fmt.Sprint(i))
+			So(newSocket(conn, ns).namespace("").Join("room"), ShouldBeNil)
+			conns = append(conns, conn)
+		}
+		So(ns.BroadcastToSample("room", "ev", 0.5), ShouldBeNil)
+		n := 0
+		for _, conn := range conns {
+			n += len(conn.Frames())
+		}
+		So(n, ShouldEqual, 5)
+	})
+}
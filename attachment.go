@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"strings"
 )
 
 // Attachment is an attachment handler used in emit args. All attachments will be sent as binary data in the transport layer. When using an attachment, make sure it is a pointer.
 //
+// Non-nil []byte values in emit args are sent as attachments too, and received
+// attachments can be decoded into []byte args as well as Attachment.
+//
 // For example:
 //
 //     type Arg struct {
@@ -34,6 +38,13 @@ type Attachment struct {
 	num  int
 }
 
+// HasAttachments returns whether args hold []byte or Attachment values, which
+// are sent as attachments. Adaptors relaying the events between nodes as json
+// can't relay them.
+func HasAttachments(args ...interface{}) bool {
+	return hasBinary(reflect.ValueOf(args)) || len(encodeAttachments(args)) > 0
+}
+
 func encodeAttachments(v interface{}) []io.Reader {
 	index := 0
 	return encodeAttachmentValue(reflect.ValueOf(v), &index)
@@ -57,6 +68,9 @@ func encodeAttachmentValue(v reflect.Value, index *int) []io.Reader {
 			(*index)++
 			return ret
 		}
+		if isMarshaler(v.Type()) {
+			return ret
+		}
 		for i, n := 0, v.NumField(); i < n; i++ {
 			var r []io.Reader
 			r = encodeAttachmentValue(v.Field(i), index)
@@ -153,10 +167,28 @@ func decodeAttachmentValue(v reflect.Value, binary [][]byte) error {
 }
 
 func (a Attachment) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf("{\"_placeholder\":true,\"num\":%d}", a.num)), nil
+	return placeholder(a.num), nil
 }
 
 func (a *Attachment) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		// the content resolved from a placeholder by resolvePlaceholders.
+		var data []byte
+		if err := json.Unmarshal(b, &data); err != nil {
+			return err
+		}
+		if a.Data == nil {
+			a.Data = bytes.NewBuffer(nil)
+		}
+		for len(data) > 0 {
+			n, err := a.Data.Write(data)
+			if err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+		return nil
+	}
 	var v struct {
 		Num int `json:"num"`
 	}
@@ -166,3 +198,205 @@ func (a *Attachment) UnmarshalJSON(b []byte) error {
 	a.num = v.Num
 	return nil
 }
+
+func placeholder(num int) []byte {
+	return []byte(fmt.Sprintf("{\"_placeholder\":true,\"num\":%d}", num))
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// isMarshaler returns whether values of t encode themselves by MarshalJSON,
+// which has the last word on their json, binary fields included.
+func isMarshaler(t reflect.Type) bool {
+	return t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType)
+}
+
+// isBinary returns whether v is a []byte sent as an attachment.
+func isBinary(v reflect.Value) bool {
+	t := v.Type()
+	return v.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 &&
+		!v.IsNil() && !isMarshaler(t)
+}
+
+// hasBinary returns whether v holds any []byte sent as an attachment.
+func hasBinary(v reflect.Value) bool {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() || isMarshaler(v.Type()) {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i, n := 0, v.NumField(); i < n; i++ {
+			if t.Field(i).PkgPath == "" && hasBinary(v.Field(i)) {
+				return true
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return false
+		}
+		for _, key := range v.MapKeys() {
+			if hasBinary(v.MapIndex(key)) {
+				return true
+			}
+		}
+	case reflect.Slice:
+		if isBinary(v) {
+			return true
+		}
+		fallthrough
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return false
+		}
+		for i, n := 0, v.Len(); i < n; i++ {
+			if hasBinary(v.Index(i)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeBinary replaces the []byte values in v with attachment placeholders
+// numbered from index. It returns the data to encode in place of v, and the
+// readers of the replaced values in order.
+func encodeBinary(v interface{}, index int) (interface{}, []io.Reader) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || !hasBinary(rv) {
+		return v, nil
+	}
+	var readers []io.Reader
+	data, err := encodeBinaryValue(rv, index, &readers)
+	if err != nil {
+		// leave it to the encoder to report.
+		return v, nil
+	}
+	return data, readers
+}
+
+func encodeBinaryValue(v reflect.Value, index int, readers *[]io.Reader) (interface{}, error) {
+	if !hasBinary(v) {
+		return v.Interface(), nil
+	}
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		b, err := json.Marshal(v.Interface())
+		if err != nil {
+			return nil, err
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, err
+		}
+		ret := make(map[string]interface{}, len(fields))
+		for k, f := range fields {
+			ret[k] = f
+		}
+		t := v.Type()
+		for i, n := 0, v.NumField(); i < n; i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || !hasBinary(v.Field(i)) {
+				continue
+			}
+			name := f.Tag.Get("json")
+			if name == "-" {
+				continue
+			}
+			if comma := strings.IndexByte(name, ','); comma >= 0 {
+				name = name[:comma]
+			}
+			data, err := encodeBinaryValue(v.Field(i), index, readers)
+			if err != nil {
+				return nil, err
+			}
+			if promoted, ok := data.(map[string]interface{}); ok && name == "" && f.Anonymous {
+				for k, v := range promoted {
+					ret[k] = v
+				}
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			ret[name] = data
+		}
+		return ret, nil
+	case reflect.Map:
+		ret := make(map[string]interface{}, v.Len())
+		for _, key := range v.MapKeys() {
+			data, err := encodeBinaryValue(v.MapIndex(key), index, readers)
+			if err != nil {
+				return nil, err
+			}
+			ret[key.String()] = data
+		}
+		return ret, nil
+	case reflect.Slice:
+		if isBinary(v) {
+			num := index + len(*readers)
+			*readers = append(*readers, bytes.NewReader(v.Bytes()))
+			return json.RawMessage(placeholder(num)), nil
+		}
+		fallthrough
+	case reflect.Array:
+		ret := make([]interface{}, v.Len())
+		for i := range ret {
+			data, err := encodeBinaryValue(v.Index(i), index, readers)
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = data
+		}
+		return ret, nil
+	}
+	return v.Interface(), nil
+}
+
+// resolvePlaceholders replaces the attachment placeholders in the decoded
+// json v with the base64 encoded binary, so they can be decoded into []byte
+// or Attachment.
+func resolvePlaceholders(v interface{}, binary [][]byte) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if p, ok := v["_placeholder"].(bool); ok && p {
+			num, ok := v["num"].(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("invalid placeholder")
+			}
+			n, err := num.Int64()
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 || n >= int64(len(binary)) {
+				return nil, fmt.Errorf("out of range")
+			}
+			return binary[n], nil
+		}
+		for k, e := range v {
+			r, err := resolvePlaceholders(e, binary)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = r
+		}
+	case []interface{}:
+		for i, e := range v {
+			r, err := resolvePlaceholders(e, binary)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = r
+		}
+	}
+	return v, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -182,3 +183,61 @@ func TestDecodeAttachments(t *testing.T) {
 		So(v.A.num, ShouldEqual, 2)
 	})
 }
+
+type HaveBinary struct {
+	NoAttachment
+	B    []byte            `json:"b"`
+	Skip []byte            `json:"-"`
+	M    map[string][]byte `json:"m,omitempty"`
+}
+
+func TestEncodeBinary(t *testing.T) {
+
+	Convey("No binary keeps the data", t, func() {
+		input := []interface{}{"ev", &NoAttachment{I: 1}, json.RawMessage(`"raw"`)}
+		data, readers := encodeBinary(input, 0)
+		So(readers, ShouldBeEmpty)
+		So(data, ShouldResemble, input)
+	})
+
+	Convey("Binary values become placeholders", t, func() {
+		input := []interface{}{"ev", []byte{0, 255}, &HaveBinary{
+			NoAttachment: NoAttachment{I: 1},
+			B:            []byte("b"),
+			Skip:         []byte("skip"),
+			M:            map[string][]byte{"k": []byte("m")},
+		}}
+		data, readers := encodeBinary(input, 1)
+		So(len(readers), ShouldEqual, 3)
+		b, err := json.Marshal(data)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, `["ev",{"_placeholder":true,"num":1},{"b":{"_placeholder":true,"num":2},"i":1,"m":{"k":{"_placeholder":true,"num":3}}}]`)
+		var contents []string
+		for _, r := range readers {
+			b, _ := ioutil.ReadAll(r)
+			contents = append(contents, string(b))
+		}
+		So(contents, ShouldResemble, []string{"\x00\xff", "b", "m"})
+	})
+
+	Convey("Placeholders decode into []byte and Attachment", t, func() {
+		var raw interface{}
+		decoder := json.NewDecoder(bytes.NewBufferString(`[{"b":{"_placeholder":true,"num":0},"i":1},{"_placeholder":true,"num":1}]`))
+		decoder.UseNumber()
+		So(decoder.Decode(&raw), ShouldBeNil)
+		raw, err := resolvePlaceholders(raw, [][]byte{[]byte("b"), []byte("a")})
+		So(err, ShouldBeNil)
+		b, err := json.Marshal(raw)
+		So(err, ShouldBeNil)
+
+		var v HaveBinary
+		a := &Attachment{}
+		So(json.Unmarshal(b, &[]interface{}{&v, a}), ShouldBeNil)
+		So(v.I, ShouldEqual, 1)
+		So(string(v.B), ShouldEqual, "b")
+		So(a.Data.(*bytes.Buffer).String(), ShouldEqual, "a")
+
+		_, err = resolvePlaceholders(map[string]interface{}{"_placeholder": true, "num": json.Number("2")}, nil)
+		So(err, ShouldNotBeNil)
+	})
+}
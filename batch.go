@@ -0,0 +1,159 @@
+package socketio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/googollee/go-engine.io"
+)
+
+// Event is an event with its args, emitted by Socket.EmitBurst.
+type Event struct {
+	Name string
+	Args []interface{}
+}
+
+// EmitBurst emits the events in order under a single write lock. They are all
+// encoded first, then written one after the other with no other packet of the
+// connection in between. If an event fails to encode, none is written. Events
+// of a burst can't have an ack callback.
+//
+// It doesn't coalesce the events: each is still sent as its own engine.io
+// message, only the lock is taken once. Like Emit, a burst to a namespace the
+// client didn't connect yet follows the EmitBeforeConnectPolicy of the server.
+func (n *nspSocket) EmitBurst(events []Event) error {
+	w := &batchWriter{}
+	e := newEncoder(w)
+	e.codec = n.encoder.codec
+	for _, ev := range events {
+		args, err := n.outgoingArgs(ev.Name, ev.Args)
+		if err != nil {
+			return err
+		}
+		p := packet{
+			Type: _EVENT,
+			Id:   -1,
+			NSP:  n.name,
+			Data: append([]interface{}{ev.Name}, args...),
+		}
+		if err := e.Encode(p); err != nil {
+			return e.argError(args, err)
+		}
+	}
+	return n.whenConnected("burst", func() error {
+		return n.writeFrames(w.frames)
+	})
+}
+
+// RawEvent is an event encoded once, to be emitted to many sockets of a
+// namespace without encoding it again. It's built by EncodeEvent.
+type RawEvent struct {
+	nsp    string
+	frames []*batchFrame
+}
+
+var (
+	errRawNamespace = errors.New("socketio: raw event of another namespace")
+	errRawCodec     = errors.New("socketio: raw event for a socket with a codec")
+)
+
+// EncodeEvent encodes an event with args for the sockets of the namespace nsp,
+// "" or "/" for the default one. Its args can't have an ack callback, and the
+// data of their attachments is read once.
+func EncodeEvent(nsp, event string, args ...interface{}) (*RawEvent, error) {
+	if nsp == "/" {
+		nsp = ""
+	}
+	w := &batchWriter{}
+	p := packet{
+		Type: _EVENT,
+		Id:   -1,
+		NSP:  nsp,
+		Data: append([]interface{}{event}, args...),
+	}
+	e := newEncoder(w)
+	if err := e.Encode(p); err != nil {
+		return nil, e.argError(args, err)
+	}
+	return &RawEvent{nsp: nsp, frames: w.frames}, nil
+}
+
+// EmitRaw emits the event encoded by EncodeEvent, which must be encoded for
+// the namespace of the socket. As it's encoded already, the OnAnyOutgoing hook
+// of the server doesn't see it. It's encoded as json, so it fails for the
+// sockets with a Codec. It follows the EmitBeforeConnectPolicy like Emit.
+func (n *nspSocket) EmitRaw(ev *RawEvent) error {
+	if ev.nsp != n.name {
+		return errRawNamespace
+	}
+	if n.encoder.codec != nil {
+		return errRawCodec
+	}
+	return n.whenConnected("raw event", func() error {
+		return n.writeFrames(ev.frames)
+	})
+}
+
+// batchFrame is a frame buffered by a batchWriter.
+type batchFrame struct {
+	t engineio.MessageType
+	bytes.Buffer
+	// compress hints the transport to compress the frame.
+	compress bool
+}
+
+func (f *batchFrame) Close() error {
+	return nil
+}
+
+// batchWriter buffers the frames of the packets it's given to encode, to
+// write them later.
+type batchWriter struct {
+	frames []*batchFrame
+}
+
+func (w *batchWriter) NextWriter(t engineio.MessageType) (io.WriteCloser, error) {
+	f := &batchFrame{t: t}
+	w.frames = append(w.frames, f)
+	return f, nil
+}
+
+// writeFrames writes the frames to the connection in order, holding the write
+// lock like encode.
+func (s *socket) writeFrames(frames []*batchFrame) error {
+	if s.ctx.Err() != nil || s.isBroken() {
+		return ErrSocketClosed
+	}
+	if s.queue != nil {
+		_, err := s.enqueue(frames, false, false)
+		return err
+	}
+	s.writing.lock(false)
+	err := s.write(func() error {
+		for _, f := range frames {
+			if err := s.writeFrame(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Errorf("socketio: socket %s: write packets: %s", s.Id(), err)
+	}
+	return err
+}
+
+func (s *socket) writeFrame(f *batchFrame) error {
+	s.compress = f.compress
+	w, err := s.encoder.w.NextWriter(f.t)
+	s.compress = false
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(f.Bytes()); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
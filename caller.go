@@ -1,15 +1,48 @@
 package socketio
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"strconv"
+	"strings"
 )
 
+var (
+	errorType        = reflect.TypeOf((*error)(nil)).Elem()
+	interfacesType   = reflect.TypeOf([]interface{}{})
+	eventContextType = reflect.TypeOf(EventContext{})
+)
+
+// EventContext tells a handler about the event it handles. Handlers get it by
+// taking an EventContext as their first arg, in place of the Socket, like
+//
+//	func(ctx EventContext, msg string)
+type EventContext struct {
+	// Socket is the socket receiving the event.
+	Socket Socket
+	// EventName is the name of the event.
+	EventName string
+	// AckId is the id of the ack the client asks for, -1 if none.
+	AckId int
+	// Namespace is the name of the namespace, "" for the default one.
+	Namespace string
+}
+
 type caller struct {
 	Func       reflect.Value
 	Args       []reflect.Type
 	NeedSocket bool
+	// NeedContext is set when the first arg of the func is an EventContext.
+	NeedContext bool
+	// Variadic is set when the func takes the args as ...interface{}, so it
+	// gets all args of an ack whatever their number.
+	Variadic bool
+	// Responder is set when the last arg of the func is a func, which is
+	// given to send the ack of the event.
+	Responder bool
 }
 
 func newCaller(f interface{}) (*caller, error) {
@@ -17,6 +50,9 @@ func newCaller(f interface{}) (*caller, error) {
 	if fv.Kind() != reflect.Func {
 		return nil, fmt.Errorf("f is not func")
 	}
+	if fv.IsNil() {
+		return nil, fmt.Errorf("f is nil")
+	}
 	ft := fv.Type()
 	if ft.NumIn() == 0 {
 		return &caller{
@@ -27,15 +63,21 @@ func newCaller(f interface{}) (*caller, error) {
 	for i, n := 0, ft.NumIn(); i < n; i++ {
 		args[i] = ft.In(i)
 	}
-	needSocket := false
+	needSocket, needContext := false, false
 	if args[0].Name() == "Socket" {
 		args = args[1:]
 		needSocket = true
+	} else if args[0] == eventContextType {
+		args = args[1:]
+		needContext = true
 	}
 	return &caller{
-		Func:       fv,
-		Args:       args,
-		NeedSocket: needSocket,
+		Func:        fv,
+		Args:        args,
+		NeedSocket:  needSocket,
+		NeedContext: needContext,
+		Variadic:    ft.IsVariadic() && len(args) == 1 && args[0] == interfacesType,
+		Responder:   len(args) > 0 && args[len(args)-1].Kind() == reflect.Func,
 	}, nil
 }
 
@@ -52,12 +94,22 @@ func (c *caller) GetArgs() []interface{} {
 }
 
 func (c *caller) Call(so Socket, args []interface{}) []reflect.Value {
+	return c.CallContext(EventContext{Socket: so, AckId: -1}, args)
+}
+
+// CallContext calls the func like Call with the socket of ctx, giving ctx to
+// the funcs taking an EventContext.
+func (c *caller) CallContext(ctx EventContext, args []interface{}) []reflect.Value {
 	var a []reflect.Value
 	diff := 0
-	if c.NeedSocket {
+	if c.NeedSocket || c.NeedContext {
 		diff = 1
 		a = make([]reflect.Value, len(args)+1)
-		a[0] = reflect.ValueOf(so)
+		if c.NeedContext {
+			a[0] = reflect.ValueOf(ctx)
+		} else {
+			a[0] = reflect.ValueOf(ctx.Socket)
+		}
 	} else {
 		a = make([]reflect.Value, len(args))
 	}
@@ -78,5 +130,141 @@ func (c *caller) Call(so Socket, args []interface{}) []reflect.Value {
 		a[i+diff] = v
 	}
 
+	if c.Variadic {
+		return c.Func.CallSlice(a)
+	}
 	return c.Func.Call(a)
 }
+
+// CallError calls the func with zero value args and err as the last arg. It
+// does nothing if the last arg of the func isn't an error.
+func (c *caller) CallError(so Socket, err error) []reflect.Value {
+	l := len(c.Args)
+	if l == 0 || c.Args[l-1] != errorType {
+		return nil
+	}
+	a := make([]reflect.Value, 0, l+1)
+	if c.NeedSocket {
+		a = append(a, reflect.ValueOf(so))
+	} else if c.NeedContext {
+		a = append(a, reflect.ValueOf(EventContext{Socket: so, AckId: -1}))
+	}
+	for _, t := range c.Args[:l-1] {
+		a = append(a, reflect.Zero(t))
+	}
+	a = append(a, reflect.ValueOf(&err).Elem())
+	return c.Func.Call(a)
+}
+
+// setArgs sets the args returned by GetArgs to values, skipping values which
+// aren't assignable to the arg.
+func setArgs(args []interface{}, values []interface{}) {
+	for i, v := range values {
+		if i >= len(args) {
+			return
+		}
+		rv := reflect.ValueOf(v)
+		dst := reflect.ValueOf(args[i]).Elem()
+		if rv.IsValid() && rv.Type().AssignableTo(dst.Type()) {
+			dst.Set(rv)
+		}
+	}
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// numberArg decodes a JSON number into the numeric arg of a handler. Numbers
+// with a zero fraction, like 3.0, are taken by the integer types, and numbers
+// out of the range of the type fail rather than being truncated.
+type numberArg struct {
+	ptr interface{}
+	v   reflect.Value
+}
+
+func (n *numberArg) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); err != nil && !isRangeError(err) {
+		return fmt.Errorf("socketio: %s isn't a number of %s", s, n.v.Type())
+	}
+	switch n.v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil && !isRangeError(err) {
+			var f float64
+			if f, err = strconv.ParseFloat(s, 64); err == nil {
+				if f != math.Trunc(f) {
+					return fmt.Errorf("socketio: %s isn't an integer of %s", s, n.v.Type())
+				}
+				if f < math.MinInt64 || f >= math.MaxInt64 {
+					err = strconv.ErrRange
+				}
+				i = int64(f)
+			}
+		}
+		if err != nil || n.v.OverflowInt(i) {
+			return fmt.Errorf("socketio: %s overflows %s", s, n.v.Type())
+		}
+		n.v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if strings.HasPrefix(s, "-") {
+			return fmt.Errorf("socketio: %s overflows %s", s, n.v.Type())
+		}
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil && !isRangeError(err) {
+			var f float64
+			if f, err = strconv.ParseFloat(s, 64); err == nil {
+				if f != math.Trunc(f) {
+					return fmt.Errorf("socketio: %s isn't an integer of %s", s, n.v.Type())
+				}
+				if f >= math.MaxUint64 {
+					err = strconv.ErrRange
+				}
+				u = uint64(f)
+			}
+		}
+		if err != nil || n.v.OverflowUint(u) {
+			return fmt.Errorf("socketio: %s overflows %s", s, n.v.Type())
+		}
+		n.v.SetUint(u)
+	default:
+		f, err := strconv.ParseFloat(s, n.v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("socketio: %s overflows %s", s, n.v.Type())
+		}
+		n.v.SetFloat(f)
+	}
+	return nil
+}
+
+func isRangeError(err error) bool {
+	e, ok := err.(*strconv.NumError)
+	return ok && e.Err == strconv.ErrRange
+}
+
+// wrapNumbers replaces the pointers to numbers of args, as given by GetArgs,
+// by numberArgs decoding into them. unwrapNumbers puts them back once decoded.
+func wrapNumbers(args []interface{}) {
+	for i, arg := range args {
+		v := reflect.ValueOf(arg)
+		if v.Kind() != reflect.Ptr || v.Type().Implements(unmarshalerType) {
+			continue
+		}
+		switch v.Elem().Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64:
+			args[i] = &numberArg{ptr: arg, v: v.Elem()}
+		}
+	}
+}
+
+func unwrapNumbers(args []interface{}) {
+	for i, arg := range args {
+		if n, ok := arg.(*numberArg); ok {
+			args[i] = n.ptr
+		}
+	}
+}
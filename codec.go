@@ -0,0 +1,435 @@
+package socketio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Codec encodes the packets of the clients selecting it, like
+// socket.io-msgpack-parser: each packet is sent as one binary message, the
+// object {"type": type, "nsp": namespace, "data": data, "id": ack id} encoded
+// by the codec, with the binary data of the packet in its data rather than in
+// attachments. It transcodes the json encoding of the packet, so the args of
+// handlers are encoded and decoded like with json.
+type Codec interface {
+	// Name is the value of the CodecQueryKey parameter of the handshake
+	// selecting the codec.
+	Name() string
+
+	// FromJSON returns the packet encoded as json in the encoding of the
+	// codec, with the placeholders {"_placeholder":true,"num":i} of its
+	// data replaced by binary[i].
+	FromJSON(packet []byte, binary [][]byte) ([]byte, error)
+
+	// ToJSON returns the packet in the encoding of the codec encoded as
+	// json, with its binary data replaced by placeholders numbered like
+	// binary.
+	ToJSON(packet []byte) (ret []byte, binary [][]byte, err error)
+}
+
+// CodecQueryKey is the query parameter of the handshake selecting the codec of
+// the connection, among the codecs of the server. Without it, the data is
+// encoded as json.
+const CodecQueryKey = "codec"
+
+// errUnknownCodec rejects the connections selecting a codec the server
+// doesn't have.
+var errUnknownCodec = errors.New("unknown codec")
+
+// MessagePack is the Codec of socket.io-msgpack-parser, selected by
+// "msgpack". Binary data is encoded as msgpack bin, decoded into []byte args
+// like attachments.
+var MessagePack Codec = msgpackCodec{}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) FromJSON(packet []byte, binary [][]byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(packet))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := msgpackEncode(&buf, v, binary); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) ToJSON(packet []byte) ([]byte, [][]byte, error) {
+	d := msgpackDecoder{b: packet}
+	v, err := d.decode()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(d.b) > 0 {
+		return nil, nil, fmt.Errorf("socketio: msgpack: %d bytes after data", len(d.b))
+	}
+	ret, err := json.Marshal(v)
+	return ret, d.binary, err
+}
+
+// msgpackPlaceholder returns bin[i] if v is the placeholder of the attachment
+// i, {"_placeholder":true,"num":i}.
+func msgpackPlaceholder(v map[string]interface{}, bin [][]byte) ([]byte, bool) {
+	if len(v) != 2 || v["_placeholder"] != true {
+		return nil, false
+	}
+	num, ok := v["num"].(json.Number)
+	if !ok {
+		return nil, false
+	}
+	i, err := num.Int64()
+	if err != nil || i < 0 || i >= int64(len(bin)) {
+		return nil, false
+	}
+	return bin[i], true
+}
+
+// msgpackEncode writes the decoded json v as MessagePack, with the keys of
+// maps in order, and the placeholders of the attachments bin as bin values.
+func msgpackEncode(buf *bytes.Buffer, v interface{}, bin [][]byte) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			msgpackInt(buf, i)
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, u)
+		} else {
+			f, err := v.Float64()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, f)
+		}
+	case string:
+		msgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		msgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := msgpackEncode(buf, e, bin); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if b, ok := msgpackPlaceholder(v, bin); ok {
+			msgpackBin(buf, b)
+			return nil
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		msgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			msgpackEncode(buf, k, nil)
+			if err := msgpackEncode(buf, v[k], bin); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("socketio: msgpack: can't encode %T", v)
+	}
+	return nil
+}
+
+func msgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(i))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, uint64(i))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func msgpackBin(buf *bytes.Buffer, b []byte) {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xc4)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xc5)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xc6)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.Write(b)
+}
+
+// msgpackHeader writes the header of a string, array or map of n elements:
+// the fix type with n if n < fixMax, else the type of 8, 16 or 32 bits
+// lengths. There is no 8 bits length if t8 is 0.
+func msgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, t8, t16, t32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case t8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(t8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(t16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(t32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+var (
+	errMsgpackShort = errors.New("socketio: msgpack: unexpected end of data")
+	errMsgpackDepth = errors.New("socketio: msgpack: data nested too deep")
+)
+
+// msgpackMaxDepth is the max nesting of the arrays and maps decoded, so the
+// data of a client can't exhaust the stack.
+const msgpackMaxDepth = 1000
+
+// msgpackDecoder decodes MessagePack into values encoding to json, with
+// placeholders for bin values.
+type msgpackDecoder struct {
+	b []byte
+	// depth is the nesting of the array or map being decoded.
+	depth int
+	// binary are the bin values decoded, in the order of their placeholders.
+	binary [][]byte
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.b) {
+		return nil, errMsgpackShort
+	}
+	ret := d.b[:n]
+	d.b = d.b[n:]
+	return ret, nil
+}
+
+// length reads a length of size bytes.
+func (d *msgpackDecoder) length(size int) (int, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	// every element takes a byte at least, so longer lengths are invalid.
+	if n > uint64(len(d.b)) {
+		return 0, errMsgpackShort
+	}
+	return int(n), nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	t := b[0]
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xf0 == 0x80:
+		return d.decodeMap(int(t & 0x0f))
+	case t&0xf0 == 0x90:
+		return d.decodeArray(int(t & 0x0f))
+	case t&0xe0 == 0xa0:
+		return d.decodeString(int(t & 0x1f))
+	}
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		d.binary = append(d.binary, append([]byte{}, b...))
+		return map[string]interface{}{"_placeholder": true, "num": len(d.binary) - 1}, nil
+	case 0xca:
+		b, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 0xcb:
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := d.next(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, nil
+	case 0xd0:
+		b, err := d.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int8(b[0])), nil
+	case 0xd1:
+		b, err := d.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int16(binary.BigEndian.Uint16(b))), nil
+	case 0xd2:
+		b, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return int64(int32(binary.BigEndian.Uint32(b))), nil
+	case 0xd3:
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n)
+	}
+	return nil, fmt.Errorf("socketio: msgpack: unsupported type 0x%x", t)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// enter enters an array or map, failing if it's nested too deep. leave must
+// be called once it's decoded.
+func (d *msgpackDecoder) enter() error {
+	if d.depth >= msgpackMaxDepth {
+		return errMsgpackDepth
+	}
+	d.depth++
+	return nil
+}
+
+func (d *msgpackDecoder) leave() {
+	d.depth--
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	ret := make([]interface{}, n)
+	for i := range ret {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = v
+	}
+	return ret, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	ret := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("socketio: msgpack: map key of type %T", k)
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		ret[key] = v
+	}
+	return ret, nil
+}
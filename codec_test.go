@@ -0,0 +1,170 @@
+package socketio
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMessagePack(t *testing.T) {
+
+	Convey("Data round trips through MessagePack", t, func() {
+		long := strings.Repeat("a", 300)
+		data := `["ev",null,true,false,0,127,128,-32,-33,-129,65536,-2147483649,18446744073709551615,1.5,"` + long + `",[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17],{"a":{"b":[]},"c":"d"}]`
+		b, err := MessagePack.FromJSON([]byte(data), nil)
+		So(err, ShouldBeNil)
+		So(b[0], ShouldEqual, 0xdc)
+		ret, binary, err := MessagePack.ToJSON(b)
+		So(err, ShouldBeNil)
+		So(string(ret), ShouldEqual, data)
+		So(binary, ShouldBeNil)
+	})
+
+	Convey("Binary data is encoded as bin in place of its placeholder", t, func() {
+		b, err := MessagePack.FromJSON([]byte(`["ev",{"_placeholder":true,"num":0},{"_placeholder":true,"num":1}]`), [][]byte{{1, 2}})
+		So(err, ShouldBeNil)
+		// the placeholder of a missing attachment is a map.
+		So(b, ShouldResemble, []byte{
+			0x93, 0xa2, 'e', 'v', 0xc4, 2, 1, 2,
+			0x82, 0xac, '_', 'p', 'l', 'a', 'c', 'e', 'h', 'o', 'l', 'd', 'e', 'r', 0xc3, 0xa3, 'n', 'u', 'm', 1,
+		})
+
+		ret, binary, err := MessagePack.ToJSON([]byte{0x93, 0xa2, 'e', 'v', 0xc4, 2, 1, 2, 0xc4, 0})
+		So(err, ShouldBeNil)
+		So(string(ret), ShouldEqual, `["ev",{"_placeholder":true,"num":0},{"_placeholder":true,"num":1}]`)
+		So(binary, ShouldResemble, [][]byte{{1, 2}, {}})
+	})
+
+	Convey("Invalid data fails", t, func() {
+		_, _, err := MessagePack.ToJSON([]byte{0x92, 0xa2, 'e'})
+		So(err, ShouldEqual, errMsgpackShort)
+		_, _, err = MessagePack.ToJSON([]byte{0xdd, 0xff, 0xff, 0xff, 0xff})
+		So(err, ShouldEqual, errMsgpackShort)
+		_, _, err = MessagePack.ToJSON([]byte{0x81, 1, 2})
+		So(err, ShouldNotBeNil)
+		_, _, err = MessagePack.ToJSON([]byte{0x90, 0x90})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Data nested too deep fails", t, func() {
+		// arrays of one array, and maps of the key "" to a map.
+		arrays := func(depth int) []byte {
+			return append(bytes.Repeat([]byte{0x91}, depth-1), 0x90)
+		}
+		maps := func(depth int) []byte {
+			return append(bytes.Repeat([]byte{0x81, 0xa0}, depth-1), 0x80)
+		}
+		for _, nested := range []func(int) []byte{arrays, maps} {
+			_, _, err := MessagePack.ToJSON(nested(msgpackMaxDepth))
+			So(err, ShouldBeNil)
+			_, _, err = MessagePack.ToJSON(nested(msgpackMaxDepth + 1))
+			So(err, ShouldEqual, errMsgpackDepth)
+		}
+	})
+}
+
+// rejectingCodec is MessagePack failing to encode the string "bad".
+type rejectingCodec struct {
+	Codec
+}
+
+func (c rejectingCodec) FromJSON(packet []byte, binary [][]byte) ([]byte, error) {
+	if bytes.Contains(packet, []byte(`"bad"`)) {
+		return nil, errors.New("bad value")
+	}
+	return c.Codec.FromJSON(packet, binary)
+}
+
+func TestServerCodec(t *testing.T) {
+	msgpack := func(packet string, binary ...[]byte) string {
+		b, err := MessagePack.FromJSON([]byte(packet), binary)
+		So(err, ShouldBeNil)
+		return string(b)
+	}
+
+	Convey("Clients selecting MessagePack send and get whole packets like socket.io-msgpack-parser", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetCodecs(MessagePack)
+		So(server.On("echo", func(msg string, n int) (string, int) {
+			return msg, n
+		}), ShouldBeNil)
+		got := make(chan []byte, 1)
+		So(server.On("bin", func(b []byte) {
+			got <- b
+		}), ShouldBeNil)
+		So(server.Of("/chat").On("echo", func(msg string) string {
+			return msg
+		}), ShouldBeNil)
+		conns := make(chan Socket, 1)
+		So(server.OnConnection(func(so Socket) {
+			conns <- so
+		}), ShouldBeNil)
+
+		conn := NewPipeConn("test1")
+		conn.request = &http.Request{URL: &url.URL{RawQuery: CodecQueryKey + "=msgpack"}}
+		go server.serveConn(conn)
+		defer conn.Close()
+		so := <-conns
+		So(conn.WaitFrames(1)[0], ShouldEqual, msgpack(`{"type":0,"nsp":"/"}`))
+
+		conn.SendBinary([]byte(msgpack(`{"type":2,"nsp":"/","data":["echo","hi",42],"id":1}`)))
+		So(conn.WaitFrames(2)[1], ShouldEqual, msgpack(`{"type":3,"nsp":"/","data":["hi",42],"id":1}`))
+
+		// binary data is in the data, whether the type is binary or not.
+		conn.SendBinary([]byte(msgpack(`{"type":5,"nsp":"/","data":["bin",{"_placeholder":true,"num":0}]}`, []byte{1, 2})))
+		So(<-got, ShouldResemble, []byte{1, 2})
+		conn.SendBinary([]byte(msgpack(`{"type":2,"nsp":"/","data":["bin",{"_placeholder":true,"num":0}]}`, []byte{3})))
+		So(<-got, ShouldResemble, []byte{3})
+
+		So(so.Emit("ev", []byte{3}), ShouldBeNil)
+		So(so.EmitBurst([]Event{{Name: "burst"}}), ShouldBeNil)
+		So(so.Join("room"), ShouldBeNil)
+		server.BroadcastTo("room", "bcast", 1)
+		So(conn.WaitFrames(5)[2:], ShouldResemble, []string{
+			msgpack(`{"type":2,"nsp":"/","data":["ev",{"_placeholder":true,"num":0}]}`, []byte{3}),
+			msgpack(`{"type":2,"nsp":"/","data":["burst"]}`),
+			msgpack(`{"type":2,"nsp":"/","data":["bcast",1]}`),
+		})
+
+		conn.SendBinary([]byte(msgpack(`{"type":0,"nsp":"/chat"}`)))
+		conn.SendBinary([]byte(msgpack(`{"type":2,"nsp":"/chat","data":["echo","hi"],"id":2}`)))
+		So(conn.WaitFrames(7)[5:], ShouldResemble, []string{
+			msgpack(`{"type":0,"nsp":"/chat"}`),
+			msgpack(`{"type":3,"nsp":"/chat","data":["hi"],"id":2}`),
+		})
+	})
+
+	Convey("Args failing to encode by the codec are told", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetCodecs(rejectingCodec{MessagePack})
+		conns := make(chan Socket, 1)
+		So(server.OnConnection(func(so Socket) {
+			conns <- so
+		}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		conn.request = &http.Request{URL: &url.URL{RawQuery: CodecQueryKey + "=msgpack"}}
+		go server.serveConn(conn)
+		defer conn.Close()
+		so := <-conns
+
+		err = so.Emit("ev", "ok", "bad")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "socketio: failed to encode arg 1 (string): bad value")
+	})
+
+	Convey("Clients selecting an unknown codec are rejected", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		conn := NewPipeConn("test1")
+		conn.request = &http.Request{URL: &url.URL{RawQuery: CodecQueryKey + "=msgpack"}}
+		server.serveConn(conn)
+		So(conn.Frames(), ShouldResemble, []string{`4{"message":"unknown codec"}`})
+	})
+}
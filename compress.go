@@ -0,0 +1,52 @@
+package socketio
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/googollee/go-engine.io"
+)
+
+// CompressWriter is implemented by the engine.io connections whose transport
+// can compress messages, like websocket with permessage-deflate. The
+// connections which don't implement it write every message uncompressed.
+// None of the connections of go-engine.io v1.0.1 implement it, so the
+// compression hints are no-ops with it: CompressWriter is for the wrappers of
+// the connection or future engine.io versions able to compress.
+type CompressWriter interface {
+	// NextCompressedWriter returns the next message writer like NextWriter,
+	// hinting the transport to compress the message if compress is set.
+	NextCompressedWriter(t engineio.MessageType, compress bool) (io.WriteCloser, error)
+}
+
+// nextWriter returns the next message writer of conn, compressed if compress
+// is set and conn is a CompressWriter.
+func nextWriter(conn engineio.Conn, t engineio.MessageType, compress bool) (io.WriteCloser, error) {
+	if c, ok := conn.(CompressWriter); ok && compress {
+		return c.NextCompressedWriter(t, true)
+	}
+	return conn.NextWriter(t)
+}
+
+// CompressedEmitter emits events whose messages the transport is hinted to
+// compress, like large json payloads over websocket. It's returned by
+// Socket.Compressed.
+type CompressedEmitter struct {
+	so *nspSocket
+}
+
+// Compressed returns a CompressedEmitter of the socket. Its emits are like
+// Emit where the connection isn't a CompressWriter, which is the case of every
+// transport of go-engine.io v1.0.1.
+func (n *nspSocket) Compressed() *CompressedEmitter {
+	return &CompressedEmitter{so: n}
+}
+
+// Emit emits an event with given args like Socket.Emit, hinting the transport
+// to compress its messages, attachments included. It doesn't take an ack
+// callback.
+func (c *CompressedEmitter) Emit(event string, args ...interface{}) error {
+	return c.so.whenConnected(strconv.Quote(event), func() error {
+		return c.so.emitLane(event, args, false, true)
+	})
+}
@@ -0,0 +1,51 @@
+package socketio
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// dispatchQueue is the number of events a worker of a dispatcher queues
+// before the loop waits for it.
+const dispatchQueue = 16
+
+// dispatcher runs the handlers of the events of a socket on a fixed number of
+// workers. The events of a name always go to the same worker, so they're
+// handled in the order they're read.
+type dispatcher struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+}
+
+func newDispatcher(workers int) *dispatcher {
+	d := &dispatcher{
+		queues: make([]chan func(), workers),
+	}
+	for i := range d.queues {
+		q := make(chan func(), dispatchQueue)
+		d.queues[i] = q
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for f := range q {
+				f()
+			}
+		}()
+	}
+	return d
+}
+
+// dispatch queues f to the worker of the event, waiting if its queue is full.
+func (d *dispatcher) dispatch(event string, f func()) {
+	h := fnv.New32a()
+	h.Write([]byte(event))
+	d.queues[h.Sum32()%uint32(len(d.queues))] <- f
+}
+
+// close waits for the workers to handle the events queued, and stops them.
+func (d *dispatcher) close() {
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.wg.Wait()
+}
@@ -1,17 +1,37 @@
 package socketio
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"reflect"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
+// Middleware is run before the handler of every incoming event. args are
+// pointers to the decoded handler args. It continues the dispatch by calling
+// next, or aborts it by returning an error, which closes the connection.
+type Middleware func(so Socket, event string, args []interface{}, next func() error) error
+
+// middleware is a Middleware with the name it's registered with, "" if none.
+type middleware struct {
+	name string
+	f    Middleware
+}
+
 type baseHandler struct {
-	events    map[string]*caller
-	name      string
-	broadcast BroadcastAdaptor
-	evMu      sync.Mutex
+	events      map[string]*caller
+	middlewares []middleware
+	auth        func(so Socket) error
+	connectData func(so Socket) interface{}
+	anyHandler  func(so Socket, event string, args ...interface{})
+	name        string
+	broadcast   BroadcastAdaptor
+	evMu        sync.Mutex
 }
 
 func newBaseHandler(name string, broadcast BroadcastAdaptor) *baseHandler {
@@ -22,11 +42,41 @@ func newBaseHandler(name string, broadcast BroadcastAdaptor) *baseHandler {
 	}
 }
 
-// On registers the function f to handle an event.
+// On registers the function f to handle an event. f may take a Socket, or an
+// EventContext, as its first arg, followed by the args of the event, like
+//
+//	func(so Socket, msg string, n int)
+//
+// The values returned by f are sent as the ack of the event, when the client
+// asks for one. If the last return value is declared as error, it isn't sent:
+// a non-nil error closes the connection instead. So these are all valid:
+//
+//	func()                    // empty ack
+//	func() (string, int)      // ack with a string and an int
+//	func() error              // empty ack, or close on error
+//	func() (string, error)    // ack with a string, or close on error
+//	func() (AckArgs, error)   // ack with the AckArgs, or close on error
+//
+// If the last arg of f is a func, it's given a responder sending its args as
+// the ack instead, at most once, so the ack can be sent after f returns:
+//
+//	func(so Socket, msg string, ack func(...interface{}))
+//
+// The "connection" handler of a namespace returns before any event of the
+// client in the namespace is dispatched, so the rooms it joins or the values
+// it sets hold for them. Goroutines it starts aren't waited for.
+//
+// An event ending with "*", like "order:*", is a pattern handling the events
+// with its prefix which have no handler of their own, like "order:created".
+// The pattern with the longest prefix wins. Handlers of patterns get the name
+// of the event from an EventContext.
 func (h *baseHandler) On(event string, f interface{}) error {
+	if event == "" {
+		return errors.New("socketio: empty event name")
+	}
 	c, err := newCaller(f)
 	if err != nil {
-		return err
+		return fmt.Errorf("socketio: invalid handler of event %q: %s", event, err)
 	}
 	h.evMu.Lock()
 	h.events[event] = c
@@ -34,10 +84,110 @@ func (h *baseHandler) On(event string, f interface{}) error {
 	return nil
 }
 
+// matchPattern returns the handler of the pattern with the longest prefix of
+// event, holding evMu.
+func (h *baseHandler) matchPattern(event string) (*caller, bool) {
+	var ret *caller
+	longest := -1
+	for pattern, c := range h.events {
+		if !strings.HasSuffix(pattern, "*") {
+			continue
+		}
+		prefix := pattern[:len(pattern)-1]
+		if len(prefix) > longest && strings.HasPrefix(event, prefix) {
+			ret, longest = c, len(prefix)
+		}
+	}
+	return ret, ret != nil
+}
+
+// Off unregisters the handler of an event, which is then dropped like the
+// events without handler.
+func (h *baseHandler) Off(event string) {
+	h.evMu.Lock()
+	delete(h.events, event)
+	h.evMu.Unlock()
+}
+
+// RemoveAll unregisters the handlers of all events, and the OnAny handler.
+func (h *baseHandler) RemoveAll() {
+	h.evMu.Lock()
+	h.events = make(map[string]*caller)
+	h.anyHandler = nil
+	h.evMu.Unlock()
+}
+
+// Events returns the names of the events with a handler, in order.
+func (h *baseHandler) Events() []string {
+	h.evMu.Lock()
+	ret := make([]string, 0, len(h.events))
+	for event := range h.events {
+		ret = append(ret, event)
+	}
+	h.evMu.Unlock()
+	sort.Strings(ret)
+	return ret
+}
+
+// OnAny registers f to handle the events without a handler registered by On.
+// f gets the event name and its args, decoded like json.Unmarshal into
+// interface{} values. Binary attachments are given as base64 strings.
+func (h *baseHandler) OnAny(f func(so Socket, event string, args ...interface{})) {
+	h.evMu.Lock()
+	h.anyHandler = f
+	h.evMu.Unlock()
+}
+
+// Use appends mw to the middlewares run before event handlers, in the order
+// of registration.
+func (h *baseHandler) Use(mw Middleware) {
+	h.evMu.Lock()
+	h.middlewares = append(h.middlewares, middleware{f: mw})
+	h.evMu.Unlock()
+}
+
+// UseNamed appends mw to the middlewares like Use, with a name to remove it by
+// RemoveMiddleware. If a middleware has the name already, it's replaced in
+// place.
+func (h *baseHandler) UseNamed(name string, mw Middleware) {
+	h.evMu.Lock()
+	defer h.evMu.Unlock()
+	for i, m := range h.middlewares {
+		if m.name == name {
+			h.middlewares[i].f = mw
+			return
+		}
+	}
+	h.middlewares = append(h.middlewares, middleware{name: name, f: mw})
+}
+
+// RemoveMiddleware removes the middleware registered by UseNamed with the
+// name. Like Use, it applies to the sockets connecting afterwards.
+func (h *baseHandler) RemoveMiddleware(name string) {
+	h.evMu.Lock()
+	defer h.evMu.Unlock()
+	for i, m := range h.middlewares {
+		if m.name == name {
+			h.middlewares = append(h.middlewares[:i], h.middlewares[i+1:]...)
+			return
+		}
+	}
+}
+
+// RemoveMiddlewares removes all middlewares.
+func (h *baseHandler) RemoveMiddlewares() {
+	h.evMu.Lock()
+	h.middlewares = nil
+	h.evMu.Unlock()
+}
+
 type socketHandler struct {
 	*baseHandler
 	socket *nspSocket
-	rooms  map[string]struct{}
+	// rooms are the broadcast names of the rooms joined, guarded by roomsMu
+	// as rooms may be left by the loop while handlers join others.
+	rooms   map[string]struct{}
+	roomsMu sync.Mutex
 }
 
 func newSocketHandler(ns *nspSocket, base *baseHandler) *socketHandler {
@@ -46,65 +196,507 @@ func newSocketHandler(ns *nspSocket, base *baseHandler) *socketHandler {
 	for k, v := range base.events {
 		events[k] = v
 	}
+	middlewares := append([]middleware(nil), base.middlewares...)
+	auth := base.auth
+	connectData := base.connectData
+	anyHandler := base.anyHandler
 	base.evMu.Unlock()
 	return &socketHandler{
 		baseHandler: &baseHandler{
-			events:    events,
-			name:      base.name,
-			broadcast: base.broadcast,
+			events:      events,
+			middlewares: middlewares,
+			auth:        auth,
+			connectData: connectData,
+			anyHandler:  anyHandler,
+			name:        base.name,
+			broadcast:   base.broadcast,
 		},
 		socket: ns,
 		rooms:  make(map[string]struct{}),
 	}
 }
 
+// Rooms returns the rooms joined in the namespace, as given to Join, in order.
 func (h *socketHandler) Rooms() []string {
+	h.roomsMu.Lock()
+	defer h.roomsMu.Unlock()
 	ret := make([]string, 0, len(h.rooms))
+	prefix := h.broadcastName("")
 	for room := range h.rooms {
-		if strings.HasPrefix(room, fmt.Sprint(h.name, ":")) {
-			ret = append(ret, room)
+		if strings.HasPrefix(room, prefix) {
+			ret = append(ret, strings.TrimPrefix(room, prefix))
 		}
 	}
+	sort.Strings(ret)
 	return ret
 }
 
+// ErrReservedRoom is returned when joining a reserved room.
+var ErrReservedRoom = errors.New("socketio: reserved room name")
+
+// checkRoom returns ErrReservedRoom if the room is reserved, which is the
+// empty room. Sockets have no room of their own id, so the rooms named like
+// ids are like any other.
+func (h *socketHandler) checkRoom(room string) error {
+	if room == "" {
+		return ErrReservedRoom
+	}
+	return nil
+}
+
+// Join joins the room. The reserved empty room fails with ErrReservedRoom.
 func (h *socketHandler) Join(room string) error {
-	roomName := h.broadcastName(room)
-	if err := h.baseHandler.broadcast.Join(roomName, h.socket); err != nil {
+	if err := h.checkRoom(room); err != nil {
 		return err
 	}
+	h.roomsMu.Lock()
+	joined, err := h.join(h.broadcastName(room))
+	h.roomsMu.Unlock()
+	if joined {
+		h.joined(room)
+	}
+	return err
+}
+
+// join joins the room with the broadcast name, holding roomsMu. It returns
+// whether the socket wasn't in the room already.
+func (h *socketHandler) join(roomName string) (bool, error) {
+	if err := h.baseHandler.broadcast.Join(roomName, h.socket); err != nil {
+		return false, err
+	}
+	_, ok := h.rooms[roomName]
 	h.rooms[roomName] = struct{}{}
+	return !ok, nil
+}
+
+// joined calls the OnJoinRoom hook of the server for the rooms, without
+// holding roomsMu.
+func (h *socketHandler) joined(rooms ...string) {
+	if f := h.socket.joinRoom; f != nil {
+		for _, room := range rooms {
+			f(h.socket, room)
+		}
+	}
+}
+
+// left calls the OnLeaveRoom hook of the server for the rooms, without
+// holding roomsMu.
+func (h *socketHandler) left(rooms ...string) {
+	if f := h.socket.leaveRoom; f != nil {
+		for _, room := range rooms {
+			f(h.socket, room)
+		}
+	}
+}
+
+// JoinNew joins the room like Join, returning whether the socket wasn't in
+// the room already. A socket in the room isn't joined again.
+func (h *socketHandler) JoinNew(room string) (bool, error) {
+	if err := h.checkRoom(room); err != nil {
+		return false, err
+	}
+	h.roomsMu.Lock()
+	roomName := h.broadcastName(room)
+	if _, ok := h.rooms[roomName]; ok {
+		h.roomsMu.Unlock()
+		return false, nil
+	}
+	joined, err := h.join(roomName)
+	h.roomsMu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	h.joined(room)
+	return joined, nil
+}
+
+// JoinAll joins all rooms, or none of them if one fails. The adaptor joins
+// them at once if it's a RoomsJoiner.
+func (h *socketHandler) JoinAll(rooms ...string) error {
+	names := make([]string, len(rooms))
+	for i, room := range rooms {
+		if err := h.checkRoom(room); err != nil {
+			return err
+		}
+		names[i] = h.broadcastName(room)
+	}
+	h.roomsMu.Lock()
+	if j, ok := h.baseHandler.broadcast.(RoomsJoiner); ok {
+		if err := j.JoinAll(names, h.socket); err != nil {
+			h.roomsMu.Unlock()
+			return err
+		}
+	} else {
+		for i, name := range names {
+			if err := h.baseHandler.broadcast.Join(name, h.socket); err != nil {
+				// roll back the rooms joined by this call.
+				for _, joined := range names[:i] {
+					if _, ok := h.rooms[joined]; !ok {
+						h.baseHandler.broadcast.Leave(joined, h.socket)
+					}
+				}
+				h.roomsMu.Unlock()
+				return err
+			}
+		}
+	}
+	var joined []string
+	for i, name := range names {
+		if _, ok := h.rooms[name]; !ok {
+			h.rooms[name] = struct{}{}
+			joined = append(joined, rooms[i])
+		}
+	}
+	h.roomsMu.Unlock()
+	h.joined(joined...)
 	return nil
 }
 
 func (h *socketHandler) Leave(room string) error {
+	h.roomsMu.Lock()
 	roomName := h.broadcastName(room)
 	if err := h.baseHandler.broadcast.Leave(roomName, h.socket); err != nil {
+		h.roomsMu.Unlock()
 		return err
 	}
+	_, ok := h.rooms[roomName]
 	delete(h.rooms, roomName)
+	h.roomsMu.Unlock()
+	if ok {
+		h.left(room)
+	}
 	return nil
 }
 
-func (h *socketHandler) LeaveAll() error {
-	for room := range h.rooms {
-		if err := h.baseHandler.broadcast.Leave(h.broadcastName(room), h.socket); err != nil {
-			return err
+// RoomErrors is returned when leaving some rooms failed. It maps the rooms
+// to their errors.
+type RoomErrors map[string]error
+
+func (e RoomErrors) Error() string {
+	rooms := make([]string, 0, len(e))
+	for room := range e {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	msgs := make([]string, len(rooms))
+	for i, room := range rooms {
+		msgs[i] = fmt.Sprintf("%s: %s", room, e[room])
+	}
+	return "socketio: failed to leave rooms: " + strings.Join(msgs, "; ")
+}
+
+// LeaveAll leaves all rooms, returning the rooms left in order. The rooms
+// failing to leave are kept and reported by a RoomErrors. Calling it again
+// leaves nothing more, so it's safe along with the cleanup on disconnection.
+func (h *socketHandler) LeaveAll() ([]string, error) {
+	return h.leaveMatching(func(string) bool {
+		return true
+	})
+}
+
+// LeaveMatching leaves the rooms with the prefix like LeaveAll.
+func (h *socketHandler) LeaveMatching(prefix string) ([]string, error) {
+	return h.leaveMatching(func(room string) bool {
+		return strings.HasPrefix(room, prefix)
+	})
+}
+
+func (h *socketHandler) leaveMatching(match func(room string) bool) ([]string, error) {
+	left, err := h.leaveMatchingLocked(match)
+	h.left(left...)
+	return left, err
+}
+
+func (h *socketHandler) leaveMatchingLocked(match func(room string) bool) ([]string, error) {
+	h.roomsMu.Lock()
+	defer h.roomsMu.Unlock()
+	var left []string
+	var errs RoomErrors
+	prefix := h.broadcastName("")
+	for roomName := range h.rooms {
+		room := strings.TrimPrefix(roomName, prefix)
+		if !match(room) {
+			continue
 		}
+		if err := h.baseHandler.broadcast.Leave(roomName, h.socket); err != nil {
+			if errs == nil {
+				errs = make(RoomErrors)
+			}
+			errs[room] = err
+			continue
+		}
+		delete(h.rooms, roomName)
+		left = append(left, room)
 	}
-	return nil
+	sort.Strings(left)
+	if errs != nil {
+		return left, errs
+	}
+	return left, nil
 }
 
 func (h *baseHandler) BroadcastTo(room, event string, args ...interface{}) error {
 	return h.broadcast.Send(nil, h.broadcastName(room), event, args...)
 }
 
+// BroadcastToExcept broadcasts an event to the room with given args, skipping
+// the except socket. A nil except sends to every member of the room.
+func (h *baseHandler) BroadcastToExcept(room, event string, except Socket, args ...interface{}) error {
+	return h.broadcast.Send(except, h.broadcastName(room), event, args...)
+}
+
 func (h *socketHandler) BroadcastTo(room, event string, args ...interface{}) error {
 	return h.baseHandler.broadcast.Send(h.socket, h.broadcastName(room), event, args...)
 }
 
+// BroadcastToNamespace broadcasts an event with given args to the room of the
+// namespace nsp, "" or "/" for the default one, instead of the room of this
+// namespace. The adaptor keys the rooms of every namespace, so the members get
+// the event on the namespace they joined the room on.
+func (h *baseHandler) BroadcastToNamespace(nsp, room, event string, args ...interface{}) error {
+	return h.broadcast.Send(nil, nspRoomName(nsp, room), event, args...)
+}
+
+// BroadcastToNamespace broadcasts an event like
+// baseHandler.BroadcastToNamespace, except to this socket.
+func (h *socketHandler) BroadcastToNamespace(nsp, room, event string, args ...interface{}) error {
+	return h.baseHandler.broadcast.Send(h.socket, nspRoomName(nsp, room), event, args...)
+}
+
+// BroadcastToRooms broadcasts an event with given args to the sockets in any
+// of the rooms. A socket in several of the rooms gets the event once if the
+// adaptor is a RoomsSender, like the default one.
+func (h *baseHandler) BroadcastToRooms(rooms []string, event string, args ...interface{}) error {
+	return h.broadcastToRooms(nil, rooms, event, args)
+}
+
+// BroadcastToRooms broadcasts an event like baseHandler.BroadcastToRooms,
+// except to this socket.
+func (h *socketHandler) BroadcastToRooms(rooms []string, event string, args ...interface{}) error {
+	return h.broadcastToRooms(h.socket, rooms, event, args)
+}
+
+// BroadcastToSample broadcasts an event with given args to a random fraction
+// of the sockets in the room, like for canary pushes. A fraction <= 0 sends to
+// none of them, >= 1 to all of them. Adaptors which aren't RoomSampler send to
+// a sample of the members they return, so adaptors relaying broadcasts to
+// other nodes must be RoomSampler for the members of the other nodes.
+func (h *baseHandler) BroadcastToSample(room, event string, fraction float64, args ...interface{}) error {
+	return h.broadcastToSample(nil, room, event, fraction, args)
+}
+
+// BroadcastToSample broadcasts an event like baseHandler.BroadcastToSample,
+// except to this socket.
+func (h *socketHandler) BroadcastToSample(room, event string, fraction float64, args ...interface{}) error {
+	return h.broadcastToSample(h.socket, room, event, fraction, args)
+}
+
+func (h *baseHandler) broadcastToSample(except Socket, room, event string, fraction float64, args []interface{}) error {
+	if s, ok := h.broadcast.(RoomSampler); ok {
+		return s.SendSample(except, h.broadcastName(room), event, fraction, args...)
+	}
+	members, err := h.broadcast.Members(h.broadcastName(room))
+	if err != nil {
+		return err
+	}
+	e := newRoomEmitter(event, args)
+	for _, so := range sampleSockets(sampleRand, members, except, fraction) {
+		e.emit(so)
+	}
+	return e.err
+}
+
+// ErrAdaptorNotLocal is returned by BroadcastToWithAck when the broadcast
+// adaptor isn't a LocalAdaptor, as it can't collect the acks of the sockets
+// of other nodes.
+var ErrAdaptorNotLocal = errors.New("socketio: broadcast with ack needs the local adaptor")
+
+// AckError is returned by BroadcastToWithAck when sockets of the room didn't
+// ack the broadcast.
+type AckError struct {
+	// Errors maps the ids of the sockets to their error: ErrAckTimeout,
+	// ErrSocketClosed if disconnected before acking, or the error of the
+	// emit.
+	Errors map[string]error
+}
+
+func (e *AckError) Error() string {
+	ids := make([]string, 0, len(e.Errors))
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		msgs[i] = id + ": " + e.Errors[id].Error()
+	}
+	return "socketio: broadcast not acked by " + strings.Join(msgs, ", ")
+}
+
+// BroadcastToWithAck emits an event with given args to the sockets in the
+// room, and returns the args of their acks, in the order they come, once they
+// all acked or timeout expired. The acks coming later are dropped. If some
+// sockets failed to emit, timed out or were disconnected, an *AckError with
+// the error of each is returned along with the acks received. It only reaches
+// the sockets of this server, so it returns ErrAdaptorNotLocal unless the
+// adaptor is a LocalAdaptor.
+func (h *baseHandler) BroadcastToWithAck(room, event string, timeout time.Duration, args ...interface{}) ([][]interface{}, error) {
+	return h.broadcastToWithAck(nil, room, event, timeout, args)
+}
+
+// BroadcastToWithAck broadcasts an event like baseHandler.BroadcastToWithAck,
+// except to this socket.
+func (h *socketHandler) BroadcastToWithAck(room, event string, timeout time.Duration, args ...interface{}) ([][]interface{}, error) {
+	return h.broadcastToWithAck(h.socket, room, event, timeout, args)
+}
+
+func (h *baseHandler) broadcastToWithAck(except Socket, room, event string, timeout time.Duration, args []interface{}) ([][]interface{}, error) {
+	if l, ok := h.broadcast.(LocalAdaptor); !ok || !l.Local() {
+		return nil, ErrAdaptorNotLocal
+	}
+	members, err := h.broadcast.Members(h.broadcastName(room))
+	if err != nil {
+		return nil, err
+	}
+	errs := make(map[string]error)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	type result struct {
+		id   string
+		args []interface{}
+		err  error
+	}
+	results := make(chan result, len(members))
+	n := 0
+	for _, so := range members {
+		if except != nil && so.Id() == except.Id() {
+			continue
+		}
+		a, err := so.EmitWithAck(event, args...)
+		if err != nil {
+			errs[so.Id()] = err
+			continue
+		}
+		n++
+		go func(id string, a *Ack) {
+			args, err := a.Wait(ctx)
+			if err == context.DeadlineExceeded {
+				err = ErrAckTimeout
+			}
+			results <- result{id, args, err}
+		}(so.Id(), a)
+	}
+	var ret [][]interface{}
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.err != nil {
+			errs[r.id] = r.err
+			continue
+		}
+		ret = append(ret, r.args)
+	}
+	if len(errs) > 0 {
+		return ret, &AckError{Errors: errs}
+	}
+	return ret, nil
+}
+
+// Broadcaster emits events to the sockets in a set of rooms. It's returned by
+// To, like
+//
+//	so.To("room1").To("room2").Emit("event", args...)
+type Broadcaster struct {
+	h      *baseHandler
+	except Socket
+	rooms  []string
+}
+
+// To returns a Broadcaster emitting to the room.
+func (h *baseHandler) To(room string) *Broadcaster {
+	return &Broadcaster{
+		h:     h,
+		rooms: []string{room},
+	}
+}
+
+// To returns a Broadcaster emitting to the room, except this socket.
+func (h *socketHandler) To(room string) *Broadcaster {
+	return &Broadcaster{
+		h:      h.baseHandler,
+		except: h.socket,
+		rooms:  []string{room},
+	}
+}
+
+// To returns a Broadcaster emitting to the room as well.
+func (b *Broadcaster) To(room string) *Broadcaster {
+	rooms := make([]string, len(b.rooms), len(b.rooms)+1)
+	copy(rooms, b.rooms)
+	return &Broadcaster{
+		h:      b.h,
+		except: b.except,
+		rooms:  append(rooms, room),
+	}
+}
+
+// Emit emits an event with given args to the sockets in any of the rooms. A
+// socket in several of the rooms gets the event once if the adaptor is a
+// RoomsSender, like the default one.
+func (b *Broadcaster) Emit(event string, args ...interface{}) error {
+	return b.h.broadcastToRooms(b.except, b.rooms, event, args)
+}
+
+// broadcastToRooms sends the event once to every socket in the rooms, except
+// the except socket. Several rooms are sent by adaptors which are RoomsSender,
+// else by a Send per room, and the sockets in several of the rooms get the
+// event once per room.
+func (h *baseHandler) broadcastToRooms(except Socket, rooms []string, event string, args []interface{}) error {
+	var distinct []string
+	seen := make(map[string]bool, len(rooms))
+	for _, room := range rooms {
+		name := h.broadcastName(room)
+		if !seen[name] {
+			seen[name] = true
+			distinct = append(distinct, name)
+		}
+	}
+	if len(distinct) == 1 {
+		return h.broadcast.Send(except, distinct[0], event, args...)
+	}
+	if s, ok := h.broadcast.(RoomsSender); ok {
+		return s.SendRooms(except, distinct, event, args...)
+	}
+	for _, name := range distinct {
+		if err := h.broadcast.Send(except, name, event, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RoomMembers returns the sockets currently in the room.
+func (h *baseHandler) RoomMembers(room string) ([]Socket, error) {
+	return h.broadcast.Members(h.broadcastName(room))
+}
+
+// nspEscaper escapes the colons of namespace names, so the first colon of a
+// broadcast name ends its namespace and rooms with colons don't collide with
+// the rooms of other namespaces.
+var nspEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
+
+// broadcastName returns the name of the room of the namespace in the adaptor,
+// like "/chat:room".
 func (h *baseHandler) broadcastName(room string) string {
-	return fmt.Sprintf("%s:%s", h.name, room)
+	return nspRoomName(h.name, room)
+}
+
+// nspRoomName returns the name of the room of the namespace nsp in the
+// adaptor, "/" being the default namespace "".
+func nspRoomName(nsp, room string) string {
+	if nsp == "/" {
+		nsp = ""
+	}
+	return fmt.Sprintf("%s:%s", nspEscaper.Replace(nsp), room)
 }
 
 var unknownNS = errors.New("socketio: unknown namespace for on packet")
@@ -112,6 +704,19 @@ var unknownNS = errors.New("socketio: unknown namespace for on packet")
 // onPacket handle the event callback On based on the incoming packet. packet
 // is already been partially decode. Only packet data is not decoded.
 func (h *socketHandler) onPacket(decoder *decoder, packet *packet) ([]interface{}, error) {
+	run, err := h.prepare(decoder, packet)
+	if err != nil || run == nil {
+		return nil, err
+	}
+	return run()
+}
+
+// prepare reads the packet, returning the func calling its handler with the
+// args decoded, or nil if it has no handler. Acks are handled by prepare. The
+// packet is read once prepare returns, so the handler may run on another
+// goroutine.
+func (h *socketHandler) prepare(decoder *decoder, packet *packet) (func() ([]interface{}, error), error) {
+	isEvent := packet.Type == _EVENT || packet.Type == _BINARY_EVENT
 	var message string
 	switch packet.Type {
 	case _CONNECT:
@@ -131,37 +736,145 @@ func (h *socketHandler) onPacket(decoder *decoder, packet *packet) ([]interface{
 	}
 	h.evMu.Lock()
 	c, ok := h.events[message]
+	if !ok && isEvent {
+		c, ok = h.matchPattern(message)
+	}
+	anyHandler := h.anyHandler
 	h.evMu.Unlock()
+	if !ok && isEvent && anyHandler != nil {
+		call, err := h.onAny(anyHandler, decoder, packet, message)
+		if err != nil {
+			return nil, err
+		}
+		return func() ([]interface{}, error) {
+			return nil, call()
+		}, nil
+	}
 	if !ok {
-		// If the message is not recognized by the server, the decoder.currentCloser
-		// needs to be closed otherwise the server will be stuck until the e
-		if decoder != nil {
-			decoder.Close()
+		// If the message is not recognized by the server, the rest of the
+		// packet needs to be skipped, otherwise the next packets can't be
+		// read. Failing to skip it leaves the connection in a bad state.
+		if isEvent {
+			h.socket.logger.Debugf("socketio: socket %s: event %q without handler dropped", h.socket.Id(), message)
 		}
-		return nil, nil
+		return nil, decoder.Discard(packet)
+	}
+	ctx := EventContext{
+		Socket:    h.socket,
+		EventName: message,
+		AckId:     packet.Id,
+		Namespace: h.name,
+	}
+	if !isEvent {
+		ctx.AckId = -1
 	}
 	args := c.GetArgs()
 	olen := len(args)
-	if olen > 0 && decoder != nil {
+	var respond interface{}
+	if c.Responder {
+		respond = args[olen-1]
+		olen--
+		args = args[:olen:olen]
+		// the ack is sent by the responder instead of the loop.
+		id := packet.Id
+		packet.Id = -1
+		reflect.ValueOf(respond).Elem().Set(h.ackResponder(c.Args[olen], id))
+	}
+	if c.Variadic {
+		// handlers taking ...interface{} get all args.
+		values := []interface{}{}
+		if decoder != nil {
+			packet.Data = &values
+			if err := decoder.DecodeData(packet); err != nil {
+				return nil, err
+			}
+		} else if v, ok := packet.Data.([]interface{}); ok {
+			values = v
+		}
+		args = []interface{}{&values}
+	} else if olen > 0 && decoder != nil {
+		wrapNumbers(args)
 		packet.Data = &args
 		if err := decoder.DecodeData(packet); err != nil {
 			return nil, err
 		}
+		unwrapNumbers(args)
+	} else if values, ok := packet.Data.([]interface{}); ok {
+		// server side events like disconnection carry their args.
+		setArgs(args, values)
 	}
 	for i := len(args); i < olen; i++ {
 		args = append(args, nil)
 	}
+	if respond != nil {
+		args = append(args, respond)
+	}
+	// handlers without args leave the packet data unread.
+	if err := decoder.Discard(packet); err != nil {
+		return nil, err
+	}
 
-	retV := c.Call(h.socket, args)
+	return func() ([]interface{}, error) {
+		var retV []reflect.Value
+		var dur time.Duration
+		called := false
+		call := func() (err error) {
+			if h.socket.recoverPanics {
+				defer h.recoverPanic(message, &err)
+			}
+			called = true
+			if h.socket.dispatched != nil {
+				start := time.Now()
+				defer func() {
+					dur = time.Since(start)
+				}()
+			}
+			retV = c.CallContext(ctx, args)
+			return nil
+		}
+		var err error
+		if isEvent && len(h.middlewares) > 0 {
+			err = h.runMiddlewares(message, args, call)
+		} else {
+			err = call()
+		}
+		var ret []interface{}
+		if err == nil {
+			ret, err = results(retV)
+		}
+		if f := h.socket.dispatched; f != nil && isEvent && called {
+			f(h.name, message, dur, err)
+		}
+		return ret, err
+	}, nil
+}
+
+// AckArgs is the args of the ack of an event, which a handler returns to set
+// them explicitly, alone or followed by an error. Its values are the args, even
+// if the last one is an error, and a nil AckArgs is an empty ack.
+type AckArgs []interface{}
+
+// results returns the values returned by a handler, and the error if the last
+// one is declared as error. A single AckArgs value returns its values.
+func results(retV []reflect.Value) ([]interface{}, error) {
 	if len(retV) == 0 {
 		return nil, nil
 	}
-
 	var err error
-	if last, ok := retV[len(retV)-1].Interface().(error); ok {
-		err = last
+	if last := retV[len(retV)-1]; last.Type() == errorType {
+		if !last.IsNil() {
+			err = last.Interface().(error)
+		}
 		retV = retV[0 : len(retV)-1]
 	}
+	if len(retV) == 1 {
+		if args, ok := retV[0].Interface().(AckArgs); ok {
+			if args == nil {
+				return []interface{}{}, err
+			}
+			return args, err
+		}
+	}
 	ret := make([]interface{}, len(retV))
 	for i, v := range retV {
 		ret[i] = v.Interface()
@@ -169,22 +882,137 @@ func (h *socketHandler) onPacket(decoder *decoder, packet *packet) ([]interface{
 	return ret, err
 }
 
-func (h *socketHandler) onAck(id int, decoder *decoder, packet *packet) error {
+// onAny decodes the args of an event without handler, returning the func
+// dispatching it to f.
+func (h *socketHandler) onAny(f func(Socket, string, ...interface{}), decoder *decoder, packet *packet, event string) (func() error, error) {
+	var values []interface{}
+	packet.Data = &values
+	if err := decoder.DecodeData(packet); err != nil {
+		return nil, err
+	}
+	decoder.Close()
+	// middlewares get pointers to the args like for the handlers of On.
+	args := make([]interface{}, len(values))
+	for i := range values {
+		args[i] = &values[i]
+	}
+	call := func() (err error) {
+		if h.socket.recoverPanics {
+			defer h.recoverPanic(event, &err)
+		}
+		f(h.socket, event, values...)
+		return nil
+	}
+	return func() error {
+		if len(h.middlewares) > 0 {
+			return h.runMiddlewares(event, args, call)
+		}
+		return call()
+	}, nil
+}
+
+// ackResponder returns a func of type t sending its args as the ack id of an
+// event, once. It does nothing if the client doesn't ask for an ack, when id
+// is negative. If t returns an error, it's the error sending the ack.
+func (h *socketHandler) ackResponder(t reflect.Type, id int) reflect.Value {
+	var once sync.Once
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		var err error
+		if id >= 0 {
+			once.Do(func() {
+				if t.IsVariadic() {
+					last := in[len(in)-1]
+					in = in[:len(in)-1]
+					for i, n := 0, last.Len(); i < n; i++ {
+						in = append(in, last.Index(i))
+					}
+				}
+				args := make([]interface{}, len(in))
+				for i, v := range in {
+					args[i] = v.Interface()
+				}
+				err = h.socket.encode(packet{
+					Type: _ACK,
+					Id:   id,
+					NSP:  h.socket.name,
+					Data: args,
+				})
+			})
+		}
+		out := make([]reflect.Value, t.NumOut())
+		for i := range out {
+			if t.Out(i) == errorType {
+				out[i] = reflect.ValueOf(&err).Elem()
+			} else {
+				out[i] = reflect.Zero(t.Out(i))
+			}
+		}
+		return out
+	})
+}
+
+// runMiddlewares runs the middlewares of the handler in order, ending with
+// dispatch.
+func (h *socketHandler) runMiddlewares(event string, args []interface{}, dispatch func() error) error {
+	var next func(i int) error
+	next = func(i int) error {
+		if i == len(h.middlewares) {
+			return dispatch()
+		}
+		return h.middlewares[i].f(h.socket, event, args, func() error {
+			return next(i + 1)
+		})
+	}
+	return next(0)
+}
+
+func (h *socketHandler) onAck(id int, decoder *decoder, packet *packet) (err error) {
 	h.socket.acksmu.Lock()
 	c, ok := h.socket.acks[id]
 	if !ok {
 		h.socket.acksmu.Unlock()
-		return nil
+		// a late ack, like after a timeout, is read to its end so the
+		// connection reads the next packets.
+		return decoder.Discard(packet)
 	}
 	delete(h.socket.acks, id)
+	delete(h.socket.ackSockets, id)
+	if t, ok := h.socket.ackTimers[id]; ok {
+		t.Stop()
+		delete(h.socket.ackTimers, id)
+	}
 	h.socket.acksmu.Unlock()
 
-	args := c.GetArgs()
-	packet.Data = &args
-	if err := decoder.DecodeData(packet); err != nil {
-		return err
+	var args []interface{}
+	if c.Variadic {
+		values := []interface{}{}
+		packet.Data = &values
+		if err := decoder.DecodeData(packet); err != nil {
+			return err
+		}
+		args = []interface{}{&values}
+	} else {
+		args = c.GetArgs()
+		wrapNumbers(args)
+		packet.Data = &args
+		if err := decoder.DecodeData(packet); err != nil {
+			return err
+		}
+		unwrapNumbers(args)
 	}
 
+	if h.socket.recoverPanics {
+		defer h.recoverPanic(fmt.Sprintf("ack %d", id), &err)
+	}
 	c.Call(h.socket, args)
 	return nil
 }
+
+// recoverPanic turns a panic of the handler of event into an error closing
+// the connection, so the socket is cleaned up like on other errors.
+func (h *socketHandler) recoverPanic(event string, err *error) {
+	if r := recover(); r != nil {
+		h.socket.logger.Errorf("socketio: socket %s: handler of %q panicked: %v\n%s", h.socket.Id(), event, r, debug.Stack())
+		*err = fmt.Errorf("socketio: handler of %q panicked: %v", event, r)
+	}
+}
@@ -1,6 +1,7 @@
 package socketio
 
 import (
+	"errors"
 	"testing"
 
 	"io"
@@ -24,6 +25,10 @@ func (f *FakeBroadcastAdaptor) Send(ignore Socket, room, event string, args ...i
 	return nil
 }
 
+func (f *FakeBroadcastAdaptor) Members(room string) ([]Socket, error) {
+	return nil, nil
+}
+
 type FakeReadCloser struct{}
 
 func (fr *FakeReadCloser) Read(p []byte) (n int, err error) {
@@ -101,3 +106,898 @@ func TestHandler(t *testing.T) {
 		So(handlerCalled, ShouldBeTrue)
 	})
 }
+
+func TestBroadcastToExcept(t *testing.T) {
+
+	Convey("Broadcast skips the excepted socket only", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		conns := []*PipeConn{NewPipeConn("a"), NewPipeConn("b"), NewPipeConn("c")}
+		var sockets []*nspSocket
+		for _, conn := range conns {
+			so := newSocket(conn, ns).namespace("")
+			So(so.Join("room"), ShouldBeNil)
+			sockets = append(sockets, so)
+		}
+
+		err := ns.BroadcastToExcept("room", "ev", sockets[1], "data")
+		So(err, ShouldBeNil)
+		So(conns[0].Frames(), ShouldResemble, []string{`2["ev","data"]`})
+		So(conns[1].Frames(), ShouldBeEmpty)
+		So(conns[2].Frames(), ShouldResemble, []string{`2["ev","data"]`})
+
+		err = sockets[0].BroadcastToExcept("room", "ev2", nil)
+		So(err, ShouldBeNil)
+		So(len(conns[1].Frames()), ShouldEqual, 1)
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+
+	Convey("Middlewares run in order and can abort dispatch", t, func() {
+		errDenied := errors.New("denied")
+		conn := NewPipeConn("test1")
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		var order []string
+		ns.Use(func(so Socket, event string, args []interface{}, next func() error) error {
+			order = append(order, "log:"+event)
+			return next()
+		})
+		ns.Use(func(so Socket, event string, args []interface{}, next func() error) error {
+			order = append(order, "auth:"+event)
+			if event == "secret" {
+				return errDenied
+			}
+			return next()
+		})
+		got := make(chan string, 1)
+		ns.On("ev", func(msg string) {
+			got <- msg
+		})
+		ns.On("secret", func() {
+			got <- "secret"
+		})
+
+		socketInstance := newSocket(conn, ns)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- socketInstance.loop()
+		}()
+
+		conn.Send(`2["ev","x"]`)
+		So(<-got, ShouldEqual, "x")
+		conn.Send(`2["secret"]`)
+		So(<-errc, ShouldEqual, errDenied)
+		So(got, ShouldBeEmpty)
+		So(order, ShouldResemble, []string{"log:ev", "auth:ev", "log:secret", "auth:secret"})
+	})
+
+	Convey("Middlewares run for the packets of their namespace only", t, func() {
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		ran := make(chan string, 4)
+		for _, nsp := range []string{"", "/chat"} {
+			nsp := nsp
+			root.Of(nsp).Use(func(so Socket, event string, args []interface{}, next func() error) error {
+				ran <- nsp + " " + event
+				return next()
+			})
+			So(root.Of(nsp).On("ev", func() {}), ShouldBeNil)
+		}
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, root)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.Send("0/chat")
+		conn.Send(`2/chat,1["ev"]`)
+		conn.Send(`22["ev"]`)
+		conn.WaitFrames(4)
+		conn.Close()
+		<-done
+		So(<-ran, ShouldEqual, "/chat ev")
+		So(<-ran, ShouldEqual, " ev")
+		So(ran, ShouldBeEmpty)
+	})
+
+	Convey("Removed middlewares don't run", t, func() {
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		var order []string
+		for _, name := range []string{"a", "b", "c"} {
+			name := name
+			ns.UseNamed(name, func(so Socket, event string, args []interface{}, next func() error) error {
+				order = append(order, name)
+				return next()
+			})
+		}
+		ns.UseNamed("c", func(so Socket, event string, args []interface{}, next func() error) error {
+			order = append(order, "c2")
+			return next()
+		})
+		ns.RemoveMiddleware("a")
+		ns.RemoveMiddleware("unknown")
+		So(ns.On("ev", func() {}), ShouldBeNil)
+		run := func() {
+			conn := NewPipeConn("test1")
+			socketInstance := newSocket(conn, ns)
+			done := make(chan struct{})
+			go func() {
+				socketInstance.loop()
+				close(done)
+			}()
+			conn.Send(`21["ev"]`)
+			conn.WaitFrames(2)
+			conn.Close()
+			<-done
+		}
+		run()
+		ns.RemoveMiddlewares()
+		run()
+		So(order, ShouldResemble, []string{"b", "c2"})
+	})
+}
+
+func TestOnValidation(t *testing.T) {
+	h := newBaseHandler("", &FakeBroadcastAdaptor{})
+
+	Convey("Nil handler is rejected", t, func() {
+		So(h.On("ev", nil), ShouldNotBeNil)
+		var f func()
+		So(h.On("ev", f), ShouldNotBeNil)
+		So(h.events, ShouldBeEmpty)
+	})
+
+	Convey("Non-function handler is rejected", t, func() {
+		So(h.On("ev", "handler"), ShouldNotBeNil)
+		So(h.events, ShouldBeEmpty)
+	})
+
+	Convey("Empty event name is rejected", t, func() {
+		So(h.On("", func() {}), ShouldNotBeNil)
+		So(h.events, ShouldBeEmpty)
+	})
+
+	Convey("Valid handler is registered", t, func() {
+		So(h.On("ev", func() {}), ShouldBeNil)
+		So(len(h.events), ShouldEqual, 1)
+	})
+}
+
+func TestHandlerAck(t *testing.T) {
+	ack := func(f interface{}) (string, error) {
+		conn := NewPipeConn("test1")
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		So(ns.On("ev", f), ShouldBeNil)
+		socketInstance := newSocket(conn, ns)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- socketInstance.loop()
+		}()
+		conn.Send(`21["ev"]`)
+		frames := conn.WaitFrames(2)
+		conn.Close()
+		err := <-errc
+		if len(frames) < 2 {
+			return "", err
+		}
+		return frames[1], err
+	}
+
+	Convey("Handler returning (string, error)", t, func() {
+		frame, err := ack(func() (string, error) {
+			return "ok", nil
+		})
+		So(frame, ShouldEqual, `31["ok"]`)
+		So(err, ShouldEqual, io.EOF)
+	})
+
+	Convey("Handler returning (error)", t, func() {
+		frame, _ := ack(func() error {
+			return nil
+		})
+		So(frame, ShouldEqual, `31[]`)
+
+		errFailed := errors.New("failed")
+		frame, err := ack(func() error {
+			return errFailed
+		})
+		So(frame, ShouldEqual, "")
+		So(err, ShouldEqual, errFailed)
+	})
+
+	Convey("Handler returning (int, string)", t, func() {
+		frame, _ := ack(func() (int, string) {
+			return 1, "a"
+		})
+		So(frame, ShouldEqual, `31[1,"a"]`)
+	})
+
+	Convey("Handler returning nothing", t, func() {
+		frame, _ := ack(func(so Socket) {})
+		So(frame, ShouldEqual, `31[]`)
+	})
+
+	Convey("Handler returning AckArgs", t, func() {
+		frame, _ := ack(func() AckArgs {
+			return nil
+		})
+		So(frame, ShouldEqual, `31[]`)
+
+		frame, _ = ack(func() (AckArgs, error) {
+			return AckArgs{"ok"}, nil
+		})
+		So(frame, ShouldEqual, `31["ok"]`)
+
+		frame, _ = ack(func() (AckArgs, error) {
+			return AckArgs{1, "a", nil}, nil
+		})
+		So(frame, ShouldEqual, `31[1,"a",null]`)
+
+		errFailed := errors.New("failed")
+		frame, err := ack(func() (AckArgs, error) {
+			return AckArgs{"ok"}, errFailed
+		})
+		So(frame, ShouldEqual, "")
+		So(err, ShouldEqual, errFailed)
+	})
+}
+
+func TestBroadcasterTo(t *testing.T) {
+	ns := newNamespace(newBroadcastDefault())
+	conns := []*PipeConn{NewPipeConn("a"), NewPipeConn("b"), NewPipeConn("c"), NewPipeConn("d")}
+	var sockets []*nspSocket
+	for _, conn := range conns {
+		sockets = append(sockets, newSocket(conn, ns).namespace(""))
+	}
+	sockets[0].Join("r1")
+	sockets[1].Join("r1")
+	sockets[1].Join("r2")
+	sockets[2].Join("r2")
+	count := func() []int {
+		var ret []int
+		for _, conn := range conns {
+			ret = append(ret, len(conn.Frames()))
+			conn.mu.Lock()
+			conn.frames = nil
+			conn.mu.Unlock()
+		}
+		return ret
+	}
+
+	Convey("Single room", t, func() {
+		So(sockets[3].To("r1").Emit("ev"), ShouldBeNil)
+		So(count(), ShouldResemble, []int{1, 1, 0, 0})
+	})
+
+	Convey("Multiple rooms with overlapping members", t, func() {
+		So(sockets[3].To("r1").To("r2").To("r1").Emit("ev"), ShouldBeNil)
+		So(count(), ShouldResemble, []int{1, 1, 1, 0})
+	})
+
+	Convey("Sender is excluded", t, func() {
+		So(sockets[1].To("r1").To("r2").Emit("ev"), ShouldBeNil)
+		So(count(), ShouldResemble, []int{1, 0, 1, 0})
+		So(ns.To("r1").To("r2").Emit("ev"), ShouldBeNil)
+		So(count(), ShouldResemble, []int{1, 1, 1, 0})
+	})
+
+	Convey("Chained To doesn't change the original", t, func() {
+		b := ns.To("r1")
+		b.To("r2")
+		So(b.Emit("ev"), ShouldBeNil)
+		So(count(), ShouldResemble, []int{1, 1, 0, 0})
+	})
+}
+
+func TestOnAny(t *testing.T) {
+
+	Convey("OnAny gets the events without a handler", t, func() {
+		conn := NewPipeConn("test1")
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		type event struct {
+			name string
+			args []interface{}
+		}
+		got := make(chan event, 3)
+		ns.OnAny(func(so Socket, name string, args ...interface{}) {
+			got <- event{name, args}
+		})
+
+		socketInstance := newSocket(conn, ns)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+
+		conn.Send(`2["foo"]`)
+		conn.Send(`2["bar","x",1]`)
+		conn.Send(`51-["baz",{"_placeholder":true,"num":0},{"a":true}]`)
+		conn.SendBinary([]byte("bin"))
+		So(<-got, ShouldResemble, event{"foo", []interface{}{}})
+		So(<-got, ShouldResemble, event{"bar", []interface{}{"x", float64(1)}})
+		So(<-got, ShouldResemble, event{"baz", []interface{}{"Ymlu", map[string]interface{}{"a": true}}})
+
+		conn.Close()
+		<-done
+	})
+}
+
+// failingLeaveAdaptor fails to leave the rooms in fail.
+type failingLeaveAdaptor struct {
+	BroadcastAdaptor
+	fail map[string]bool
+}
+
+func (f *failingLeaveAdaptor) Leave(room string, socket Socket) error {
+	if f.fail[room] {
+		return errors.New("leave failed")
+	}
+	return f.BroadcastAdaptor.Leave(room, socket)
+}
+
+func TestRooms(t *testing.T) {
+
+	Convey("Rooms returns the rooms as joined", t, func() {
+		root := newNamespace(newBroadcastDefault())
+		root.Of("/chat")
+		so := newSocket(&FakeSockConnection{}, root)
+		chat := so.namespace("/chat")
+		So(chat.Join("room2"), ShouldBeNil)
+		So(chat.Join("room1"), ShouldBeNil)
+		So(so.namespace("").Join("other"), ShouldBeNil)
+		So(chat.Rooms(), ShouldResemble, []string{"room1", "room2"})
+		So(so.namespace("").Rooms(), ShouldResemble, []string{"other"})
+	})
+}
+
+func TestRoomNamesWithColons(t *testing.T) {
+
+	Convey("Rooms with colons round-trip", t, func() {
+		root := newNamespace(newBroadcastDefault())
+		ns := newSocket(&FakeSockConnection{}, root).namespace("")
+		root.Of("/chat")
+		chat := newSocket(&FakeSockConnection{}, root).namespace("/chat")
+		So(chat.Join("user:123"), ShouldBeNil)
+		So(chat.Rooms(), ShouldResemble, []string{"user:123"})
+		members, err := chat.RoomMembers("user:123")
+		So(err, ShouldBeNil)
+		So(len(members), ShouldEqual, 1)
+		members, _ = ns.RoomMembers("user:123")
+		So(members, ShouldBeEmpty)
+		left, err := chat.LeaveMatching("user:")
+		So(err, ShouldBeNil)
+		So(left, ShouldResemble, []string{"user:123"})
+		So(chat.Rooms(), ShouldBeEmpty)
+	})
+
+	Convey("Rooms don't collide with rooms of namespaces with colons", t, func() {
+		root := newNamespace(newBroadcastDefault())
+		root.Of("/a")
+		root.Of("/a:b")
+		a := newSocket(&FakeSockConnection{}, root).namespace("/a")
+		So(a.Join("b:c"), ShouldBeNil)
+		members, _ := root.Of("/a:b").(*namespace).RoomMembers("c")
+		So(members, ShouldBeEmpty)
+		members, _ = root.Of("/a").(*namespace).RoomMembers("b:c")
+		So(len(members), ShouldEqual, 1)
+	})
+}
+
+func TestLeaveAll(t *testing.T) {
+
+	Convey("LeaveAll returns the rooms left", t, func() {
+		ns := newSocket(&FakeSockConnection{}, newNamespace(newBroadcastDefault())).namespace("")
+		for _, room := range []string{"b", "a", "c"} {
+			So(ns.Join(room), ShouldBeNil)
+		}
+		rooms, err := ns.LeaveAll()
+		So(err, ShouldBeNil)
+		So(rooms, ShouldResemble, []string{"a", "b", "c"})
+		So(ns.Rooms(), ShouldBeEmpty)
+	})
+
+	Convey("LeaveMatching only leaves the rooms with the prefix", t, func() {
+		root := newNamespace(newBroadcastDefault())
+		root.Of("/chat")
+		ns := newSocket(&FakeSockConnection{}, root).namespace("/chat")
+		for _, room := range []string{"user:1", "user:2", "game:1"} {
+			So(ns.Join(room), ShouldBeNil)
+		}
+		rooms, err := ns.LeaveMatching("user:")
+		So(err, ShouldBeNil)
+		So(rooms, ShouldResemble, []string{"user:1", "user:2"})
+		So(ns.Rooms(), ShouldResemble, []string{"game:1"})
+	})
+
+	Convey("Failing rooms don't stop leaving the others", t, func() {
+		adaptor := &failingLeaveAdaptor{
+			BroadcastAdaptor: newBroadcastDefault(),
+			fail:             map[string]bool{":b": true, ":d": true},
+		}
+		ns := newSocket(&FakeSockConnection{}, newNamespace(adaptor)).namespace("")
+		for _, room := range []string{"a", "b", "c", "d"} {
+			So(ns.Join(room), ShouldBeNil)
+		}
+		rooms, err := ns.LeaveAll()
+		So(rooms, ShouldResemble, []string{"a", "c"})
+		errs, ok := err.(RoomErrors)
+		So(ok, ShouldBeTrue)
+		So(len(errs), ShouldEqual, 2)
+		So(err.Error(), ShouldEqual, "socketio: failed to leave rooms: b: leave failed; d: leave failed")
+		So(ns.Rooms(), ShouldResemble, []string{"b", "d"})
+
+		// the rooms kept are left once the adaptor recovers.
+		delete(adaptor.fail, ":b")
+		rooms, err = ns.LeaveAll()
+		So(rooms, ShouldResemble, []string{"b"})
+		So(err, ShouldNotBeNil)
+		So(ns.Rooms(), ShouldResemble, []string{"d"})
+	})
+}
+
+func TestVariadicHandler(t *testing.T) {
+
+	Convey("Handlers taking ...interface{} get all args", t, func() {
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		got := make(chan []interface{}, 1)
+		So(ns.On("ev", func(so Socket, args ...interface{}) {
+			got <- args
+		}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, ns)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.Send(`2["ev","a",1]`)
+		So(<-got, ShouldResemble, []interface{}{"a", float64(1)})
+		conn.Close()
+		<-done
+	})
+}
+
+func TestAckResponder(t *testing.T) {
+
+	Convey("Handlers taking a func last ack the event when they call it", t, func() {
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		responders := make(chan func(...interface{}), 1)
+		So(ns.On("ev", func(so Socket, msg string, ack func(...interface{})) {
+			responders <- ack
+		}), ShouldBeNil)
+		So(ns.On("sync", func() {}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, ns)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.WaitFrames(1)
+		conn.Send(`21["ev","hi"]`)
+		ack := <-responders
+		ack("done", 1)
+		ack("again")
+		conn.Send(`22["sync"]`)
+		frames := conn.WaitFrames(3)
+		So(frames[1:], ShouldResemble, []string{`31["done",1]`, `32[]`})
+		conn.Close()
+		<-done
+	})
+
+	Convey("Error responders ack once, in place of the return values", t, func() {
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		responders := make(chan func(data interface{}) error, 1)
+		So(ns.On("rpc", func(msg string, respond func(data interface{}) error) string {
+			responders <- respond
+			return "ignored"
+		}), ShouldBeNil)
+		So(ns.On("ret", func(msg string) (string, error) {
+			return msg + "!", nil
+		}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, ns)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.WaitFrames(1)
+		conn.Send(`21["rpc","hi"]`)
+		respond := <-responders
+		// the handler returned already.
+		So(respond(map[string]string{"ok": "hi"}), ShouldBeNil)
+		So(respond("again"), ShouldBeNil)
+		conn.Send(`22["ret","hi"]`)
+		So(conn.WaitFrames(3)[1:], ShouldResemble, []string{`31[{"ok":"hi"}]`, `32["hi!"]`})
+		conn.Close()
+		<-done
+		So(conn.Frames(), ShouldHaveLength, 3)
+	})
+}
+
+func TestEventContext(t *testing.T) {
+
+	Convey("Handlers taking an EventContext first get the event details", t, func() {
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		got := make(chan EventContext, 2)
+		So(root.Of("/chat").On("ev", func(ctx EventContext, msg string) string {
+			got <- ctx
+			return msg
+		}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, root)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.Send("0/chat")
+		conn.Send(`2/chat,7["ev","hi"]`)
+		conn.Send(`2/chat,["ev","no ack"]`)
+		ctx := <-got
+		So(ctx.Socket, ShouldEqual, socketInstance.namespace("/chat"))
+		So(ctx.EventName, ShouldEqual, "ev")
+		So(ctx.AckId, ShouldEqual, 7)
+		So(ctx.Namespace, ShouldEqual, "/chat")
+		So((<-got).AckId, ShouldEqual, -1)
+		So(conn.WaitFrames(3)[2], ShouldEqual, `3/chat,7["hi"]`)
+		conn.Close()
+		<-done
+	})
+}
+
+var errCloseFailed = errors.New("close failed")
+
+// closeErrorConn fails to close the readers of its frames.
+type closeErrorConn struct {
+	*PipeConn
+}
+
+func (c closeErrorConn) NextReader() (engineio.MessageType, io.ReadCloser, error) {
+	t, r, err := c.PipeConn.NextReader()
+	if err != nil {
+		return t, r, err
+	}
+	return t, closeErrorReader{r}, nil
+}
+
+type closeErrorReader struct {
+	io.ReadCloser
+}
+
+func (closeErrorReader) Close() error {
+	return errCloseFailed
+}
+
+func TestDecoderCloseError(t *testing.T) {
+
+	Convey("Failing to skip an unknown event closes the connection", t, func() {
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(closeErrorConn{conn}, newNamespace(&FakeBroadcastAdaptor{}))
+		errc := make(chan error, 1)
+		go func() {
+			errc <- socketInstance.loop()
+		}()
+		conn.Send(`2["unknown","data"]`)
+		So(<-errc, ShouldEqual, errCloseFailed)
+	})
+}
+
+// failingJoinAdaptor fails to join the rooms in fail, and can't join several
+// rooms at once.
+type failingJoinAdaptor struct {
+	BroadcastAdaptor
+	fail map[string]bool
+}
+
+func (f *failingJoinAdaptor) Join(room string, socket Socket) error {
+	if f.fail[room] {
+		return errors.New("join failed")
+	}
+	return f.BroadcastAdaptor.Join(room, socket)
+}
+
+func TestJoinNew(t *testing.T) {
+
+	Convey("JoinNew tells the first join of a room", t, func() {
+		ns := newSocket(&FakeSockConnection{}, newNamespace(newBroadcastDefault())).namespace("")
+		joined, err := ns.JoinNew("room")
+		So(err, ShouldBeNil)
+		So(joined, ShouldBeTrue)
+		joined, err = ns.JoinNew("room")
+		So(err, ShouldBeNil)
+		So(joined, ShouldBeFalse)
+		So(ns.Leave("room"), ShouldBeNil)
+		joined, err = ns.JoinNew("room")
+		So(err, ShouldBeNil)
+		So(joined, ShouldBeTrue)
+	})
+
+	Convey("JoinNew fails like Join", t, func() {
+		adaptor := &failingJoinAdaptor{
+			BroadcastAdaptor: newBroadcastDefault(),
+			fail:             map[string]bool{":room": true},
+		}
+		ns := newSocket(&FakeSockConnection{}, newNamespace(adaptor)).namespace("")
+		joined, err := ns.JoinNew("room")
+		So(err, ShouldNotBeNil)
+		So(joined, ShouldBeFalse)
+		So(ns.Rooms(), ShouldBeEmpty)
+	})
+}
+
+func TestJoinAll(t *testing.T) {
+
+	Convey("JoinAll joins all rooms", t, func() {
+		adaptor := newBroadcastDefault()
+		ns := newSocket(&FakeSockConnection{}, newNamespace(adaptor)).namespace("")
+		rooms := []string{"a", "b", "c", "d", "e"}
+		So(ns.JoinAll(rooms...), ShouldBeNil)
+		So(len(ns.Rooms()), ShouldEqual, 5)
+		for _, room := range rooms {
+			members, err := ns.RoomMembers(room)
+			So(err, ShouldBeNil)
+			So(len(members), ShouldEqual, 1)
+		}
+	})
+
+	Convey("JoinAll rolls back the rooms joined before a failure", t, func() {
+		adaptor := &failingJoinAdaptor{
+			BroadcastAdaptor: newBroadcastDefault(),
+			fail:             map[string]bool{":d": true},
+		}
+		ns := newSocket(&FakeSockConnection{}, newNamespace(adaptor)).namespace("")
+		So(ns.Join("a"), ShouldBeNil)
+		So(ns.JoinAll("a", "b", "c", "d", "e"), ShouldNotBeNil)
+		So(ns.Rooms(), ShouldResemble, []string{"a"})
+		for room, want := range map[string]int{"a": 1, "b": 0, "c": 0, "d": 0, "e": 0} {
+			members, err := ns.RoomMembers(room)
+			So(err, ShouldBeNil)
+			So(len(members), ShouldEqual, want)
+		}
+	})
+}
+
+func TestEvents(t *testing.T) {
+
+	Convey("Events lists the registered events", t, func() {
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		So(ns.Events(), ShouldBeEmpty)
+		for _, event := range []string{"b", "connection", "a"} {
+			So(ns.On(event, func() {}), ShouldBeNil)
+		}
+		events := ns.Events()
+		So(events, ShouldResemble, []string{"a", "b", "connection"})
+
+		events[0] = "changed"
+		So(ns.Events(), ShouldResemble, []string{"a", "b", "connection"})
+
+		so := newSocket(&FakeSockConnection{}, ns).namespace("")
+		So(so.On("c", func() {}), ShouldBeNil)
+		So(so.Events(), ShouldResemble, []string{"a", "b", "c", "connection"})
+		So(ns.Events(), ShouldResemble, []string{"a", "b", "connection"})
+	})
+}
+
+func TestOff(t *testing.T) {
+
+	Convey("Events are dropped after Off", t, func() {
+		conn := NewPipeConn("test1")
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		got := make(chan string, 4)
+		for _, event := range []string{"a", "b"} {
+			event := event
+			So(ns.On(event, func(msg string) {
+				got <- event + msg
+			}), ShouldBeNil)
+		}
+		socketInstance := newSocket(conn, ns)
+		so := socketInstance.namespace("")
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+
+		conn.Send(`2["a","1"]`)
+		So(<-got, ShouldEqual, "a1")
+		so.Off("a")
+		conn.Send(`2["a","2"]`)
+		conn.Send(`2["b","2"]`)
+		So(<-got, ShouldEqual, "b2")
+		so.RemoveAll()
+		So(so.Events(), ShouldBeEmpty)
+		conn.Send(`21["b","3"]`)
+		So(conn.WaitFrames(2)[1], ShouldEqual, "31[]")
+		conn.Close()
+		<-done
+		So(got, ShouldBeEmpty)
+		So(ns.Events(), ShouldResemble, []string{"a", "b"})
+	})
+}
+
+func TestBroadcastToRooms(t *testing.T) {
+
+	Convey("Sockets in several rooms get the event once", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		conns := []*PipeConn{NewPipeConn("a"), NewPipeConn("b"), NewPipeConn("c")}
+		var sockets []*nspSocket
+		for _, conn := range conns {
+			sockets = append(sockets, newSocket(conn, ns).namespace(""))
+		}
+		So(sockets[0].JoinAll("r1", "r2"), ShouldBeNil)
+		So(sockets[1].JoinAll("r1", "r2", "r3"), ShouldBeNil)
+		So(sockets[2].JoinAll("r3"), ShouldBeNil)
+
+		So(ns.BroadcastToRooms([]string{"r1", "r2", "r3"}, "ev", 1), ShouldBeNil)
+		So(sockets[0].BroadcastToRooms([]string{"r1", "r2", "r3"}, "ev", 2), ShouldBeNil)
+		So(conns[0].Frames(), ShouldResemble, []string{`2["ev",1]`})
+		So(conns[1].Frames(), ShouldResemble, []string{`2["ev",1]`, `2["ev",2]`})
+		So(conns[2].Frames(), ShouldResemble, []string{`2["ev",1]`, `2["ev",2]`})
+	})
+
+	Convey("Adaptors which aren't RoomsSender get a Send per room", t, func() {
+		a := &sendRecorder{}
+		ns := newNamespace(a)
+		So(ns.BroadcastToRooms([]string{"r1", "r2", "r1"}, "ev", 1), ShouldBeNil)
+		So(a.rooms, ShouldResemble, []string{":r1", ":r2"})
+	})
+}
+
+// sendRecorder is a broadcast adaptor recording the rooms sent to.
+type sendRecorder struct {
+	FakeBroadcastAdaptor
+	rooms []string
+}
+
+func (a *sendRecorder) Send(ignore Socket, room, event string, args ...interface{}) error {
+	a.rooms = append(a.rooms, room)
+	return nil
+}
+
+func TestRecoverPanics(t *testing.T) {
+
+	Convey("Panics of handlers close their socket only", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		So(ns.On("boom", func() {
+			panic("boom")
+		}), ShouldBeNil)
+		got := make(chan string, 1)
+		So(ns.On("ok", func(msg string) {
+			got <- msg
+		}), ShouldBeNil)
+		errs := make(chan error, 1)
+		So(ns.On("error", func(so Socket, err error) {
+			errs <- err
+		}), ShouldBeNil)
+		reasons := make(chan string, 2)
+		So(ns.On("disconnection", func(so Socket, reason string) {
+			reasons <- reason
+		}), ShouldBeNil)
+
+		var conns []*PipeConn
+		var loops []chan error
+		for _, id := range []string{"a", "b"} {
+			conn := NewPipeConn(id)
+			socketInstance := newSocket(conn, ns)
+			socketInstance.recoverPanics = true
+			So(socketInstance.namespace("").Join("room"), ShouldBeNil)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- socketInstance.loop()
+			}()
+			conns = append(conns, conn)
+			loops = append(loops, errc)
+		}
+
+		conns[0].Send(`2["boom"]`)
+		err := <-loops[0]
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, `socketio: handler of "boom" panicked: boom`)
+		So(<-errs, ShouldEqual, err)
+		So(<-reasons, ShouldEqual, ReasonServerError)
+		members, _ := ns.RoomMembers("room")
+		So(len(members), ShouldEqual, 1)
+
+		conns[1].Send(`2["ok","still here"]`)
+		So(<-got, ShouldEqual, "still here")
+		conns[1].Close()
+		<-loops[1]
+	})
+}
+
+func TestHandlerNumbers(t *testing.T) {
+	handle := func(ns *namespace, frame string) error {
+		errs := make(chan error, 1)
+		ns.On("error", func(so Socket, err error) {
+			errs <- err
+		})
+		conn := NewPipeConn("test1")
+		done := make(chan struct{})
+		go func() {
+			newSocket(conn, ns).loop()
+			close(done)
+		}()
+		conn.Send(frame)
+		conn.WaitFrames(1)
+		conn.Close()
+		<-done
+		select {
+		case err := <-errs:
+			return err
+		default:
+			return nil
+		}
+	}
+
+	Convey("Numbers are converted to the type of the args", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		var i64 int64
+		var f32 float32
+		var i int
+		ns.On("i64", func(v int64) { i64 = v })
+		ns.On("f32", func(v float32) { f32 = v })
+		ns.On("int", func(v *int) { i = *v })
+		So(handle(ns, `2["i64",9007199254740993]`), ShouldBeNil)
+		So(i64, ShouldEqual, int64(9007199254740993))
+		So(handle(ns, `2["f32",1.5]`), ShouldBeNil)
+		So(f32, ShouldEqual, float32(1.5))
+		So(handle(ns, `2["int",3.0]`), ShouldBeNil)
+		So(i, ShouldEqual, 3)
+		So(handle(ns, `2["int",-2e3]`), ShouldBeNil)
+		So(i, ShouldEqual, -2000)
+	})
+
+	Convey("Numbers out of the range of the args fail", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		ns.On("i64", func(v int64) {})
+		ns.On("f32", func(v float32) {})
+		ns.On("u8", func(v uint8) {})
+		ns.On("int", func(v int) {})
+		So(handle(ns, `2["i64",1e30]`).Error(), ShouldEqual, "socketio: 1e30 overflows int64")
+		So(handle(ns, `2["i64",9223372036854775808]`).Error(), ShouldEqual, "socketio: 9223372036854775808 overflows int64")
+		So(handle(ns, `2["f32",1e39]`).Error(), ShouldEqual, "socketio: 1e39 overflows float32")
+		So(handle(ns, `2["u8",256]`).Error(), ShouldEqual, "socketio: 256 overflows uint8")
+		So(handle(ns, `2["u8",-1]`).Error(), ShouldEqual, "socketio: -1 overflows uint8")
+		So(handle(ns, `2["int",3.5]`).Error(), ShouldEqual, "socketio: 3.5 isn't an integer of int")
+		So(handle(ns, `2["int","3"]`).Error(), ShouldEqual, `socketio: "3" isn't a number of int`)
+	})
+}
+
+func TestHandlerPatterns(t *testing.T) {
+
+	Convey("Events without handler are matched by the longest pattern", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		got := make(chan string, 10)
+		handler := func(name string) func(EventContext) {
+			return func(ctx EventContext) {
+				got <- name + " " + ctx.EventName
+			}
+		}
+		So(ns.On("order:created", handler("exact")), ShouldBeNil)
+		So(ns.On("order:*", handler("order")), ShouldBeNil)
+		So(ns.On("order:item:*", handler("item")), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		go newSocket(conn, ns).loop()
+		defer conn.Close()
+		for _, ev := range []string{"order:created", "order:updated", "order:item:added", "other", "order", "order:*"} {
+			conn.Send(`2["` + ev + `"]`)
+		}
+		conn.Send(`21["order:updated"]`)
+		So(conn.WaitFrames(2), ShouldResemble, []string{"0", "31[]"})
+		close(got)
+		var names []string
+		for name := range got {
+			names = append(names, name)
+		}
+		So(names, ShouldResemble, []string{
+			"exact order:created",
+			"order order:updated",
+			"item order:item:added",
+			"order order:*",
+			"order order:updated",
+		})
+	})
+}
@@ -2,8 +2,13 @@ package socketio
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/googollee/go-engine.io"
 )
@@ -48,3 +53,197 @@ func (f *FrameSaver) NextReader() (engineio.MessageType, io.ReadCloser, error) {
 	f.data = f.data[1:]
 	return ret.Type, ioutil.NopCloser(ret.Buffer), nil
 }
+
+// PipeConn is an engineio.Conn for testing socket.loop. Incoming frames are
+// fed with Send and outgoing frames are saved and can be read with Frames.
+type PipeConn struct {
+	id        string
+	request   *http.Request
+	in        chan FrameData
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	frames    []FrameData
+	// written tells which frames have their writer closed.
+	written []bool
+	// reading is the last reader returned, which must be closed before the
+	// next one like with engine.io.
+	reading *pipeReader
+}
+
+func NewPipeConn(id string) *PipeConn {
+	return &PipeConn{
+		id:      id,
+		request: &http.Request{},
+		in:      make(chan FrameData, 100),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *PipeConn) Id() string {
+	return c.id
+}
+
+func (c *PipeConn) Request() *http.Request {
+	return c.request
+}
+
+func (c *PipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *PipeConn) NextReader() (engineio.MessageType, io.ReadCloser, error) {
+	c.mu.Lock()
+	open := c.reading != nil && !c.reading.isClosed()
+	c.mu.Unlock()
+	if open {
+		return engineio.MessageText, nil, errReaderOpen
+	}
+	select {
+	case f := <-c.in:
+		r := &pipeReader{Reader: f.Buffer}
+		c.mu.Lock()
+		c.reading = r
+		c.mu.Unlock()
+		return f.Type, r, nil
+	case <-c.closed:
+		return engineio.MessageText, nil, io.EOF
+	}
+}
+
+// errReaderOpen is returned by PipeConn.NextReader when the previous reader
+// isn't closed. engine.io blocks instead, stalling the connection.
+var errReaderOpen = errors.New("previous reader not closed")
+
+type pipeReader struct {
+	io.Reader
+	mu     sync.Mutex
+	closed bool
+}
+
+func (r *pipeReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *pipeReader) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func (c *PipeConn) NextWriter(t engineio.MessageType) (io.WriteCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return nil, io.ErrClosedPipe
+	default:
+	}
+	c.frames = append(c.frames, FrameData{
+		Buffer: bytes.NewBuffer(nil),
+		Type:   t,
+	})
+	c.written = append(c.written, false)
+	w := &pipeWriter{
+		conn:  c,
+		index: len(c.frames) - 1,
+	}
+	c.mu.Unlock()
+	// let other writers in between frames, like a slow transport would.
+	runtime.Gosched()
+	c.mu.Lock()
+	return w, nil
+}
+
+type pipeWriter struct {
+	conn  *PipeConn
+	index int
+}
+
+func (w *pipeWriter) Write(p []byte) (int, error) {
+	w.conn.mu.Lock()
+	defer w.conn.mu.Unlock()
+	return w.conn.frames[w.index].Buffer.Write(p)
+}
+
+func (w *pipeWriter) Close() error {
+	w.conn.mu.Lock()
+	defer w.conn.mu.Unlock()
+	w.conn.written[w.index] = true
+	return nil
+}
+
+// Send feeds a text frame to the socket reading from c.
+func (c *PipeConn) Send(frame string) {
+	c.in <- FrameData{
+		Buffer: bytes.NewBufferString(frame),
+		Type:   engineio.MessageText,
+	}
+}
+
+// SendBinary feeds a binary frame to the socket reading from c.
+func (c *PipeConn) SendBinary(b []byte) {
+	c.in <- FrameData{
+		Buffer: bytes.NewBuffer(b),
+		Type:   engineio.MessageBinary,
+	}
+}
+
+// Frames returns the frames written to c so far.
+func (c *PipeConn) Frames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make([]string, len(c.frames))
+	for i, d := range c.frames {
+		ret[i] = d.Buffer.String()
+	}
+	return ret
+}
+
+// WaitFrames waits up to a second until at least n frames are written to c,
+// and returns the frames written.
+func (c *PipeConn) WaitFrames(n int) []string {
+	deadline := time.Now().Add(time.Second)
+	for {
+		if c.hasWritten(n) || time.Now().After(deadline) {
+			return c.Frames()
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// hasWritten returns whether the first n frames are written.
+func (c *PipeConn) hasWritten(n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.written) < n {
+		return false
+	}
+	for _, ok := range c.written[:n] {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Saver returns a FrameSaver holding copies of the frames written to c, to
+// decode them.
+func (c *PipeConn) Saver() *FrameSaver {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := &FrameSaver{}
+	for _, d := range c.frames {
+		ret.data = append(ret.data, FrameData{
+			Buffer: bytes.NewBuffer(append([]byte(nil), d.Buffer.Bytes()...)),
+			Type:   d.Type,
+		})
+	}
+	return ret
+}
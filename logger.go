@@ -0,0 +1,15 @@
+package socketio
+
+// Logger logs what happens to the sockets of the server, like dropped
+// packets and failures. It's called by the sockets concurrently.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// nopLogger is the default Logger, logging nothing.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+
+func (nopLogger) Errorf(format string, args ...interface{}) {}
@@ -0,0 +1,73 @@
+package socketio
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// captureLogger keeps the lines logged.
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) {
+	l.log("debug " + fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Errorf(format string, args ...interface{}) {
+	l.log("error " + fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) log(line string) {
+	l.mu.Lock()
+	l.lines = append(l.lines, line)
+	l.mu.Unlock()
+}
+
+func (l *captureLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestLogger(t *testing.T) {
+
+	Convey("Dropped packets are logged", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		logger := &captureLogger{}
+		server.SetLogger(logger)
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		conn.Send(`2["unknown","data"]`)
+		conn.Send(`0/nonexistent`)
+		conn.Send(`21["sync"]`)
+		conn.WaitFrames(3)
+		conn.SendBinary([]byte{1})
+		So(waitFor(func() bool { return server.NamespaceCount("") == 0 }), ShouldBeTrue)
+
+		So(logger.Lines(), ShouldResemble, []string{
+			`debug socketio: socket test1: event "unknown" without handler dropped`,
+			`debug socketio: socket test1: packet of unknown namespace "/nonexistent" dropped`,
+			`debug socketio: socket test1: event "sync" without handler dropped`,
+			"error socketio: socket test1: decode packet: need text package",
+		})
+	})
+
+	Convey("Ack timeouts are logged", t, func() {
+		socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+		logger := &captureLogger{}
+		socketInstance.logger = logger
+		errc := make(chan error, 1)
+		So(socketInstance.namespace("").EmitTimeout("ev", time.Millisecond, func(err error) {
+			errc <- err
+		}), ShouldBeNil)
+		So(<-errc, ShouldEqual, ErrAckTimeout)
+		So(logger.Lines(), ShouldResemble, []string{"debug socketio: socket test1: ack 0 timed out"})
+	})
+}
@@ -1,5 +1,10 @@
 package socketio
 
+import (
+	"sync"
+	"time"
+)
+
 // Namespace is the name space of a socket.io handler.
 type Namespace interface {
 
@@ -11,17 +16,61 @@ type Namespace interface {
 
 	// On registers the function f to handle an event.
 	On(event string, f interface{}) error
+
+	// Off unregisters the handler of an event.
+	Off(event string)
+
+	// RemoveAll unregisters the handlers of all events.
+	RemoveAll()
+
+	// Events returns the names of the events with a handler.
+	Events() []string
+
+	// OnAny registers f to handle the events without a handler.
+	OnAny(f func(so Socket, event string, args ...interface{}))
+
+	// Use appends a middleware run before event handlers.
+	Use(mw Middleware)
+
+	// UseNamed appends a middleware with a name to remove it by.
+	UseNamed(name string, mw Middleware)
+
+	// RemoveMiddleware removes the middleware with the name.
+	RemoveMiddleware(name string)
+
+	// RemoveMiddlewares removes all middlewares.
+	RemoveMiddlewares()
+
+	// BroadcastTo broadcasts an event to the room of the namespace.
+	BroadcastTo(room, event string, args ...interface{}) error
+
+	// BroadcastToNamespace broadcasts an event to the room of the namespace
+	// nsp.
+	BroadcastToNamespace(nsp, room, event string, args ...interface{}) error
+
+	// BroadcastToRooms broadcasts an event to the rooms of the namespace,
+	// once per socket.
+	BroadcastToRooms(rooms []string, event string, args ...interface{}) error
+
+	// BroadcastToSample broadcasts an event to a random fraction of the room.
+	BroadcastToSample(room, event string, fraction float64, args ...interface{}) error
+
+	// BroadcastToWithAck broadcasts an event to the room, and returns the
+	// acks of the sockets until timeout.
+	BroadcastToWithAck(room, event string, timeout time.Duration, args ...interface{}) ([][]interface{}, error)
 }
 
 type namespace struct {
 	*baseHandler
-	root map[string]*namespace
+	root   map[string]*namespace
+	rootMu *sync.RWMutex
 }
 
 func newNamespace(broadcast BroadcastAdaptor) *namespace {
 	ret := &namespace{
 		baseHandler: newBaseHandler("", broadcast),
 		root:        make(map[string]*namespace),
+		rootMu:      &sync.RWMutex{},
 	}
 	ret.root[ret.Name()] = ret
 	return ret
@@ -35,13 +84,27 @@ func (n *namespace) Of(name string) Namespace {
 	if name == "/" {
 		name = ""
 	}
+	n.rootMu.Lock()
+	defer n.rootMu.Unlock()
 	if ret, ok := n.root[name]; ok {
 		return ret
 	}
 	ret := &namespace{
 		baseHandler: newBaseHandler(name, n.baseHandler.broadcast),
 		root:        n.root,
+		rootMu:      n.rootMu,
 	}
 	n.root[name] = ret
 	return ret
 }
+
+// namespaces returns a snapshot of all namespaces by name.
+func (n *namespace) namespaces() map[string]*namespace {
+	n.rootMu.RLock()
+	defer n.rootMu.RUnlock()
+	ret := make(map[string]*namespace, len(n.root))
+	for k, v := range n.root {
+		ret[k] = v
+	}
+	return ret
+}
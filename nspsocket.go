@@ -2,7 +2,19 @@
 
 package socketio
 
-import "reflect"
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrAckTimeout is passed to an ack callback registered by EmitTimeout when
+// the client doesn't acknowledge in time.
+var ErrAckTimeout = errors.New("socketio: ack timeout")
 
 type nspSocket struct {
 	*socketHandler
@@ -10,6 +22,10 @@ type nspSocket struct {
 	// only connected flag is needed as this flag is view from client to server
 	// and default leave it as zero value false.
 	connected bool
+	connMu    sync.Mutex
+	// pending are the emits waiting for the namespace to connect, with the
+	// EmitBeforeConnectBuffer policy. It's guarded by connMu.
+	pending []func()
 }
 
 func newNspSocket(s *socket, base *baseHandler) *nspSocket {
@@ -20,6 +36,10 @@ func newNspSocket(s *socket, base *baseHandler) *nspSocket {
 	return ns
 }
 
+func (n *nspSocket) Namespace() string {
+	return n.name
+}
+
 func (n *nspSocket) Emit(event string, args ...interface{}) error {
 	if err := n.nspEmit(event, args...); err != nil {
 		return err
@@ -30,7 +50,79 @@ func (n *nspSocket) Emit(event string, args ...interface{}) error {
 	return nil
 }
 
+// ErrNamespaceNotConnected is returned by the emits to a named namespace the
+// client isn't connected to.
+var ErrNamespaceNotConnected = errors.New("socketio: namespace not connected")
+
+// EmitOn emits an event with given args like Emit, to the namespace nsp of
+// the connection, "" or "/" for the default one, so a handler can notify the
+// client on another namespace than its own. It returns
+// ErrNamespaceNotConnected if the client didn't connect nsp.
+func (n *nspSocket) EmitOn(nsp, event string, args ...interface{}) error {
+	if nsp == "/" {
+		nsp = ""
+	}
+	ns, ok := n.nsps[nsp]
+	if !ok || nsp != "" && !ns.isConnected() {
+		return ErrNamespaceNotConnected
+	}
+	return ns.Emit(event, args...)
+}
+
+// EmitTimeout emits an event like Emit with an ack callback as the last arg.
+// If the client doesn't ack within timeout, the callback is unregistered and,
+// when its last parameter is an error, called with ErrAckTimeout, or with
+// ErrSocketClosed if the socket is disconnected first.
+func (n *nspSocket) EmitTimeout(event string, timeout time.Duration, args ...interface{}) error {
+	return n.emit(event, timeout, args)
+}
+
 func (n *nspSocket) nspEmit(event string, args ...interface{}) error {
+	return n.emit(event, 0, args)
+}
+
+// EmitBeforeConnectPolicy is what happens to the events emitted to a named
+// namespace before the client connects it.
+type EmitBeforeConnectPolicy int
+
+const (
+	// EmitBeforeConnectFail fails the emits with ErrNamespaceNotConnected.
+	EmitBeforeConnectFail EmitBeforeConnectPolicy = iota
+	// EmitBeforeConnectBuffer buffers the emits, and sends them in order once
+	// the namespace is connected.
+	EmitBeforeConnectBuffer
+)
+
+func (n *nspSocket) emit(event string, timeout time.Duration, args []interface{}) error {
+	return n.whenConnected(strconv.Quote(event), func() error {
+		return n.emitConnected(event, timeout, args)
+	})
+}
+
+// whenConnected calls send now if the namespace is connected, else follows
+// the EmitBeforeConnectPolicy: it returns ErrNamespaceNotConnected, or buffers
+// send, logging its error as the emit of what.
+func (n *nspSocket) whenConnected(what string, send func() error) error {
+	if n.name != "" && n.ctx.Err() == nil {
+		n.connMu.Lock()
+		if !n.connected {
+			defer n.connMu.Unlock()
+			if n.emitBeforeConnect != EmitBeforeConnectBuffer {
+				return ErrNamespaceNotConnected
+			}
+			n.pending = append(n.pending, func() {
+				if err := send(); err != nil {
+					n.logger.Errorf("socketio: socket %s: emit %s to %s: %s", n.Id(), what, n.name, err)
+				}
+			})
+			return nil
+		}
+		n.connMu.Unlock()
+	}
+	return send()
+}
+
+func (n *nspSocket) emitConnected(event string, timeout time.Duration, args []interface{}) error {
 	var c *caller
 	if l := len(args); l > 0 {
 		fv := reflect.ValueOf(args[l-1])
@@ -43,36 +135,288 @@ func (n *nspSocket) nspEmit(event string, args ...interface{}) error {
 			args = args[:l-1]
 		}
 	}
-	args = append([]interface{}{event}, args...)
-	if c != nil {
-		id, err := n.sendId(args)
-		if err != nil {
-			return err
+	_, err := n.sendEvent(event, c, timeout, args)
+	return err
+}
+
+// sendEvent sends the event with args. If c isn't nil, it's registered for the
+// ack of the event, expiring after timeout if positive, and the ack id is
+// returned.
+func (n *nspSocket) sendEvent(event string, c *caller, timeout time.Duration, args []interface{}) (int, error) {
+	args, err := n.outgoingArgs(event, args)
+	if err != nil {
+		return -1, err
+	}
+	data := append([]interface{}{event}, args...)
+	if c == nil {
+		if err := n.send(data); err != nil {
+			return -1, n.encoder.argError(args, err)
 		}
+		return -1, nil
+	}
+	// the ack is registered first, as it may come before encode returns.
+	id, err := n.addAck(n, c)
+	if err != nil {
+		return -1, err
+	}
+	p := packet{
+		Type: _EVENT,
+		Id:   id,
+		NSP:  n.name,
+		Data: data,
+	}
+	if err := n.encode(p); err != nil {
+		n.removeAck(id, c)
+		return -1, n.encoder.argError(args, err)
+	}
+	if timeout > 0 {
 		n.acksmu.Lock()
-		n.acks[id] = c
+		if n.acks[id] == c {
+			n.ackTimers[id] = time.AfterFunc(timeout, func() {
+				n.ackTimeout(n, id, c)
+			})
+		}
 		n.acksmu.Unlock()
+	}
+	return id, nil
+}
+
+// EmitPriority emits an event with given args like Emit, for control events
+// which mustn't wait behind bulk data on a busy connection. It's written
+// before the events of Emit waiting for the connection, which are written
+// after all priority events waiting. Events of a lane are written in the order
+// they got to wait, so an event may overtake the events emitted before it in
+// the other lane only. The event being written is never interrupted. It
+// doesn't take an ack callback.
+func (n *nspSocket) EmitPriority(event string, args ...interface{}) error {
+	return n.whenConnected(strconv.Quote(event), func() error {
+		return n.emitLane(event, args, true, false)
+	})
+}
+
+// emitLane emits an event with given args and no ack callback, like
+// encodeLane.
+func (n *nspSocket) emitLane(event string, args []interface{}, priority, compress bool) error {
+	args, err := n.outgoingArgs(event, args)
+	if err != nil {
+		return err
+	}
+	p := packet{
+		Type: _EVENT,
+		Id:   -1,
+		NSP:  n.name,
+		Data: append([]interface{}{event}, args...),
+	}
+	if err := n.encodeLane(p, priority, compress); err != nil {
+		return n.encoder.argError(args, err)
+	}
+	return nil
+}
+
+// VolatileEmitter emits events which are dropped rather than waiting when the
+// connection is busy. It's returned by Socket.Volatile.
+type VolatileEmitter struct {
+	so *nspSocket
+}
+
+// Volatile returns a VolatileEmitter of the socket, for events which may be
+// lost like frequent updates.
+func (n *nspSocket) Volatile() *VolatileEmitter {
+	return &VolatileEmitter{so: n}
+}
+
+// Emit emits an event with given args, unless the connection is busy writing
+// other packets, in which case the event is dropped. It gives no delivery
+// guarantee, and doesn't take an ack callback.
+func (v *VolatileEmitter) Emit(event string, args ...interface{}) error {
+	return v.so.whenConnected(strconv.Quote(event), func() error {
+		args, err := v.so.outgoingArgs(event, args)
+		if err != nil {
+			return err
+		}
+		p := packet{
+			Type: _EVENT,
+			Id:   -1,
+			NSP:  v.so.name,
+			Data: append([]interface{}{event}, args...),
+		}
+		if _, err := v.so.tryEncode(p); err != nil {
+			return v.so.encoder.argError(args, err)
+		}
 		return nil
+	})
+}
+
+// Ack is the pending ack of an event emitted by EmitWithAck.
+type Ack struct {
+	so   *nspSocket
+	id   int
+	c    *caller
+	done chan struct{}
+	args []interface{}
+}
+
+// EmitWithAck emits an event with given args, returning the Ack to wait for
+// the ack of the client.
+func (n *nspSocket) EmitWithAck(event string, args ...interface{}) (*Ack, error) {
+	a := &Ack{
+		so:   n,
+		done: make(chan struct{}),
+	}
+	c, err := newCaller(func(args ...interface{}) {
+		a.args = args
+		close(a.done)
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.c = c
+	if n.name != "" && n.ctx.Err() == nil && !n.isConnected() {
+		return nil, ErrNamespaceNotConnected
+	}
+	if a.id, err = n.sendEvent(event, c, 0, args); err != nil {
+		return nil, err
 	}
-	return n.send(args)
+	return a, nil
 }
 
+// Wait waits for the ack and returns its args, decoded like json.Unmarshal
+// into interface{} values. If ctx is done first, the ack is unregistered and
+// ctx.Err() is returned, and ErrSocketClosed if the socket is disconnected
+// first.
+func (a *Ack) Wait(ctx context.Context) ([]interface{}, error) {
+	select {
+	case <-a.done:
+		return a.args, nil
+	case <-ctx.Done():
+	case <-a.so.ctx.Done():
+	}
+	if !a.so.removeAck(a.id, a.c) {
+		// the ack came along, or the acks were cancelled by the
+		// disconnection.
+		select {
+		case <-a.done:
+			return a.args, nil
+		case <-a.so.ctx.Done():
+			return nil, ErrSocketClosed
+		}
+	}
+	if ctx.Err() == nil {
+		return nil, ErrSocketClosed
+	}
+	return nil, ctx.Err()
+}
+
+// ErrWaitInHandler is returned by EmitAndWait while a handler of the socket
+// runs on its loop, which reads the acks of the client once the handler
+// returns.
+var ErrWaitInHandler = errors.New("socketio: can't wait for an ack in a handler run by the loop")
+
+// EmitAndWait emits an event with given args and waits for the ack of the
+// client like Wait. Handlers pass their own deadline in ctx, so the ack of a
+// client which never answers is unregistered when it expires. The loop of the
+// socket reads the ack, so the handlers calling it must be run by the workers
+// of SetDispatchWorkers: while a handler runs on the loop, like connection
+// handlers and event handlers without workers, it returns ErrWaitInHandler.
+func (n *nspSocket) EmitAndWait(ctx context.Context, event string, args ...interface{}) ([]interface{}, error) {
+	if atomic.LoadInt32(&n.handling) == 1 {
+		return nil, ErrWaitInHandler
+	}
+	a, err := n.EmitWithAck(event, args...)
+	if err != nil {
+		return nil, err
+	}
+	return a.Wait(ctx)
+}
+
+// outgoingArgs returns the args of an outgoing event, as given by the
+// OnAnyOutgoing hook of the server if any. An error of the hook aborts the
+// emit.
+func (n *nspSocket) outgoingArgs(event string, args []interface{}) ([]interface{}, error) {
+	if n.outgoing == nil {
+		return args, nil
+	}
+	return n.outgoing(n.name, event, args)
+}
+
+// Disconnect disconnects the namespace, leaving its rooms, or the connection
+// for the default namespace.
 func (n *nspSocket) Disconnect() {
 	if n.name != "" {
-		n.sendDisconnect()
+		if n.isConnected() {
+			n.sendDisconnect("")
+			n.onDisconnect(ReasonServerNamespaceDisconnect)
+		}
 		return
 	}
 	n.socket.Disconnect()
 }
 
-func (n *nspSocket) sendDisconnect() error {
+// DisconnectWithReason disconnects like Disconnect, sending the reason to the
+// client as the data of the disconnect packet. Disconnecting the default
+// namespace sends it for every namespace connected before closing the
+// connection.
+func (n *nspSocket) DisconnectWithReason(reason string) {
+	if n.name != "" {
+		if n.isConnected() {
+			n.sendDisconnect(reason)
+			n.onDisconnect(ReasonServerNamespaceDisconnect)
+		}
+		return
+	}
+	n.socket.close(reason)
+}
+
+// onDisconnect leaves all rooms of the namespace and triggers its
+// disconnection event with the reason. It does nothing if a named namespace is
+// disconnected already, so the disconnection paths may race.
+func (n *nspSocket) onDisconnect(reason string) {
+	if !n.swapConnected(false) && n.name != "" {
+		return
+	}
+	n.LeaveAll()
+	p := packet{
+		Type: _DISCONNECT,
+		Id:   -1,
+		NSP:  n.name,
+		Data: []interface{}{reason},
+	}
+	n.onPacket(nil, &p)
+}
+
+// IsConnected returns whether the connection is open and the namespace
+// connected. The default namespace is connected along with the connection.
+func (n *nspSocket) IsConnected() bool {
+	return n.ctx.Err() == nil && (n.name == "" || n.isConnected())
+}
+
+func (n *nspSocket) isConnected() bool {
+	n.connMu.Lock()
+	defer n.connMu.Unlock()
+	return n.connected
+}
+
+// swapConnected sets the connected flag, returning its previous value.
+func (n *nspSocket) swapConnected(connected bool) bool {
+	n.connMu.Lock()
+	defer n.connMu.Unlock()
+	old := n.connected
+	n.connected = connected
+	return old
+}
+
+// sendDisconnect sends the disconnect packet of the namespace, with the reason
+// unless it's empty.
+func (n *nspSocket) sendDisconnect(reason string) error {
 	packet := packet{
 		Type: _DISCONNECT,
 		Id:   -1,
 		NSP:  n.name,
 	}
-	encoder := newEncoder(n.conn)
-	return encoder.Encode(packet)
+	if reason != "" {
+		packet.Data = reason
+	}
+	return n.encode(packet)
 }
 
 func (n *nspSocket) send(args []interface{}) error {
@@ -82,8 +426,35 @@ func (n *nspSocket) send(args []interface{}) error {
 		NSP:  n.name,
 		Data: args,
 	}
-	encoder := newEncoder(n.conn)
-	return encoder.Encode(packet)
+	return n.encode(packet)
+}
+
+// EmitError sends an error packet with the payload to the error handler of the
+// client in the namespace. The payload is any value encoding to json; an error
+// is sent as {"message": err.Error()}. It follows the EmitBeforeConnectPolicy
+// like Emit.
+func (n *nspSocket) EmitError(payload interface{}) error {
+	return n.whenConnected("error", func() error {
+		return n.sendError(payload)
+	})
+}
+
+// sendError sends an error packet like EmitError, connected or not, like the
+// errors answering the events of the client.
+func (n *nspSocket) sendError(payload interface{}) error {
+	if err, ok := payload.(error); ok {
+		payload = map[string]string{"message": err.Error()}
+	}
+	packet := packet{
+		Type: _ERROR,
+		Id:   -1,
+		NSP:  n.name,
+		Data: payload,
+	}
+	if err := n.encode(packet); err != nil {
+		return n.encoder.argError([]interface{}{payload}, err)
+	}
+	return nil
 }
 
 // sendConnect sends connection event to client. This event always trigger from
@@ -95,29 +466,49 @@ func (n *nspSocket) sendConnect() error {
 		Id:   -1,
 		NSP:  n.name,
 	}
-	n.connected = true
-	encoder := newEncoder(n.conn)
-	return encoder.Encode(packet)
+	if n.connectData != nil {
+		if data := n.connectData(n); data != nil {
+			packet.Data = data
+		}
+	}
+	if err := n.encode(packet); err != nil {
+		return err
+	}
+	n.flushPending()
+	return nil
 }
 
-func (n *nspSocket) sendId(args []interface{}) (int, error) {
-	n.mu.Lock()
-	packet := packet{
-		Type: _EVENT,
-		Id:   n.id,
-		NSP:  n.name,
-		Data: args,
-	}
-	n.id++
-	if n.id < 0 {
-		n.id = 0
+// flushPending sends the emits buffered before the namespace connected in
+// order, including those buffered meanwhile, then marks it connected.
+func (n *nspSocket) flushPending() {
+	for {
+		n.connMu.Lock()
+		pending := n.pending
+		n.pending = nil
+		if len(pending) == 0 {
+			n.connected = true
+			n.connMu.Unlock()
+			return
+		}
+		n.connMu.Unlock()
+		for _, f := range pending {
+			f()
+		}
 	}
-	n.mu.Unlock()
+}
 
-	encoder := newEncoder(n.conn)
-	err := encoder.Encode(packet)
-	if err != nil {
-		return -1, nil
+// connect accepts the connection of the namespace, then calls its connection
+// handler. So the handler is called once per connected namespace, and can emit
+// to the client.
+func (n *nspSocket) connect() error {
+	if err := n.sendConnect(); err != nil {
+		return err
+	}
+	p := packet{
+		Type: _CONNECT,
+		Id:   -1,
+		NSP:  n.name,
 	}
-	return packet.Id, nil
+	_, err := n.onPacket(nil, &p)
+	return err
 }
@@ -0,0 +1,1008 @@
+package socketio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googollee/go-engine.io"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEmitTimeout(t *testing.T) {
+
+	Convey("Ack callback gets ErrAckTimeout when client never acks", t, func() {
+		socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+		errc := make(chan error, 1)
+		err := ns.EmitTimeout("ev", 10*time.Millisecond, func(so Socket, msg string, err error) {
+			errc <- err
+		})
+		So(err, ShouldBeNil)
+
+		select {
+		case err = <-errc:
+		case <-time.After(time.Second):
+		}
+		So(err, ShouldEqual, ErrAckTimeout)
+		socketInstance.acksmu.Lock()
+		So(len(socketInstance.acks), ShouldEqual, 0)
+		So(len(socketInstance.ackTimers), ShouldEqual, 0)
+		socketInstance.acksmu.Unlock()
+	})
+
+	Convey("Ack received in time stops the timer", t, func() {
+		socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+		called := 0
+		err := ns.EmitTimeout("ev", 20*time.Millisecond, func(err error) {
+			So(err, ShouldBeNil)
+			called++
+		})
+		So(err, ShouldBeNil)
+		So(len(socketInstance.ackTimers), ShouldEqual, 1)
+
+		ns.onPacket(newDecoder(&FrameSaver{}), &packet{Type: _ACK, Id: 0, NSP: ""})
+		So(len(socketInstance.acks), ShouldEqual, 0)
+		So(len(socketInstance.ackTimers), ShouldEqual, 0)
+
+		time.Sleep(40 * time.Millisecond)
+		So(called, ShouldEqual, 1)
+	})
+
+	Convey("Pending acks get ErrSocketClosed on disconnection", t, func() {
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		root.Of("/chat")
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, root)
+		chat := socketInstance.namespace("/chat")
+		chat.connected = true
+		done := make(chan error, 1)
+		go func() {
+			done <- socketInstance.loop()
+		}()
+		conn.WaitFrames(1)
+
+		type result struct {
+			so  Socket
+			err error
+		}
+		results := make(chan result, 1)
+		So(chat.EmitTimeout("ev", time.Hour, func(so Socket, err error) {
+			results <- result{so, err}
+		}), ShouldBeNil)
+		a, err := socketInstance.namespace("").EmitWithAck("ev")
+		So(err, ShouldBeNil)
+		waited := make(chan error, 1)
+		go func() {
+			_, err := a.Wait(context.Background())
+			waited <- err
+		}()
+
+		conn.Close()
+		<-done
+		r := <-results
+		So(r.so, ShouldEqual, chat)
+		So(r.err, ShouldEqual, ErrSocketClosed)
+		So(<-waited, ShouldEqual, ErrSocketClosed)
+		socketInstance.acksmu.Lock()
+		So(socketInstance.acks, ShouldBeEmpty)
+		So(socketInstance.ackSockets, ShouldBeEmpty)
+		So(socketInstance.ackTimers, ShouldBeEmpty)
+		socketInstance.acksmu.Unlock()
+	})
+}
+
+func TestEmitAckError(t *testing.T) {
+
+	Convey("Failed emit with ack returns the error and registers no ack", t, func() {
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+		conn.Close()
+
+		err := ns.Emit("ev", "data", func() {})
+		So(err, ShouldEqual, io.ErrClosedPipe)
+		So(socketInstance.acks, ShouldBeEmpty)
+
+		// the failed write marked the socket broken.
+		err = ns.EmitTimeout("ev", time.Second, func() {})
+		So(err, ShouldEqual, ErrSocketClosed)
+		So(socketInstance.acks, ShouldBeEmpty)
+		So(socketInstance.ackTimers, ShouldBeEmpty)
+	})
+}
+
+func TestEmitArgError(t *testing.T) {
+
+	Convey("Encode error tells the offending arg", t, func() {
+		socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+
+		err := ns.Emit("ev", "data", 1, make(chan int))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "socketio: failed to encode arg 2 (chan int): ")
+
+		err = ns.Emit("ev", map[string]interface{}{"f": func() {}}, func() {})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "socketio: failed to encode arg 0 (map[string]interface {}): ")
+		So(socketInstance.acks, ShouldBeEmpty)
+	})
+}
+
+func TestConcurrentEmit(t *testing.T) {
+
+	Convey("Concurrent emits with attachments keep their frames together", t, func() {
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+		const goroutines, emits = 20, 50
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < emits; i++ {
+					n := g*emits + i
+					a := &Attachment{Data: bytes.NewBufferString(fmt.Sprint(n))}
+					ns.Emit("ev", n, a)
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		saver := conn.Saver()
+		So(len(saver.data), ShouldEqual, 2*goroutines*emits)
+		seen := make(map[int]bool)
+		for len(saver.data) > 0 {
+			decoder := newDecoder(saver)
+			var p packet
+			So(decoder.Decode(&p), ShouldBeNil)
+			So(decoder.Message(), ShouldEqual, "ev")
+			var n int
+			a := &Attachment{}
+			p.Data = &[]interface{}{&n, a}
+			So(decoder.DecodeData(&p), ShouldBeNil)
+			So(a.Data.(*bytes.Buffer).String(), ShouldEqual, fmt.Sprint(n))
+			seen[n] = true
+		}
+		So(len(seen), ShouldEqual, goroutines*emits)
+	})
+}
+
+func BenchmarkEmit(b *testing.B) {
+	socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+	ns := socketInstance.namespace("")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ns.Emit("ev", "data", i)
+	}
+}
+
+func TestAckIdsAcrossNamespaces(t *testing.T) {
+
+	Convey("Acks of concurrent emits on two namespaces get their own responses", t, func() {
+		conn := NewPipeConn("test1")
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		root.Of("/a")
+		root.Of("/b")
+		socketInstance := newSocket(conn, root)
+		const emits = 50
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		got := make(map[string]int)
+		for _, nsp := range []string{"/a", "/b"} {
+			ns := socketInstance.namespace(nsp)
+			ns.swapConnected(true)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < emits; i++ {
+					want := fmt.Sprintf("%s %d", ns.name, i)
+					ns.Emit("ev", want, func(resp string) {
+						mu.Lock()
+						if resp == want {
+							got[ns.name]++
+						}
+						mu.Unlock()
+					})
+				}
+			}()
+		}
+		wg.Wait()
+
+		saver := conn.Saver()
+		So(len(saver.data), ShouldEqual, 2*emits)
+		for len(saver.data) > 0 {
+			decoder := newDecoder(saver)
+			var p packet
+			So(decoder.Decode(&p), ShouldBeNil)
+			var data string
+			p.Data = &[]interface{}{&data}
+			So(decoder.DecodeData(&p), ShouldBeNil)
+			// the client acks with the payload of the event.
+			ack := &FrameSaver{}
+			newEncoder(ack).Encode(packet{Type: _ACK, NSP: p.NSP, Id: p.Id, Data: []interface{}{data}})
+			decoder = newDecoder(ack)
+			var ap packet
+			So(decoder.Decode(&ap), ShouldBeNil)
+			_, err := socketInstance.namespace(ap.NSP).onPacket(decoder, &ap)
+			So(err, ShouldBeNil)
+		}
+		So(got, ShouldResemble, map[string]int{"/a": emits, "/b": emits})
+		So(socketInstance.acks, ShouldBeEmpty)
+	})
+}
+
+func TestEmitWithAck(t *testing.T) {
+
+	ack := func(socketInstance *socket, id int, data string) {
+		saver := &FrameSaver{}
+		saver.NextWriter(engineio.MessageText)
+		saver.data[0].Buffer.WriteString(data)
+		decoder := newDecoder(saver)
+		var p packet
+		So(decoder.Decode(&p), ShouldBeNil)
+		So(p.Id, ShouldEqual, id)
+		_, err := socketInstance.namespace("").onPacket(decoder, &p)
+		So(err, ShouldBeNil)
+	}
+
+	Convey("Wait returns the args of the ack", t, func() {
+		socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+		a, err := ns.EmitWithAck("ev", "data")
+		So(err, ShouldBeNil)
+		ack(socketInstance, 0, `30["ok",1]`)
+		args, err := a.Wait(context.Background())
+		So(err, ShouldBeNil)
+		So(args, ShouldResemble, []interface{}{"ok", float64(1)})
+		So(socketInstance.acks, ShouldBeEmpty)
+	})
+
+	Convey("Cancelling the context unregisters the ack", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		So(ns.On("ping", func() string { return "pong" }), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, ns)
+		done := make(chan error, 1)
+		go func() {
+			done <- socketInstance.loop()
+		}()
+		defer conn.Close()
+		conn.WaitFrames(1)
+		a, err := socketInstance.namespace("").EmitWithAck("ev")
+		So(err, ShouldBeNil)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		args, err := a.Wait(ctx)
+		So(args, ShouldBeNil)
+		So(err == context.DeadlineExceeded, ShouldBeTrue)
+		socketInstance.acksmu.Lock()
+		So(socketInstance.acks, ShouldBeEmpty)
+		socketInstance.acksmu.Unlock()
+
+		// late acks are read to their end, attachments included, so the
+		// next packets are read.
+		conn.Send(`30["late"]`)
+		conn.Send(`61-0[{"_placeholder":true,"num":0}]`)
+		conn.SendBinary([]byte{1})
+		conn.Send(`21["ping"]`)
+		So(conn.WaitFrames(3), ShouldResemble, []string{"0", `20["ev"]`, `31["pong"]`})
+		select {
+		case err := <-done:
+			So(err, ShouldBeNil)
+		default:
+		}
+	})
+
+	Convey("Handlers waiting for a client which never acks time out", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		ns.On("ask", func(so Socket) string {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err := so.EmitAndWait(ctx, "question")
+			return err.Error()
+		})
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, ns)
+		socketInstance.workers = 1
+		go socketInstance.loop()
+		defer conn.Close()
+		conn.Send(`21["ask"]`)
+		So(conn.WaitFrames(3), ShouldResemble, []string{"0", `20["question"]`, `31["context deadline exceeded"]`})
+		socketInstance.acksmu.Lock()
+		So(socketInstance.acks, ShouldBeEmpty)
+		socketInstance.acksmu.Unlock()
+	})
+
+	Convey("Handlers run by workers get the ack of the client", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		ns.On("ask", func(so Socket) (string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			args, err := so.EmitAndWait(ctx, "question")
+			if err != nil {
+				return "", err
+			}
+			return args[0].(string), nil
+		})
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, ns)
+		socketInstance.workers = 1
+		go socketInstance.loop()
+		defer conn.Close()
+		conn.Send(`21["ask"]`)
+		So(conn.WaitFrames(2), ShouldResemble, []string{"0", `20["question"]`})
+		conn.Send(`30["answer"]`)
+		So(conn.WaitFrames(3)[2], ShouldEqual, `31["answer"]`)
+	})
+
+	Convey("Handlers run by the loop can't wait for an ack", t, func() {
+		ns := newNamespace(newBroadcastDefault())
+		ns.On("ask", func(so Socket) string {
+			_, err := so.EmitAndWait(context.Background(), "question")
+			return err.Error()
+		})
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, ns)
+		go socketInstance.loop()
+		defer conn.Close()
+		conn.Send(`21["ask"]`)
+		So(conn.WaitFrames(2), ShouldResemble, []string{"0", `31["` + ErrWaitInHandler.Error() + `"]`})
+	})
+
+	Convey("Emits over the max pending acks fail", t, func() {
+		socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+		socketInstance.maxAcks = 2
+		ns := socketInstance.namespace("")
+		_, err := ns.EmitWithAck("ev")
+		So(err, ShouldBeNil)
+		So(ns.Emit("ev", func(so Socket) {}), ShouldBeNil)
+		_, err = ns.EmitWithAck("ev")
+		So(err, ShouldEqual, ErrTooManyAcks)
+		So(ns.Emit("ev", func(so Socket) {}), ShouldEqual, ErrTooManyAcks)
+		So(ns.Emit("ev"), ShouldBeNil)
+		So(len(socketInstance.acks), ShouldEqual, 2)
+
+		ack(socketInstance, 0, `30[]`)
+		_, err = ns.EmitWithAck("ev")
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Variadic ack callbacks get all args", t, func() {
+		socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+		var got []interface{}
+		So(ns.Emit("ev", func(so Socket, args ...interface{}) {
+			got = args
+		}), ShouldBeNil)
+		ack(socketInstance, 0, `30["a",true,null]`)
+		So(got, ShouldResemble, []interface{}{"a", true, nil})
+	})
+}
+
+// slowConn blocks writing its frames until released.
+type slowConn struct {
+	*PipeConn
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (c slowConn) NextWriter(t engineio.MessageType) (io.WriteCloser, error) {
+	c.writing <- struct{}{}
+	<-c.release
+	return c.PipeConn.NextWriter(t)
+}
+
+// failingConn fails its writes once left bytes are written.
+type failingConn struct {
+	*PipeConn
+	left int
+}
+
+func (c *failingConn) NextWriter(t engineio.MessageType) (io.WriteCloser, error) {
+	w, err := c.PipeConn.NextWriter(t)
+	if err != nil {
+		return nil, err
+	}
+	return &failingWriter{WriteCloser: w, conn: c}, nil
+}
+
+type failingWriter struct {
+	io.WriteCloser
+	conn *failingConn
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.conn.left {
+		w.conn.left -= len(p)
+		return w.WriteCloser.Write(p)
+	}
+	n, _ := w.WriteCloser.Write(p[:w.conn.left])
+	w.conn.left = 0
+	return n, io.ErrShortWrite
+}
+
+func TestEmitBrokenConn(t *testing.T) {
+
+	Convey("A failed write marks the socket broken", t, func() {
+		frame := `51-["ev",{"_placeholder":true,"num":0}]`
+		conn := &failingConn{PipeConn: NewPipeConn("test1"), left: len(frame) + 1}
+		socketInstance := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+
+		So(ns.Emit("ev", []byte{1, 2, 3}), ShouldEqual, io.ErrShortWrite)
+		So(socketInstance.isBroken(), ShouldBeTrue)
+		So(ns.Emit("next"), ShouldEqual, ErrSocketClosed)
+		So(ns.Volatile().Emit("next"), ShouldEqual, ErrSocketClosed)
+		So(conn.Frames(), ShouldResemble, []string{frame, "\x01"})
+	})
+}
+
+func TestEmitPriority(t *testing.T) {
+
+	Convey("Priority emits are written before the emits waiting", t, func() {
+		conn := slowConn{
+			PipeConn: NewPipeConn("test1"),
+			writing:  make(chan struct{}, 1),
+			release:  make(chan struct{}),
+		}
+		socketInstance := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+		done := make(chan error, 4)
+		go func() {
+			done <- ns.Emit("first")
+		}()
+		<-conn.writing
+
+		// wait for each emit to queue, to know their order.
+		waiting := func(n int) func() bool {
+			return func() bool {
+				socketInstance.writing.mu.Lock()
+				defer socketInstance.writing.mu.Unlock()
+				return len(socketInstance.writing.high)+len(socketInstance.writing.low) == n
+			}
+		}
+		go func() {
+			done <- ns.Emit("bulk", 1)
+		}()
+		So(waitFor(waiting(1)), ShouldBeTrue)
+		go func() {
+			done <- ns.Emit("bulk", 2)
+		}()
+		So(waitFor(waiting(2)), ShouldBeTrue)
+		go func() {
+			done <- ns.EmitPriority("expiry")
+		}()
+		So(waitFor(waiting(3)), ShouldBeTrue)
+
+		close(conn.release)
+		go func() {
+			for range conn.writing {
+			}
+		}()
+		for i := 0; i < 4; i++ {
+			So(<-done, ShouldBeNil)
+		}
+		So(conn.Frames(), ShouldResemble, []string{
+			`2["first"]`,
+			`2["expiry"]`,
+			`2["bulk",1]`,
+			`2["bulk",2]`,
+		})
+	})
+}
+
+func TestWriteQueue(t *testing.T) {
+	// newQueued returns a socket with a queue of one packet, whose writer is
+	// blocked writing the first packet emitted.
+	newQueued := func(policy QueueFullPolicy) (slowConn, *socket) {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetWriteQueue(1, policy)
+		conn := slowConn{
+			PipeConn: NewPipeConn("test1"),
+			writing:  make(chan struct{}, 10),
+			release:  make(chan struct{}),
+		}
+		so := server.newSocket(conn)
+		So(so.namespace("").Emit("first"), ShouldBeNil)
+		<-conn.writing
+		So(so.namespace("").Emit("queued"), ShouldBeNil)
+		return conn, so
+	}
+
+	Convey("Emits to a full queue fail with the error policy", t, func() {
+		conn, so := newQueued(QueueFullError)
+		ns := so.namespace("")
+		So(ns.Emit("over"), ShouldEqual, ErrQueueFull)
+		_, err := ns.EmitWithAck("over")
+		So(err, ShouldEqual, ErrQueueFull)
+		So(so.acks, ShouldBeEmpty)
+		So(ns.Volatile().Emit("volatile"), ShouldBeNil)
+
+		close(conn.release)
+		so.flush()
+		So(conn.Frames(), ShouldResemble, []string{`2["first"]`, `2["queued"]`})
+		so.Disconnect()
+		<-so.queue.done
+	})
+
+	Convey("Priority emits are written before the queued ones", t, func() {
+		conn, so := newQueued(QueueFullError)
+		ns := so.namespace("")
+		So(ns.EmitPriority("urgent"), ShouldBeNil)
+		So(ns.Emit("over"), ShouldEqual, ErrQueueFull)
+
+		close(conn.release)
+		so.flush()
+		So(conn.Frames(), ShouldResemble, []string{`2["first"]`, `2["urgent"]`, `2["queued"]`})
+		so.Disconnect()
+		<-so.queue.done
+	})
+
+	Convey("Emits to a full queue are dropped with the drop policy", t, func() {
+		conn, so := newQueued(QueueFullDrop)
+		So(so.namespace("").Emit("over"), ShouldBeNil)
+
+		close(conn.release)
+		so.flush()
+		So(conn.Frames(), ShouldResemble, []string{`2["first"]`, `2["queued"]`})
+		so.Disconnect()
+		<-so.queue.done
+	})
+
+	Convey("Emits to a full queue wait with the block policy", t, func() {
+		conn, so := newQueued(QueueFullBlock)
+		done := make(chan error, 1)
+		go func() {
+			done <- so.namespace("").Emit("over")
+		}()
+		time.Sleep(20 * time.Millisecond)
+		So(done, ShouldBeEmpty)
+
+		close(conn.release)
+		So(<-done, ShouldBeNil)
+		so.flush()
+		So(conn.Frames(), ShouldResemble, []string{`2["first"]`, `2["queued"]`, `2["over"]`})
+		so.Disconnect()
+		<-so.queue.done
+		So(so.namespace("").Emit("closed"), ShouldEqual, ErrSocketClosed)
+	})
+
+	Convey("Packets queued before closing are written", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetWriteQueue(4, QueueFullBlock)
+		server.OnConnection(func(so Socket) {
+			so.Emit("welcome")
+			so.DisconnectWithReason("bye")
+		})
+		conn := NewPipeConn("test1")
+		server.serveConn(conn)
+		So(conn.Frames(), ShouldResemble, []string{"0", `2["welcome"]`, `1"bye"`})
+	})
+}
+
+func TestVolatileEmit(t *testing.T) {
+
+	Convey("Volatile emits are dropped while the connection is busy", t, func() {
+		conn := slowConn{
+			PipeConn: NewPipeConn("test1"),
+			writing:  make(chan struct{}, 1),
+			release:  make(chan struct{}),
+		}
+		ns := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		done := make(chan error, 1)
+		go func() {
+			done <- ns.Emit("slow")
+		}()
+		<-conn.writing
+
+		start := time.Now()
+		So(ns.Volatile().Emit("dropped", 1), ShouldBeNil)
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+		close(conn.release)
+		So(<-done, ShouldBeNil)
+
+		So(ns.Volatile().Emit("sent", 2), ShouldBeNil)
+		So(conn.Frames(), ShouldResemble, []string{`2["slow"]`, `2["sent",2]`})
+	})
+}
+
+// compressConn records whether its frames are compressed.
+type compressConn struct {
+	*PipeConn
+	mu         sync.Mutex
+	compressed []bool
+}
+
+func (c *compressConn) NextWriter(t engineio.MessageType) (io.WriteCloser, error) {
+	return c.NextCompressedWriter(t, false)
+}
+
+func (c *compressConn) NextCompressedWriter(t engineio.MessageType, compress bool) (io.WriteCloser, error) {
+	c.mu.Lock()
+	c.compressed = append(c.compressed, compress)
+	c.mu.Unlock()
+	return c.PipeConn.NextWriter(t)
+}
+
+func (c *compressConn) flags() []bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]bool(nil), c.compressed...)
+}
+
+func TestCompressedEmit(t *testing.T) {
+	emit := func(queue bool) *compressConn {
+		conn := &compressConn{PipeConn: NewPipeConn("test1")}
+		so := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		if queue {
+			so.startWriter(4, QueueFullBlock)
+		}
+		ns := so.namespace("")
+		So(ns.Emit("plain"), ShouldBeNil)
+		So(ns.Compressed().Emit("big", []byte{1}), ShouldBeNil)
+		So(ns.Emit("plain"), ShouldBeNil)
+		so.flush()
+		So(conn.Frames(), ShouldResemble, []string{
+			`2["plain"]`,
+			`51-["big",{"_placeholder":true,"num":0}]`,
+			"\x01",
+			`2["plain"]`,
+		})
+		so.Disconnect()
+		return conn
+	}
+
+	Convey("Compressed emits hint the transport to compress their frames", t, func() {
+		So(emit(false).flags(), ShouldResemble, []bool{false, true, true, false})
+	})
+
+	Convey("Compressed emits through the write queue keep the hint", t, func() {
+		So(emit(true).flags(), ShouldResemble, []bool{false, true, true, false})
+	})
+
+	Convey("Raw frame hooks pass the hint through", t, func() {
+		conn := &compressConn{PipeConn: NewPipeConn("test1")}
+		var out []string
+		raw := &rawConn{Conn: conn, out: func(id string, data []byte) {
+			out = append(out, string(data))
+		}}
+		ns := newSocket(raw, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		So(ns.Compressed().Emit("big"), ShouldBeNil)
+		So(out, ShouldResemble, []string{`2["big"]`})
+		So(conn.flags(), ShouldResemble, []bool{true})
+	})
+}
+
+func TestBinaryAck(t *testing.T) {
+
+	Convey("Ack callbacks get the attachments of binary acks", t, func() {
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.WaitFrames(1)
+		ns := socketInstance.namespace("")
+		type reply struct {
+			b    []byte
+			a    string
+			text string
+		}
+		got := make(chan reply, 1)
+		So(ns.Emit("ev", []byte{0, 1, 2}, func(b []byte, a *Attachment, text string) {
+			got <- reply{b, a.Data.(*bytes.Buffer).String(), text}
+		}), ShouldBeNil)
+		frames := conn.WaitFrames(3)
+		So(frames[1], ShouldEqual, `51-0["ev",{"_placeholder":true,"num":0}]`)
+		So(frames[2], ShouldEqual, "\x00\x01\x02")
+
+		conn.Send(`62-0[{"_placeholder":true,"num":0},{"_placeholder":true,"num":1},"text"]`)
+		conn.SendBinary([]byte{0, 1, 2, 255})
+		conn.SendBinary([]byte("attachment"))
+		r := <-got
+		So(r.b, ShouldResemble, []byte{0, 1, 2, 255})
+		So(r.a, ShouldEqual, "attachment")
+		So(r.text, ShouldEqual, "text")
+
+		conn.Close()
+		<-done
+	})
+
+	Convey("Binary acks mixing text and binary args fill the params in order", t, func() {
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.WaitFrames(1)
+		ns := socketInstance.namespace("")
+		type reply struct {
+			text string
+			b    []byte
+			n    int
+		}
+		got := make(chan reply, 1)
+		So(ns.Emit("ev", func(text string, b []byte, n int) {
+			got <- reply{text, b, n}
+		}), ShouldBeNil)
+		So(conn.WaitFrames(2)[1], ShouldEqual, `20["ev"]`)
+
+		conn.Send(`61-0["text",{"_placeholder":true,"num":0},42]`)
+		conn.SendBinary([]byte{255, 0})
+		So(<-got, ShouldResemble, reply{"text", []byte{255, 0}, 42})
+
+		conn.Close()
+		<-done
+	})
+
+	Convey("Bytes returned by handlers are acked as attachments", t, func() {
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		ns.On("get", func(so Socket) []byte {
+			return []byte{0, 1, 2}
+		})
+		ns.On("respond", func(so Socket, ack func(string, []byte)) {
+			ack("bin", []byte{255})
+		})
+		conn := NewPipeConn("test1")
+		go newSocket(conn, ns).loop()
+		defer conn.Close()
+		conn.Send(`21["get"]`)
+		conn.Send(`22["respond"]`)
+		So(conn.WaitFrames(5), ShouldResemble, []string{
+			"0",
+			`61-1[{"_placeholder":true,"num":0}]`,
+			"\x00\x01\x02",
+			`61-2["bin",{"_placeholder":true,"num":0}]`,
+			"\xff",
+		})
+	})
+}
+
+func TestEmitBurst(t *testing.T) {
+
+	Convey("Events of a burst are written in order", t, func() {
+		conn := NewPipeConn("test1")
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		root.Of("/chat")
+		ns := newSocket(conn, root).namespace("/chat")
+		ns.connected = true
+		So(ns.EmitBurst([]Event{
+			{Name: "a", Args: []interface{}{1}},
+			{Name: "b", Args: []interface{}{[]byte{1, 2}}},
+			{Name: "c"},
+		}), ShouldBeNil)
+		So(conn.Frames(), ShouldResemble, []string{
+			`2/chat,["a",1]`,
+			`51-/chat,["b",{"_placeholder":true,"num":0}]`,
+			"\x01\x02",
+			`2/chat,["c"]`,
+		})
+	})
+
+	Convey("No event of a burst is written if one fails to encode", t, func() {
+		conn := NewPipeConn("test1")
+		ns := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		err := ns.EmitBurst([]Event{
+			{Name: "a", Args: []interface{}{1}},
+			{Name: "b", Args: []interface{}{make(chan int)}},
+		})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "socketio: failed to encode arg 0 (chan int)")
+		So(conn.Frames(), ShouldBeEmpty)
+	})
+
+	Convey("Bursts follow the policy of emits before the namespace is connected", t, func() {
+		conn := NewPipeConn("test1")
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		root.Of("/chat")
+		ns := newSocket(conn, root).namespace("/chat")
+		So(ns.EmitBurst([]Event{{Name: "a"}}), ShouldEqual, ErrNamespaceNotConnected)
+		So(conn.Frames(), ShouldBeEmpty)
+
+		ns.emitBeforeConnect = EmitBeforeConnectBuffer
+		So(ns.EmitBurst([]Event{{Name: "b"}, {Name: "c"}}), ShouldBeNil)
+		So(conn.Frames(), ShouldBeEmpty)
+		ns.flushPending()
+		So(conn.Frames(), ShouldResemble, []string{`2/chat,["b"]`, `2/chat,["c"]`})
+	})
+}
+
+const benchBurst = 16
+
+func BenchmarkEmitEach(b *testing.B) {
+	socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+	ns := socketInstance.namespace("")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchBurst; j++ {
+			ns.Emit("ev", "data", j)
+		}
+	}
+}
+
+func BenchmarkEmitBurst(b *testing.B) {
+	socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+	ns := socketInstance.namespace("")
+	events := make([]Event, benchBurst)
+	for j := range events {
+		events[j] = Event{Name: "ev", Args: []interface{}{"data", j}}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ns.EmitBurst(events)
+	}
+}
+
+func TestNamespaceDisconnect(t *testing.T) {
+
+	Convey("Disconnecting a namespace leaves its rooms only", t, func() {
+		root := newNamespace(newBroadcastDefault())
+		chat := root.Of("/chat")
+		reasons := make(chan string, 1)
+		So(chat.On("disconnection", func(so Socket, reason string) {
+			reasons <- reason
+		}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, root)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.Send("0/chat")
+		conn.WaitFrames(2)
+		ns := socketInstance.namespace("/chat")
+		So(ns.Join("room"), ShouldBeNil)
+		So(socketInstance.namespace("").Join("room"), ShouldBeNil)
+
+		ns.Disconnect()
+		So(<-reasons, ShouldEqual, ReasonServerNamespaceDisconnect)
+		So(ns.IsConnected(), ShouldBeFalse)
+		So(ns.Rooms(), ShouldBeEmpty)
+		members, _ := root.broadcast.Members(root.Of("/chat").(*namespace).broadcastName("room"))
+		So(members, ShouldBeEmpty)
+		members, _ = root.broadcast.Members(root.broadcastName("room"))
+		So(len(members), ShouldEqual, 1)
+		So(socketInstance.namespace("").IsConnected(), ShouldBeTrue)
+		So(conn.WaitFrames(3)[2], ShouldEqual, "1/chat")
+
+		conn.Close()
+		<-done
+		So(reasons, ShouldBeEmpty)
+	})
+
+	Convey("The reason of a disconnection is sent before closing", t, func() {
+		root := newNamespace(newBroadcastDefault())
+		root.Of("/chat")
+		root.Of("/news")
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, root)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.Send("0/chat")
+		conn.Send("0/news")
+		conn.WaitFrames(3)
+
+		socketInstance.namespace("/chat").DisconnectWithReason("kicked")
+		So(conn.WaitFrames(4)[3], ShouldEqual, `1/chat,"kicked"`)
+		So(socketInstance.namespace("").IsConnected(), ShouldBeTrue)
+
+		socketInstance.namespace("").DisconnectWithReason("maintenance")
+		<-done
+		frames := conn.Frames()
+		So(len(frames), ShouldEqual, 6)
+		So(frames[4:], ShouldContain, `1"maintenance"`)
+		So(frames[4:], ShouldContain, `1/news,"maintenance"`)
+	})
+}
+
+func TestAckIdWraparound(t *testing.T) {
+
+	Convey("Ack ids wrap around skipping the pending ones", t, func() {
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+		pending, _ := newCaller(func() {})
+		socketInstance.acks[0] = pending
+		maxInt := int(^uint(0) >> 1)
+		socketInstance.id = maxInt - 1
+		for i := 0; i < 3; i++ {
+			So(ns.Emit("ev", func() {}), ShouldBeNil)
+		}
+		So(conn.Frames(), ShouldResemble, []string{
+			fmt.Sprintf(`2%d["ev"]`, maxInt-1),
+			fmt.Sprintf(`2%d["ev"]`, maxInt),
+			`21["ev"]`,
+		})
+		So(socketInstance.acks[0], ShouldEqual, pending)
+		So(len(socketInstance.acks), ShouldEqual, 4)
+	})
+}
+
+func TestEmitError(t *testing.T) {
+
+	Convey("EmitError sends an error packet with the payload", t, func() {
+		conn := NewPipeConn("test1")
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		root.Of("/chat")
+		socketInstance := newSocket(conn, root)
+		socketInstance.namespace("/chat").connected = true
+		So(socketInstance.namespace("/chat").EmitError(map[string]interface{}{"code": 42}), ShouldBeNil)
+		So(socketInstance.namespace("").EmitError(errors.New("denied")), ShouldBeNil)
+		So(socketInstance.namespace("").EmitError("plain"), ShouldBeNil)
+		So(conn.Frames(), ShouldResemble, []string{
+			`4/chat,{"code":42}`,
+			`4{"message":"denied"}`,
+			`4"plain"`,
+		})
+		err := socketInstance.namespace("").EmitError(make(chan int))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "socketio: failed to encode arg 0 (chan int)")
+	})
+}
+
+func TestNamespaceDisconnectRace(t *testing.T) {
+
+	Convey("Disconnecting a namespace while the loop exits leaves its rooms once", t, func() {
+		for i := 0; i < 20; i++ {
+			root := newNamespace(newBroadcastDefault())
+			chat := root.Of("/chat")
+			var mu sync.Mutex
+			disconnections := 0
+			chat.On("disconnection", func(so Socket) {
+				mu.Lock()
+				disconnections++
+				mu.Unlock()
+			})
+			conn := NewPipeConn("test1")
+			socketInstance := newSocket(conn, root)
+			done := make(chan struct{})
+			go func() {
+				socketInstance.loop()
+				close(done)
+			}()
+			conn.Send("0/chat")
+			conn.WaitFrames(2)
+			ns := socketInstance.namespace("/chat")
+			So(ns.JoinAll("a", "b"), ShouldBeNil)
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				ns.Disconnect()
+			}()
+			go func() {
+				defer wg.Done()
+				conn.Close()
+			}()
+			wg.Wait()
+			<-done
+			So(disconnections, ShouldEqual, 1)
+			So(ns.Rooms(), ShouldBeEmpty)
+			members, _ := chat.(*namespace).RoomMembers("a")
+			So(members, ShouldBeEmpty)
+		}
+	})
+}
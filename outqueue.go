@@ -0,0 +1,153 @@
+package socketio
+
+import "errors"
+
+// ErrQueueFull is returned by the emits to a socket whose outgoing queue is
+// full, with the QueueFullError policy.
+var ErrQueueFull = errors.New("socketio: outgoing queue full")
+
+// QueueFullPolicy is what happens to the packets emitted to a socket whose
+// outgoing queue is full.
+type QueueFullPolicy int
+
+const (
+	// QueueFullBlock waits for room in the queue.
+	QueueFullBlock QueueFullPolicy = iota
+	// QueueFullError fails the emit with ErrQueueFull.
+	QueueFullError
+	// QueueFullDrop drops the packet, and the emit succeeds.
+	QueueFullDrop
+)
+
+// outQueue queues the frames of the packets emitted to a socket, for its
+// writer goroutine to write them to the connection. It has a lane for the
+// priority packets, written before the others waiting.
+type outQueue struct {
+	items    chan outItem
+	priority chan outItem
+	policy   QueueFullPolicy
+	// done is closed when the writer returns.
+	done chan struct{}
+}
+
+// outItem is the frames of a packet, or a flush marker if flushed isn't nil.
+type outItem struct {
+	frames  []*batchFrame
+	flushed chan struct{}
+}
+
+// startWriter makes the socket queue the frames of its packets, up to size
+// packets per lane, and starts the goroutine writing them.
+func (s *socket) startWriter(size int, policy QueueFullPolicy) {
+	s.queue = &outQueue{
+		items:    make(chan outItem, size),
+		priority: make(chan outItem, size),
+		policy:   policy,
+		done:     make(chan struct{}),
+	}
+	go s.writeLoop()
+}
+
+// writeLoop writes the frames queued until the socket is closed, or a write
+// fails, which closes the connection. The priority lane is drained first.
+func (s *socket) writeLoop() {
+	defer close(s.queue.done)
+	for {
+		var item outItem
+		select {
+		case item = <-s.queue.priority:
+		default:
+			select {
+			case <-s.ctx.Done():
+				return
+			case item = <-s.queue.priority:
+			case item = <-s.queue.items:
+			}
+		}
+		if item.flushed != nil {
+			close(item.flushed)
+			continue
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.writing.lock(false)
+		err := s.write(func() error {
+			for _, f := range item.frames {
+				if err := s.writeFrame(f); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			s.logger.Errorf("socketio: socket %s: write packet: %s", s.Id(), err)
+			s.Disconnect()
+			return
+		}
+	}
+}
+
+// enqueue queues the frames of a packet in the priority lane if priority is
+// set, according to the policy of the queue if the lane is full, or drops them
+// if volatile. It returns whether they're queued.
+func (s *socket) enqueue(frames []*batchFrame, priority, volatile bool) (bool, error) {
+	if s.ctx.Err() != nil || s.isBroken() {
+		return false, ErrSocketClosed
+	}
+	lane := s.queue.items
+	if priority {
+		lane = s.queue.priority
+	}
+	item := outItem{frames: frames}
+	select {
+	case lane <- item:
+		return true, nil
+	default:
+	}
+	if volatile || s.queue.policy == QueueFullDrop {
+		return false, nil
+	}
+	if s.queue.policy == QueueFullError {
+		return false, ErrQueueFull
+	}
+	select {
+	case lane <- item:
+		return true, nil
+	case <-s.ctx.Done():
+		return false, ErrSocketClosed
+	}
+}
+
+// encodeFrames encodes the packet to frames, for the queue.
+func (s *socket) encodeFrames(p packet) ([]*batchFrame, error) {
+	w := &batchWriter{}
+	e := newEncoder(w)
+	e.codec = s.encoder.codec
+	if err := e.Encode(p); err != nil {
+		return nil, err
+	}
+	return w.frames, nil
+}
+
+// flush waits for the frames queued to be written, if the socket has a queue.
+// Each lane gets a flush marker, as the markers are written in the order of
+// their lane only.
+func (s *socket) flush() {
+	if s.queue == nil {
+		return
+	}
+	for _, lane := range []chan outItem{s.queue.priority, s.queue.items} {
+		flushed := make(chan struct{})
+		select {
+		case lane <- outItem{flushed: flushed}:
+		case <-s.queue.done:
+			return
+		}
+		select {
+		case <-flushed:
+		case <-s.queue.done:
+			return
+		}
+	}
+}
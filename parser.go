@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"strconv"
+	"sync"
 
 	"github.com/googollee/go-engine.io"
 )
@@ -62,9 +64,13 @@ type packet struct {
 	attachNumber int
 }
 
+// encoder encodes packets to the frame writer. It holds no state between
+// packets, so one encoder can be shared by concurrent senders.
 type encoder struct {
-	w   frameWriter
-	err error
+	w frameWriter
+	// codec encodes the packets if not nil, else they're encoded as text
+	// with attachments.
+	codec Codec
 }
 
 func newEncoder(w frameWriter) *encoder {
@@ -75,6 +81,12 @@ func newEncoder(w frameWriter) *encoder {
 
 func (e *encoder) Encode(v packet) error {
 	attachments := encodeAttachments(v.Data)
+	data, binary := encodeBinary(v.Data, len(attachments))
+	v.Data = data
+	attachments = append(attachments, binary...)
+	if e.codec != nil {
+		return e.encodeCodec(v, attachments)
+	}
 	v.attachNumber = len(attachments)
 	if v.attachNumber > 0 {
 		v.Type += _BINARY_EVENT - _EVENT
@@ -90,46 +102,134 @@ func (e *encoder) Encode(v packet) error {
 	return nil
 }
 
+// frameBuffer is a scratch buffer to build a text frame before writing it.
+type frameBuffer struct {
+	bytes.Buffer
+	json *json.Encoder
+}
+
+// maxPooledFrame is the max capacity of a frameBuffer put back in the pool,
+// so a few huge frames don't pin memory.
+const maxPooledFrame = 64 << 10
+
+var frameBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := &frameBuffer{}
+		b.json = json.NewEncoder(&b.Buffer)
+		return b
+	},
+}
+
 func (e *encoder) encodePacket(v packet) error {
-	writer, err := e.w.NextWriter(engineio.MessageText)
-	if err != nil {
-		return err
-	}
-	defer writer.Close()
+	buf := frameBufferPool.Get().(*frameBuffer)
+	defer func() {
+		if buf.Cap() <= maxPooledFrame {
+			buf.Reset()
+			frameBufferPool.Put(buf)
+		}
+	}()
 
-	w := newTrimWriter(writer, "\n")
-	wh := newWriterHelper(w)
-	wh.Write([]byte{byte(v.Type) + '0'})
+	buf.WriteByte(byte(v.Type) + '0')
 	if v.Type == _BINARY_EVENT || v.Type == _BINARY_ACK {
-		wh.Write([]byte(fmt.Sprintf("%d-", v.attachNumber)))
+		buf.WriteString(strconv.Itoa(v.attachNumber))
+		buf.WriteByte('-')
 	}
 	needEnd := false
 	if v.NSP != "" {
-		wh.Write([]byte(v.NSP))
+		buf.WriteString(v.NSP)
 		needEnd = true
 	}
 	if v.Id >= 0 {
-		f := "%d"
 		if needEnd {
-			f = ",%d"
+			buf.WriteByte(',')
 			needEnd = false
 		}
-		wh.Write([]byte(fmt.Sprintf(f, v.Id)))
+		buf.WriteString(strconv.Itoa(v.Id))
 	}
 	if v.Data != nil {
 		if needEnd {
-			wh.Write([]byte{','})
-			needEnd = false
+			buf.WriteByte(',')
 		}
-		if wh.Error() != nil {
-			return wh.Error()
+		if err := buf.json.Encode(v.Data); err != nil {
+			return err
+		}
+		buf.Truncate(buf.Len() - 1)
+	}
+
+	writer, err := e.w.NextWriter(engineio.MessageText)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	wh := newWriterHelper(writer)
+	wh.Write(buf.Bytes())
+	return wh.Error()
+}
+
+// codecPacket is the json encoding of the packets given to a codec, like the
+// packets of socket.io-msgpack-parser.
+type codecPacket struct {
+	Type packetType  `json:"type"`
+	NSP  string      `json:"nsp"`
+	Data interface{} `json:"data,omitempty"`
+	Id   *int        `json:"id,omitempty"`
+}
+
+// encodeCodec writes the packet v as one binary message encoded by the codec,
+// with its attachments in its data.
+func (e *encoder) encodeCodec(v packet, attachments []io.Reader) error {
+	binary := make([][]byte, len(attachments))
+	for i, r := range attachments {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
 		}
-		encoder := json.NewEncoder(w)
-		return encoder.Encode(v.Data)
+		binary[i] = b
+	}
+	p := codecPacket{
+		Type: v.Type,
+		NSP:  v.NSP,
+		Data: v.Data,
 	}
+	if p.NSP == "" {
+		p.NSP = "/"
+	}
+	if v.Id >= 0 {
+		p.Id = &v.Id
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if b, err = e.codec.FromJSON(b, binary); err != nil {
+		return err
+	}
+	writer, err := e.w.NextWriter(engineio.MessageBinary)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	wh := newWriterHelper(writer)
+	wh.Write(b)
 	return wh.Error()
 }
 
+// argError tells which of args failed to encode, if err is caused by one of
+// them, like "socketio: failed to encode arg 2 (chan int): ...". Other errors,
+// like write errors, are returned as is.
+func (e *encoder) argError(args []interface{}, err error) error {
+	for i, arg := range args {
+		b, aerr := json.Marshal(arg)
+		if aerr == nil && e.codec != nil {
+			_, aerr = e.codec.FromJSON(b, nil)
+		}
+		if aerr != nil {
+			return fmt.Errorf("socketio: failed to encode arg %d (%T): %s", i, arg, aerr)
+		}
+	}
+	return err
+}
+
 func (e *encoder) writeBinary(r io.Reader) error {
 	writer, err := e.w.NextWriter(engineio.MessageBinary)
 	if err != nil {
@@ -149,6 +249,49 @@ type decoder struct {
 	message       string
 	current       io.Reader
 	currentCloser io.Closer
+	// limit is the max bytes of a packet with its attachments, 0 for no
+	// limit. read counts the bytes of the current packet.
+	limit int64
+	read  int64
+	// codec decodes the packets if not nil, else they're decoded as text
+	// with attachments.
+	codec Codec
+	// binary are the binary data of the packet decoded by the codec.
+	binary [][]byte
+}
+
+// ErrPayloadTooLarge is returned when decoding a packet larger than the max
+// payload of the server.
+var ErrPayloadTooLarge = errors.New("socketio: payload too large")
+
+// payloadReader reads a frame of the decoder, failing with
+// ErrPayloadTooLarge once the packet exceeds the limit of the decoder.
+type payloadReader struct {
+	r io.Reader
+	d *decoder
+}
+
+func (r payloadReader) Read(p []byte) (int, error) {
+	if r.d.read > r.d.limit {
+		return 0, ErrPayloadTooLarge
+	}
+	if max := r.d.limit - r.d.read + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	r.d.read += int64(n)
+	if r.d.read > r.d.limit {
+		return n, ErrPayloadTooLarge
+	}
+	return n, err
+}
+
+// limitReader limits r to the payload limit of the decoder, if any.
+func (d *decoder) limitReader(r io.Reader) io.Reader {
+	if d.limit <= 0 {
+		return r
+	}
+	return payloadReader{r: r, d: d}
 }
 
 func newDecoder(r frameReader) *decoder {
@@ -157,12 +300,16 @@ func newDecoder(r frameReader) *decoder {
 	}
 }
 
-func (d *decoder) Close() {
-	if d != nil && d.currentCloser != nil {
-		d.currentCloser.Close()
-		d.current = nil
-		d.currentCloser = nil
+// Close closes the reader of the current frame, leaving its unread data. The
+// next frames can't be read if it fails.
+func (d *decoder) Close() error {
+	if d == nil || d.currentCloser == nil {
+		return nil
 	}
+	err := d.currentCloser.Close()
+	d.current = nil
+	d.currentCloser = nil
+	return err
 }
 
 func (d *decoder) Decode(v *packet) error {
@@ -179,10 +326,14 @@ func (d *decoder) Decode(v *packet) error {
 		}
 	}()
 
+	d.read = 0
+	if d.codec != nil {
+		return d.decodeCodec(ty, r, v)
+	}
 	if ty != engineio.MessageText {
 		return fmt.Errorf("need text package")
 	}
-	reader := bufio.NewReader(r)
+	reader := bufio.NewReader(d.limitReader(r))
 
 	v.Id = -1
 
@@ -267,7 +418,12 @@ func (d *decoder) Decode(v *packet) error {
 	if finish {
 		return nil
 	}
+	return d.setData(v, reader, r)
+}
 
+// setData makes the data of the packet v read by reader, closing the frame
+// closer once read.
+func (d *decoder) setData(v *packet, reader *bufio.Reader, closer io.Closer) error {
 	switch v.Type {
 	case _EVENT:
 		fallthrough
@@ -278,45 +434,133 @@ func (d *decoder) Decode(v *packet) error {
 		}
 		d.message = msgReader.Message()
 		d.current = msgReader
-		d.currentCloser = r
+		d.currentCloser = closer
 	case _ACK:
 		fallthrough
 	case _BINARY_ACK:
 		d.current = reader
-		d.currentCloser = r
+		d.currentCloser = closer
 	}
 	return nil
 }
 
+// decodeCodec decodes the packet v of the message r, encoded as a whole by
+// the codec with its binary data.
+func (d *decoder) decodeCodec(ty engineio.MessageType, r io.ReadCloser, v *packet) error {
+	if ty != engineio.MessageBinary {
+		return fmt.Errorf("need binary package")
+	}
+	b, err := ioutil.ReadAll(d.limitReader(r))
+	if err != nil {
+		return err
+	}
+	if b, d.binary, err = d.codec.ToJSON(b); err != nil {
+		return err
+	}
+	var p struct {
+		Type packetType      `json:"type"`
+		NSP  string          `json:"nsp"`
+		Data json.RawMessage `json:"data"`
+		Id   *int            `json:"id"`
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	v.Type = p.Type
+	if p.NSP != "/" {
+		v.NSP = p.NSP
+	}
+	v.Id = -1
+	if p.Id != nil {
+		v.Id = *p.Id
+	}
+	// the binary data is in the data whatever the type, so the type is set
+	// by the binary data decoded.
+	v.attachNumber = len(d.binary)
+	if v.Type == _BINARY_EVENT || v.Type == _BINARY_ACK {
+		v.Type -= _BINARY_EVENT - _EVENT
+	}
+	if v.attachNumber > 0 && (v.Type == _EVENT || v.Type == _ACK) {
+		v.Type += _BINARY_EVENT - _EVENT
+	}
+	if len(p.Data) == 0 {
+		return nil
+	}
+	return d.setData(v, bufio.NewReader(bytes.NewReader(p.Data)), r)
+}
+
 func (d *decoder) Message() string {
 	return d.message
 }
 
-func (d *decoder) DecodeData(v *packet) error {
+func (d *decoder) DecodeData(v *packet) (err error) {
 	if d.current == nil {
 		return nil
 	}
 	defer func() {
-		d.Close()
+		if cerr := d.Close(); err == nil {
+			err = cerr
+		}
 	}()
 	decoder := json.NewDecoder(d.current)
-	if err := decoder.Decode(v.Data); err != nil {
+	if v.Type != _BINARY_EVENT && v.Type != _BINARY_ACK {
+		return decoder.Decode(v.Data)
+	}
+	// decode the placeholders to the attachments before decoding the data, so
+	// they can be decoded into []byte as well as Attachment.
+	decoder.UseNumber()
+	var raw interface{}
+	if err := decoder.Decode(&raw); err != nil {
 		return err
 	}
-	if v.Type == _BINARY_EVENT || v.Type == _BINARY_ACK {
-		binary, err := d.decodeBinary(v.attachNumber)
+	binary, err := d.decodeBinary(v.attachNumber)
+	if err != nil {
+		return err
+	}
+	if raw, err = resolvePlaceholders(raw, binary); err != nil {
+		return err
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v.Data); err != nil {
+		return err
+	}
+	v.Type -= _BINARY_EVENT - _EVENT
+	return nil
+}
+
+// Discard skips the data of the packet v with its attachments.
+func (d *decoder) Discard(v *packet) error {
+	if d == nil {
+		return nil
+	}
+	if err := d.Close(); err != nil {
+		return err
+	}
+	if v.Type != _BINARY_EVENT && v.Type != _BINARY_ACK || d.codec != nil {
+		return nil
+	}
+	for i := 0; i < v.attachNumber; i++ {
+		_, r, err := d.reader.NextReader()
 		if err != nil {
 			return err
 		}
-		if err := decodeAttachments(v.Data, binary); err != nil {
+		if err := r.Close(); err != nil {
 			return err
 		}
-		v.Type -= _BINARY_EVENT - _EVENT
 	}
 	return nil
 }
 
 func (d *decoder) decodeBinary(num int) ([][]byte, error) {
+	if d.codec != nil {
+		return d.binary, nil
+	}
+	if d.limit > 0 && int64(num) > d.limit {
+		return nil, ErrPayloadTooLarge
+	}
 	ret := make([][]byte, num)
 	for i := 0; i < num; i++ {
 		d.currentCloser.Close()
@@ -328,7 +572,7 @@ func (d *decoder) decodeBinary(num int) ([][]byte, error) {
 		if t == engineio.MessageText {
 			return nil, fmt.Errorf("need binary")
 		}
-		b, err := ioutil.ReadAll(r)
+		b, err := ioutil.ReadAll(d.limitReader(r))
 		if err != nil {
 			return nil, err
 		}
@@ -2,7 +2,9 @@ package socketio
 
 import (
 	"bytes"
+	"encoding/json"
 	"github.com/googollee/go-engine.io"
+	"strconv"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -188,4 +190,87 @@ func TestParser(t *testing.T) {
 		So(buf.String(), ShouldEqual, "data")
 	})
 
+	Convey("Binary type with []byte", t, func() {
+		type Payload struct {
+			Name string `json:"name"`
+			Data []byte `json:"data"`
+		}
+		p = packet{
+			Type: _EVENT,
+			Id:   1,
+			NSP:  "/abc",
+			Data: []interface{}{"binary", Payload{Name: "file", Data: []byte("data")}},
+		}
+		var payload Payload
+		decodeData = &[]interface{}{&payload}
+		output = `51-/abc,1["binary",{"data":{"_placeholder":true,"num":0},"name":"file"}]`
+		message = "binary"
+
+		test()
+
+		So(payload.Name, ShouldEqual, "file")
+		So(string(payload.Data), ShouldEqual, "data")
+	})
+
+	Convey("Types marshaling their own json", t, func() {
+		p = packet{
+			Type: _EVENT,
+			Id:   -1,
+			Data: []interface{}{"custom", CustomJSON{
+				Secret: "s",
+				Blob:   []byte("ab"),
+				File:   &Attachment{Data: bytes.NewBufferString("not sent")},
+			}, &PtrCustomJSON{N: 1}},
+		}
+		var custom CustomJSON
+		var ptr PtrCustomJSON
+		decodeData = &[]interface{}{&custom, &ptr}
+		output = `2["custom",{"blob":"ab"},{"n":"1"}]`
+		message = "custom"
+
+		test()
+
+		So(string(custom.Blob), ShouldEqual, "ab")
+		So(ptr.N, ShouldEqual, 1)
+	})
+
+}
+
+// CustomJSON hides its Secret and sends Blob as a string.
+type CustomJSON struct {
+	Secret string
+	Blob   []byte
+	File   *Attachment
+}
+
+func (c CustomJSON) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"blob": string(c.Blob)})
+}
+
+func (c *CustomJSON) UnmarshalJSON(b []byte) error {
+	var v map[string]string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	c.Blob = []byte(v["blob"])
+	return nil
+}
+
+// PtrCustomJSON sends N as a string by a pointer receiver.
+type PtrCustomJSON struct {
+	N int
+}
+
+func (c *PtrCustomJSON) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"n": strconv.Itoa(c.N)})
+}
+
+func (c *PtrCustomJSON) UnmarshalJSON(b []byte) error {
+	var v map[string]string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(v["n"])
+	c.N = n
+	return err
 }
@@ -0,0 +1,57 @@
+package socketio
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrRateLimited closes the connection of a socket sending events over the
+// rate limit with the RateLimitDisconnect policy.
+var ErrRateLimited = errors.New("socketio: rate limit exceeded")
+
+// RateLimitPolicy is what happens to the events of a socket over the rate
+// limit.
+type RateLimitPolicy int
+
+const (
+	// RateLimitDrop drops the events over the limit.
+	RateLimitDrop RateLimitPolicy = iota
+	// RateLimitDisconnect closes the connection with ErrRateLimited.
+	RateLimitDisconnect
+)
+
+// rateLimiter is a token bucket limiting the incoming events of a socket.
+// It's only used by the loop of the socket.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	policy RateLimitPolicy
+}
+
+func newRateLimiter(rate float64, burst int, policy RateLimitPolicy) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		policy: policy,
+	}
+}
+
+// allow takes a token at now if any.
+func (l *rateLimiter) allow(now time.Time) bool {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,83 @@
+package socketio
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRateLimiter(t *testing.T) {
+
+	Convey("Tokens refill at the rate up to the burst", t, func() {
+		l := newRateLimiter(10, 2, RateLimitDrop)
+		now := l.last
+		So(l.allow(now), ShouldBeTrue)
+		So(l.allow(now), ShouldBeTrue)
+		So(l.allow(now), ShouldBeFalse)
+		now = now.Add(100 * time.Millisecond)
+		So(l.allow(now), ShouldBeTrue)
+		So(l.allow(now), ShouldBeFalse)
+		now = now.Add(time.Hour)
+		So(l.allow(now), ShouldBeTrue)
+		So(l.allow(now), ShouldBeTrue)
+		So(l.allow(now), ShouldBeFalse)
+	})
+}
+
+func TestServerRateLimit(t *testing.T) {
+
+	flood := func(policy RateLimitPolicy) (int, error) {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetRateLimit(0.001, 3, policy)
+		count := 0
+		So(server.On("ev", func() {
+			count++
+		}), ShouldBeNil)
+		So(server.On("bin", func(b []byte) {
+			count++
+		}), ShouldBeNil)
+		acked := make(chan struct{})
+		So(server.On("connection", func(so Socket) {
+			so.Emit("sync", func() {
+				close(acked)
+			})
+		}), ShouldBeNil)
+		errs := make(chan error, 1)
+		So(server.OnError("", func(so Socket, err error) {
+			errs <- err
+		}), ShouldBeNil)
+
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		for i := 0; i < 5; i++ {
+			conn.Send(`2["ev"]`)
+			conn.Send(`51-["bin",{"_placeholder":true,"num":0}]`)
+			conn.SendBinary([]byte{1})
+		}
+		if policy == RateLimitDisconnect {
+			err = <-errs
+		} else {
+			// acks aren't limited, and come after the flood.
+			conn.Send(`30[]`)
+			<-acked
+		}
+		conn.Close()
+		So(waitFor(func() bool { return server.NamespaceCount("") == 0 }), ShouldBeTrue)
+		So(errs, ShouldBeEmpty)
+		return count, err
+	}
+
+	Convey("Events over the limit are dropped", t, func() {
+		count, err := flood(RateLimitDrop)
+		So(count, ShouldEqual, 3)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Events over the limit close the connection", t, func() {
+		count, err := flood(RateLimitDisconnect)
+		So(count, ShouldEqual, 3)
+		So(err, ShouldEqual, ErrRateLimited)
+	})
+}
@@ -0,0 +1,73 @@
+package socketio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/googollee/go-engine.io"
+)
+
+// rawConn calls the raw frame hooks of the server with the frames read from
+// and written to the connection.
+type rawConn struct {
+	engineio.Conn
+	in    func(id string, data []byte)
+	out   func(id string, data []byte)
+	limit int64
+}
+
+func (c *rawConn) NextReader() (engineio.MessageType, io.ReadCloser, error) {
+	t, r, err := c.Conn.NextReader()
+	if err != nil || c.in == nil {
+		return t, r, err
+	}
+	defer r.Close()
+	var src io.Reader = r
+	if c.limit > 0 {
+		// leave the decoder to fail with the byte over the limit.
+		src = io.LimitReader(r, c.limit+1)
+	}
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return t, nil, err
+	}
+	c.in(c.Id(), data)
+	return t, ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *rawConn) NextWriter(t engineio.MessageType) (io.WriteCloser, error) {
+	w, err := c.Conn.NextWriter(t)
+	if err != nil || c.out == nil {
+		return w, err
+	}
+	return &rawWriter{conn: c, w: w}, nil
+}
+
+// NextCompressedWriter returns the next message writer like NextWriter,
+// compressed if the connection is a CompressWriter.
+func (c *rawConn) NextCompressedWriter(t engineio.MessageType, compress bool) (io.WriteCloser, error) {
+	w, err := nextWriter(c.Conn, t, compress)
+	if err != nil || c.out == nil {
+		return w, err
+	}
+	return &rawWriter{conn: c, w: w}, nil
+}
+
+// rawWriter buffers a frame to pass it to the out hook when closed.
+type rawWriter struct {
+	bytes.Buffer
+	conn *rawConn
+	w    io.WriteCloser
+}
+
+func (w *rawWriter) Close() error {
+	w.conn.out(w.conn.Id(), w.Bytes())
+	wh := newWriterHelper(w.w)
+	wh.Write(w.Bytes())
+	if err := wh.Error(); err != nil {
+		w.w.Close()
+		return err
+	}
+	return w.w.Close()
+}
@@ -0,0 +1,57 @@
+package socketio
+
+import (
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRawHooks(t *testing.T) {
+
+	Convey("Raw hooks see the frames in and out", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		var mu sync.Mutex
+		var in, out []string
+		server.OnRawIn(func(id string, data []byte) {
+			mu.Lock()
+			in = append(in, id+" "+string(data))
+			mu.Unlock()
+		})
+		server.OnRawOut(func(id string, data []byte) {
+			mu.Lock()
+			out = append(out, id+" "+string(data))
+			mu.Unlock()
+		})
+		So(server.On("echo", func(msg string) string {
+			return msg
+		}), ShouldBeNil)
+		So(server.On("bin", func(so Socket, b []byte) {
+			so.Emit("bin", b)
+		}), ShouldBeNil)
+
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		conn.Send(`21["echo","hi"]`)
+		conn.Send(`51-["bin",{"_placeholder":true,"num":0}]`)
+		conn.SendBinary([]byte("data"))
+		frames := conn.WaitFrames(4)
+		conn.Close()
+		So(waitFor(func() bool { return server.NamespaceCount("") == 0 }), ShouldBeTrue)
+
+		mu.Lock()
+		defer mu.Unlock()
+		So(in, ShouldResemble, []string{
+			`test1 21["echo","hi"]`,
+			`test1 51-["bin",{"_placeholder":true,"num":0}]`,
+			`test1 data`,
+		})
+		So(frames, ShouldResemble, []string{
+			"0", `31["hi"]`, `51-["bin",{"_placeholder":true,"num":0}]`, "data",
+		})
+		So(out, ShouldResemble, []string{
+			"test1 0", `test1 31["hi"]`, `test1 51-["bin",{"_placeholder":true,"num":0}]`, "test1 data",
+		})
+	})
+}
@@ -0,0 +1,434 @@
+// Package redis provides a socketio.BroadcastAdaptor relaying the broadcasts
+// to the other nodes of a cluster through redis pub/sub, so a broadcast on one
+// node reaches the clients connected to the others.
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	socketio "github.com/cention-sany/go-socket.io"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// ErrAttachment is returned by Adaptor.Send when args contain attachments,
+// like []byte values, which can't be relayed through redis.
+var ErrAttachment = errors.New("socketio: redis broadcast doesn't support attachments")
+
+// ErrClosed is returned by the broadcasts of a closed Adaptor.
+var ErrClosed = errors.New("socketio: redis adaptor closed")
+
+const (
+	// minReconnectDelay is the delay before redialing a failed subscription,
+	// doubled after each failed attempt up to maxReconnectDelay.
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 10 * time.Second
+)
+
+// Options is the configuration of Adaptor.
+type Options struct {
+	// Addr is the address of the redis server, like "localhost:6379".
+	Addr string
+	// Password is used to AUTH with the redis server if not empty.
+	Password string
+	// Prefix is the prefix of the pub/sub channels. Default is "socket.io".
+	Prefix string
+	// Logger logs the broadcasts of other nodes failing to relay, and the
+	// errors of the connections to redis. Default logs nothing.
+	Logger socketio.Logger
+}
+
+// Adaptor is a socketio.BroadcastAdaptor which relays broadcasts to other
+// nodes through redis pub/sub. Rooms are tracked per node as each node only
+// knows its own connections, and every node subscribes to the channels of the
+// rooms with local members, emitting the broadcasts of the others to them.
+// The subscription is redialed with backoff when its connection fails.
+type Adaptor struct {
+	local  socketio.BroadcastAdaptor
+	prefix string
+	node   string
+	logger socketio.Logger
+	dial   func() (redigo.Conn, error)
+	pubMu  sync.Mutex
+	// pub is nil after a failure, until the next publish dials again.
+	pub redigo.Conn
+	// roomsMu serializes the joins and leaves with the subscriptions to
+	// their rooms, guarding rooms.
+	roomsMu sync.Mutex
+	// rooms are the rooms with local members, whose channels are subscribed.
+	rooms map[string]struct{}
+	// subMu guards sub, only replaced by loop, against the subscriptions.
+	subMu     sync.Mutex
+	sub       redigo.PubSubConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// message is the payload published for each broadcast.
+type message struct {
+	Node   string            `json:"node"`
+	Ignore string            `json:"ignore,omitempty"`
+	Room   string            `json:"room"`
+	Event  string            `json:"event"`
+	Args   []json.RawMessage `json:"args"`
+	// Before are the rooms of a SendRooms published before Room, whose
+	// members got the event already.
+	Before []string `json:"before,omitempty"`
+	// Fraction is the fraction of the members to send to, for SendSample.
+	Fraction *float64 `json:"fraction,omitempty"`
+}
+
+// New connects to redis with given options and starts relaying broadcasts
+// published by other nodes.
+func New(opts Options) (*Adaptor, error) {
+	return newAdaptor(opts, func() (redigo.Conn, error) {
+		return dial(opts)
+	})
+}
+
+func dial(opts Options) (redigo.Conn, error) {
+	if opts.Password == "" {
+		return redigo.Dial("tcp", opts.Addr)
+	}
+	return redigo.Dial("tcp", opts.Addr, redigo.DialPassword(opts.Password))
+}
+
+// newAdaptor returns the adaptor publishing and subscribing with the
+// connections of dial, relaying the broadcasts of the other nodes.
+func newAdaptor(opts Options, dial func() (redigo.Conn, error)) (*Adaptor, error) {
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = "socket.io"
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	pub, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	sub, err := dial()
+	if err != nil {
+		pub.Close()
+		return nil, err
+	}
+	ret := &Adaptor{
+		local:  socketio.NewLocalBroadcastAdaptor(),
+		prefix: prefix,
+		node:   hex.EncodeToString(id),
+		logger: opts.Logger,
+		dial:   dial,
+		pub:    pub,
+		rooms:  make(map[string]struct{}),
+		sub:    redigo.PubSubConn{Conn: sub},
+		done:   make(chan struct{}),
+	}
+	go ret.loop()
+	return ret, nil
+}
+
+// Close closes the connections to redis.
+func (a *Adaptor) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.subMu.Lock()
+		a.sub.Close()
+		a.subMu.Unlock()
+		a.pubMu.Lock()
+		if a.pub != nil {
+			err = a.pub.Close()
+			a.pub = nil
+		}
+		a.pubMu.Unlock()
+	})
+	return err
+}
+
+func (a *Adaptor) closed() bool {
+	select {
+	case <-a.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Join makes the socket join the room on this node, subscribing to the
+// channel of the room for its first member.
+func (a *Adaptor) Join(room string, socket socketio.Socket) error {
+	a.roomsMu.Lock()
+	defer a.roomsMu.Unlock()
+	if err := a.local.Join(room, socket); err != nil {
+		return err
+	}
+	if _, ok := a.rooms[room]; ok {
+		return nil
+	}
+	a.rooms[room] = struct{}{}
+	a.subMu.Lock()
+	defer a.subMu.Unlock()
+	// a failed connection is redialed by loop, subscribing to the room then.
+	if err := a.sub.Subscribe(a.channel(room)); err != nil {
+		a.errorf("socketio: redis: subscribe %s: %s", a.channel(room), err)
+	}
+	return nil
+}
+
+// Leave makes the socket leave the room on this node, unsubscribing from the
+// channel of the room after its last member.
+func (a *Adaptor) Leave(room string, socket socketio.Socket) error {
+	a.roomsMu.Lock()
+	defer a.roomsMu.Unlock()
+	if err := a.local.Leave(room, socket); err != nil {
+		return err
+	}
+	if _, ok := a.rooms[room]; !ok {
+		return nil
+	}
+	members, err := a.local.Members(room)
+	if err != nil || len(members) > 0 {
+		return err
+	}
+	delete(a.rooms, room)
+	a.subMu.Lock()
+	defer a.subMu.Unlock()
+	if err := a.sub.Unsubscribe(a.channel(room)); err != nil {
+		a.errorf("socketio: redis: unsubscribe %s: %s", a.channel(room), err)
+	}
+	return nil
+}
+
+// Members returns the sockets of this node in the room.
+func (a *Adaptor) Members(room string) ([]socketio.Socket, error) {
+	return a.local.Members(room)
+}
+
+// Send sends the event to the local members of the room, and publishes it to
+// the other nodes.
+func (a *Adaptor) Send(ignore socketio.Socket, room, event string, args ...interface{}) error {
+	msg, err := a.newMessage(ignore, event, args)
+	if err != nil {
+		return err
+	}
+	msg.Room = room
+	if err := a.local.Send(ignore, room, event, args...); err != nil {
+		return err
+	}
+	return a.publish(msg)
+}
+
+// SendRooms sends the event once to the local sockets in any of the rooms,
+// and publishes it on the channel of each room for the other nodes, which
+// skip the members of the rooms before it to send it once to theirs.
+func (a *Adaptor) SendRooms(except socketio.Socket, rooms []string, event string, args ...interface{}) error {
+	if len(rooms) == 0 {
+		return nil
+	}
+	msg, err := a.newMessage(except, event, args)
+	if err != nil {
+		return err
+	}
+	if err := a.local.(socketio.RoomsSender).SendRooms(except, rooms, event, args...); err != nil {
+		return err
+	}
+	for i, room := range rooms {
+		msg.Room = room
+		msg.Before = rooms[:i]
+		if err := a.publish(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendSample sends the event to a random fraction of the local members of
+// the room, and publishes it for the other nodes to send it to the same
+// fraction of their members.
+func (a *Adaptor) SendSample(except socketio.Socket, room, event string, fraction float64, args ...interface{}) error {
+	msg, err := a.newMessage(except, event, args)
+	if err != nil {
+		return err
+	}
+	msg.Room = room
+	msg.Fraction = &fraction
+	if err := a.local.(socketio.RoomSampler).SendSample(except, room, event, fraction, args...); err != nil {
+		return err
+	}
+	return a.publish(msg)
+}
+
+// channel returns the pub/sub channel of the room.
+func (a *Adaptor) channel(room string) string {
+	return a.prefix + "#" + room
+}
+
+// publish publishes msg on the channel of its room, dialing again after a
+// failure of the connection.
+func (a *Adaptor) publish(msg *message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	a.pubMu.Lock()
+	defer a.pubMu.Unlock()
+	if a.closed() {
+		return ErrClosed
+	}
+	if a.pub == nil {
+		if a.pub, err = a.dial(); err != nil {
+			return err
+		}
+	}
+	if _, err = a.pub.Do("PUBLISH", a.channel(msg.Room), b); err != nil && a.pub.Err() != nil {
+		a.pub.Close()
+		a.pub = nil
+	}
+	return err
+}
+
+// newMessage returns the message of the event with args, except to the
+// ignore socket if not nil.
+func (a *Adaptor) newMessage(ignore socketio.Socket, event string, args []interface{}) (*message, error) {
+	if socketio.HasAttachments(args...) {
+		return nil, ErrAttachment
+	}
+	msg := &message{
+		Node:  a.node,
+		Event: event,
+		Args:  make([]json.RawMessage, len(args)),
+	}
+	for i, arg := range args {
+		b, err := json.Marshal(arg)
+		if err != nil {
+			return nil, err
+		}
+		msg.Args[i] = b
+	}
+	if ignore != nil {
+		msg.Ignore = ignore.Id()
+	}
+	return msg, nil
+}
+
+// loop relays the broadcasts of the other nodes until the adaptor is closed,
+// redialing the subscription when it fails.
+func (a *Adaptor) loop() {
+	for {
+		switch v := a.sub.Receive().(type) {
+		case redigo.Message:
+			if err := a.onMessage(v.Data); err != nil {
+				a.errorf("socketio: redis: relay broadcast of %s: %s", v.Channel, err)
+			}
+		case error:
+			if a.closed() {
+				return
+			}
+			a.errorf("socketio: redis: receive, reconnecting: %s", v)
+			if !a.reconnect() {
+				return
+			}
+		}
+	}
+}
+
+// reconnect redials the subscription with exponential backoff until it
+// succeeds, or returns false if the adaptor is closed.
+func (a *Adaptor) reconnect() bool {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-a.done:
+			return false
+		case <-time.After(delay):
+		}
+		err := a.resubscribe()
+		if err == nil {
+			return true
+		}
+		a.errorf("socketio: redis: reconnect: %s", err)
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// resubscribe replaces the subscription with a new connection, subscribed to
+// the channels of the rooms with local members.
+func (a *Adaptor) resubscribe() error {
+	conn, err := a.dial()
+	if err != nil {
+		return err
+	}
+	a.roomsMu.Lock()
+	defer a.roomsMu.Unlock()
+	a.subMu.Lock()
+	defer a.subMu.Unlock()
+	a.sub.Close()
+	a.sub = redigo.PubSubConn{Conn: conn}
+	if a.closed() {
+		// Close didn't see the new connection.
+		return conn.Close()
+	}
+	if len(a.rooms) == 0 {
+		return nil
+	}
+	channels := make([]interface{}, 0, len(a.rooms))
+	for room := range a.rooms {
+		channels = append(channels, a.channel(room))
+	}
+	return a.sub.Subscribe(channels...)
+}
+
+func (a *Adaptor) errorf(format string, args ...interface{}) {
+	if a.logger != nil {
+		a.logger.Errorf(format, args...)
+	}
+}
+
+// onMessage emits a broadcast published by another node to the local
+// members of the room.
+func (a *Adaptor) onMessage(data []byte) error {
+	var msg message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	if msg.Node == a.node {
+		return nil
+	}
+	args := make([]interface{}, len(msg.Args))
+	for i, v := range msg.Args {
+		args[i] = v
+	}
+	// the socket excluded by SendRooms or SendSample is on the node of the
+	// sender.
+	if msg.Fraction != nil {
+		return a.local.(socketio.RoomSampler).SendSample(nil, msg.Room, msg.Event, *msg.Fraction, args...)
+	}
+	members, err := a.local.Members(msg.Room)
+	if err != nil {
+		return err
+	}
+	sent := make(map[string]bool)
+	for _, room := range msg.Before {
+		before, err := a.local.Members(room)
+		if err != nil {
+			return err
+		}
+		for _, so := range before {
+			sent[so.Id()] = true
+		}
+	}
+	for _, so := range members {
+		if so.Id() == msg.Ignore || sent[so.Id()] {
+			continue
+		}
+		so.Emit(msg.Event, args...)
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	socketio "github.com/cention-sany/go-socket.io"
+	redigo "github.com/gomodule/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeRedis is an in-memory redis pub/sub server, delivering the messages
+// published on a channel to the connections subscribed to it.
+type fakeRedis struct {
+	mu    sync.Mutex
+	conns []*fakeConn
+	// down makes dial fail.
+	down bool
+}
+
+func (r *fakeRedis) dial() (redigo.Conn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.down {
+		return nil, errors.New("connection refused")
+	}
+	c := &fakeConn{
+		redis:    r,
+		channels: make(map[string]bool),
+		replies:  make(chan interface{}, 100),
+		closed:   make(chan struct{}),
+	}
+	r.conns = append(r.conns, c)
+	return c, nil
+}
+
+// drop closes the connections, like a restart of the server, and makes dial
+// fail if down.
+func (r *fakeRedis) drop(down bool) {
+	r.mu.Lock()
+	conns := r.conns
+	r.conns = nil
+	r.down = down
+	r.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (r *fakeRedis) setDown(down bool) {
+	r.mu.Lock()
+	r.down = down
+	r.mu.Unlock()
+}
+
+// subscribers returns the number of connections subscribed to channel.
+func (r *fakeRedis) subscribers(channel string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, c := range r.conns {
+		if c.channels[channel] {
+			n++
+		}
+	}
+	return n
+}
+
+// publish delivers data on channel to the subscribers, like PUBLISH.
+func (r *fakeRedis) publish(channel string, data []byte) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, c := range r.conns {
+		if c.channels[channel] {
+			c.replies <- []interface{}{[]byte("message"), []byte(channel), data}
+			n++
+		}
+	}
+	return n
+}
+
+// fakeConn is a redigo.Conn of a fakeRedis.
+type fakeConn struct {
+	redis *fakeRedis
+	// channels are the subscribed channels, guarded by redis.mu.
+	channels  map[string]bool
+	replies   chan interface{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var errClosedConn = errors.New("use of closed connection")
+
+func (c *fakeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *fakeConn) Err() error {
+	select {
+	case <-c.closed:
+		return errClosedConn
+	default:
+		return nil
+	}
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	if cmd != "PUBLISH" {
+		return nil, fmt.Errorf("unexpected %s", cmd)
+	}
+	return c.redis.publish(args[0].(string), args[1].([]byte)), nil
+}
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if cmd != "SUBSCRIBE" && cmd != "UNSUBSCRIBE" {
+		return fmt.Errorf("unexpected %s", cmd)
+	}
+	c.redis.mu.Lock()
+	defer c.redis.mu.Unlock()
+	for _, arg := range args {
+		channel := arg.(string)
+		if cmd == "SUBSCRIBE" {
+			c.channels[channel] = true
+		} else {
+			delete(c.channels, channel)
+		}
+		c.replies <- []interface{}{[]byte(strings.ToLower(cmd)), []byte(channel), int64(len(c.channels))}
+	}
+	return nil
+}
+
+func (c *fakeConn) Flush() error {
+	return c.Err()
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	select {
+	case r := <-c.replies:
+		return r, nil
+	case <-c.closed:
+		return nil, errClosedConn
+	}
+}
+
+// errorLogger records the errors logged.
+type errorLogger struct {
+	errors chan string
+}
+
+func (l errorLogger) Debugf(format string, args ...interface{}) {}
+
+func (l errorLogger) Errorf(format string, args ...interface{}) {
+	l.errors <- fmt.Sprintf(format, args...)
+}
+
+// node is a server with an adaptor of the fake redis.
+func node(r *fakeRedis, logger socketio.Logger) (*socketio.Server, *Adaptor) {
+	a, err := newAdaptor(Options{Logger: logger}, r.dial)
+	So(err, ShouldBeNil)
+	server, err := socketio.NewServer(nil)
+	So(err, ShouldBeNil)
+	server.SetAdaptor(a)
+	return server, a
+}
+
+func TestAdaptor(t *testing.T) {
+	wait := func(ts *socketio.TestSocket, n int) []socketio.TestEvent {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		events, err := ts.WaitEvents(ctx, n)
+		So(err, ShouldBeNil)
+		return events
+	}
+	waitFor := func(cond func() bool) {
+		deadline := time.Now().Add(time.Second)
+		for !cond() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		So(cond(), ShouldBeTrue)
+	}
+
+	Convey("Broadcasts reach the members of the room on every node once", t, func() {
+		r := &fakeRedis{}
+		server1, a1 := node(r, nil)
+		defer a1.Close()
+		server2, a2 := node(r, nil)
+		defer a2.Close()
+		sender := socketio.NewTestSocket(server1)
+		defer sender.Close()
+		local := socketio.NewTestSocket(server1)
+		defer local.Close()
+		remote := socketio.NewTestSocket(server2)
+		defer remote.Close()
+		for _, ts := range []*socketio.TestSocket{sender, local, remote} {
+			So(ts.Join("room"), ShouldBeNil)
+		}
+
+		So(sender.BroadcastTo("room", "ev", "data", map[string]int{"i": 1}), ShouldBeNil)
+		want := socketio.TestEvent{
+			Name:  "ev",
+			Args:  []interface{}{"data", map[string]interface{}{"i": float64(1)}},
+			AckId: -1,
+		}
+		So(wait(local, 1), ShouldResemble, []socketio.TestEvent{want})
+		So(wait(remote, 1), ShouldResemble, []socketio.TestEvent{want})
+
+		server2.BroadcastTo("room", "back")
+		So(wait(sender, 1)[0].Name, ShouldEqual, "back")
+		So(wait(local, 2)[1].Name, ShouldEqual, "back")
+		So(wait(remote, 2)[1].Name, ShouldEqual, "back")
+		time.Sleep(10 * time.Millisecond)
+		So(sender.Events(), ShouldHaveLength, 1)
+		So(local.Events(), ShouldHaveLength, 2)
+		So(remote.Events(), ShouldHaveLength, 2)
+	})
+
+	Convey("Broadcasts to several rooms reach the members of every node once", t, func() {
+		r := &fakeRedis{}
+		server1, a1 := node(r, nil)
+		defer a1.Close()
+		server2, a2 := node(r, nil)
+		defer a2.Close()
+		local := socketio.NewTestSocket(server1)
+		defer local.Close()
+		remote := socketio.NewTestSocket(server2)
+		defer remote.Close()
+		other := socketio.NewTestSocket(server2)
+		defer other.Close()
+		So(local.JoinAll("a", "b"), ShouldBeNil)
+		So(remote.JoinAll("a", "b"), ShouldBeNil)
+		So(other.Join("b"), ShouldBeNil)
+
+		So(server1.To("a").To("b").Emit("ev"), ShouldBeNil)
+		So(wait(local, 1)[0].Name, ShouldEqual, "ev")
+		So(wait(remote, 1)[0].Name, ShouldEqual, "ev")
+		So(wait(other, 1)[0].Name, ShouldEqual, "ev")
+		time.Sleep(10 * time.Millisecond)
+		So(local.Events(), ShouldHaveLength, 1)
+		So(remote.Events(), ShouldHaveLength, 1)
+		So(other.Events(), ShouldHaveLength, 1)
+	})
+
+	Convey("Sampled broadcasts reach a fraction of the members of every node", t, func() {
+		r := &fakeRedis{}
+		server1, a1 := node(r, nil)
+		defer a1.Close()
+		server2, a2 := node(r, nil)
+		defer a2.Close()
+		var sockets []*socketio.TestSocket
+		for i := 0; i < 8; i++ {
+			server := server1
+			if i%2 == 1 {
+				server = server2
+			}
+			ts := socketio.NewTestSocket(server)
+			defer ts.Close()
+			So(ts.Join("room"), ShouldBeNil)
+			sockets = append(sockets, ts)
+		}
+
+		So(server1.BroadcastToSample("room", "ev", 0.5), ShouldBeNil)
+		time.Sleep(20 * time.Millisecond)
+		got := []int{0, 0}
+		for i, ts := range sockets {
+			got[i%2] += len(ts.Events())
+		}
+		So(got, ShouldResemble, []int{2, 2})
+	})
+
+	Convey("Broadcasts failing to relay are logged", t, func() {
+		r := &fakeRedis{}
+		logger := errorLogger{errors: make(chan string, 1)}
+		server, a := node(r, logger)
+		ts := socketio.NewTestSocket(server)
+		defer ts.Close()
+		So(ts.Join("room"), ShouldBeNil)
+		r.publish("socket.io#:room", []byte("{"))
+		So(<-logger.errors, ShouldStartWith, "socketio: redis: relay broadcast of socket.io#:room: ")
+
+		// closing the adaptor stops the relay quietly.
+		So(a.Close(), ShouldBeNil)
+		time.Sleep(10 * time.Millisecond)
+		So(logger.errors, ShouldBeEmpty)
+	})
+
+	Convey("Nodes subscribe to the rooms with local members only", t, func() {
+		r := &fakeRedis{}
+		server1, a1 := node(r, nil)
+		defer a1.Close()
+		server2, a2 := node(r, nil)
+		defer a2.Close()
+		first := socketio.NewTestSocket(server1)
+		defer first.Close()
+		second := socketio.NewTestSocket(server1)
+		defer second.Close()
+		So(first.Join("room"), ShouldBeNil)
+		So(second.Join("room"), ShouldBeNil)
+		So(r.subscribers("socket.io#:room"), ShouldEqual, 1)
+		So(r.subscribers("socket.io#:other"), ShouldEqual, 0)
+
+		So(server2.BroadcastToNamespace("", "other", "ev"), ShouldBeNil)
+		So(first.Leave("room"), ShouldBeNil)
+		So(r.subscribers("socket.io#:room"), ShouldEqual, 1)
+		So(second.Leave("room"), ShouldBeNil)
+		So(r.subscribers("socket.io#:room"), ShouldEqual, 0)
+		So(server2.BroadcastToNamespace("", "room", "ev"), ShouldBeNil)
+		time.Sleep(10 * time.Millisecond)
+		So(first.Events(), ShouldBeEmpty)
+		So(second.Events(), ShouldBeEmpty)
+	})
+
+	Convey("Failed connections are redialed with backoff and resubscribed", t, func() {
+		r := &fakeRedis{}
+		logger := errorLogger{errors: make(chan string, 10)}
+		server1, a1 := node(r, logger)
+		defer a1.Close()
+		server2, a2 := node(r, nil)
+		defer a2.Close()
+		remote := socketio.NewTestSocket(server1)
+		defer remote.Close()
+		So(remote.Join("room"), ShouldBeNil)
+
+		r.drop(true)
+		So(<-logger.errors, ShouldStartWith, "socketio: redis: receive, reconnecting: ")
+		So(<-logger.errors, ShouldEqual, "socketio: redis: reconnect: connection refused")
+		r.setDown(false)
+		waitFor(func() bool { return r.subscribers("socket.io#:room") == 1 })
+
+		// the failed publish connection is redialed by the next publish.
+		So(server2.BroadcastToNamespace("", "room", "lost"), ShouldEqual, errClosedConn)
+		So(server2.BroadcastToNamespace("", "room", "ev"), ShouldBeNil)
+		So(wait(remote, 1)[0].Name, ShouldEqual, "ev")
+	})
+
+	Convey("Attachments are rejected", t, func() {
+		r := &fakeRedis{}
+		_, a := node(r, nil)
+		defer a.Close()
+		So(a.Send(nil, ":room", "ev", &socketio.Attachment{}), ShouldEqual, ErrAttachment)
+		So(a.Send(nil, ":room", "ev", "text", []byte{1}), ShouldEqual, ErrAttachment)
+		So(a.Send(nil, ":room", "ev", struct{ Data []byte }{[]byte{1}}), ShouldEqual, ErrAttachment)
+	})
+
+	Convey("Binary broadcasts fail rather than reaching the local members only", t, func() {
+		r := &fakeRedis{}
+		server, a := node(r, nil)
+		defer a.Close()
+		ts := socketio.NewTestSocket(server)
+		defer ts.Close()
+		So(ts.Join("room"), ShouldBeNil)
+		So(server.BroadcastToNamespace("", "room", "ev", []byte{1}), ShouldEqual, ErrAttachment)
+		time.Sleep(10 * time.Millisecond)
+		So(ts.Events(), ShouldBeEmpty)
+	})
+}
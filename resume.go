@@ -0,0 +1,107 @@
+package socketio
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// SessionInfo is the state of a socket carried by a resume token.
+type SessionInfo struct {
+	// Id is the id of the socket the token was issued to.
+	Id string `json:"id"`
+	// Rooms are the rooms of the socket by namespace, "" for the default
+	// one.
+	Rooms map[string][]string `json:"rooms"`
+	// Issued is when the token was issued.
+	Issued time.Time `json:"issued"`
+}
+
+// DefaultResumeMaxAge is the max age of the resume tokens when
+// SetResumeSecret is given none.
+const DefaultResumeMaxAge = 2 * time.Minute
+
+// SetResumeSecret sets the secret signing the resume tokens, and their max
+// age, DefaultResumeMaxAge if <= 0. The servers sharing the secret validate
+// the tokens of each other. Without secret, no token is issued nor valid.
+//
+// Tokens are bearer credentials: anyone holding a token can resume its
+// session, as many times as they want until it expires, so the max age
+// should be as short as the reconnections allow.
+func (s *Server) SetResumeSecret(secret []byte, maxAge time.Duration) {
+	if maxAge <= 0 {
+		maxAge = DefaultResumeMaxAge
+	}
+	s.resumeSecret = append([]byte(nil), secret...)
+	s.resumeMaxAge = maxAge
+}
+
+// IssueResumeToken returns a token carrying the id of the socket and the rooms
+// of its connected namespaces, signed by the resume secret of the server, so a
+// client can resume its session on the next handshake without the server
+// storing it, like in OnReconnect with the SessionQueryKey parameter. It
+// returns "" if the server has no secret.
+func (s *Server) IssueResumeToken(so Socket) string {
+	if len(s.resumeSecret) == 0 {
+		return ""
+	}
+	info := SessionInfo{
+		Id:     so.Id(),
+		Rooms:  make(map[string][]string),
+		Issued: time.Now().UTC(),
+	}
+	if ns, ok := so.(*nspSocket); ok {
+		for name, n := range ns.nsps {
+			if name == "" || n.isConnected() {
+				info.Rooms[name] = n.Rooms()
+			}
+		}
+	} else {
+		info.Rooms[so.Namespace()] = so.Rooms()
+	}
+	payload, err := json.Marshal(info)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(s.signResume(payload))
+}
+
+// ValidateResumeToken returns the session carried by a token issued by
+// IssueResumeToken, and whether it's valid: signed by the resume secret of the
+// server, and not older than the max age. A valid token is valid again until
+// it expires, so it can be replayed meanwhile.
+func (s *Server) ValidateResumeToken(token string) (SessionInfo, bool) {
+	var info SessionInfo
+	if len(s.resumeSecret) == 0 {
+		return info, false
+	}
+	dot := strings.LastIndexByte(token, '.')
+	if dot < 0 {
+		return info, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token[:dot])
+	if err != nil {
+		return info, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil || !hmac.Equal(sig, s.signResume(payload)) {
+		return info, false
+	}
+	if err := json.Unmarshal(payload, &info); err != nil {
+		return SessionInfo{}, false
+	}
+	if time.Since(info.Issued) > s.resumeMaxAge {
+		return SessionInfo{}, false
+	}
+	return info, true
+}
+
+func (s *Server) signResume(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.resumeSecret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
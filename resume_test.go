@@ -0,0 +1,100 @@
+package socketio
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResumeToken(t *testing.T) {
+
+	Convey("Resume tokens carry the id and rooms of the socket", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		So(server.IssueResumeToken(nil), ShouldEqual, "")
+		server.SetResumeSecret([]byte("secret"), 0)
+		ts := NewTestSocket(server)
+		defer ts.Close()
+		So(ts.JoinAll("b", "a"), ShouldBeNil)
+
+		token := server.IssueResumeToken(ts.Socket)
+		So(token, ShouldNotBeEmpty)
+		info, ok := server.ValidateResumeToken(token)
+		So(ok, ShouldBeTrue)
+		So(info.Id, ShouldEqual, ts.Id())
+		So(info.Rooms, ShouldResemble, map[string][]string{"": {"a", "b"}})
+		So(time.Since(info.Issued), ShouldBeLessThan, time.Minute)
+
+		other, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		other.SetResumeSecret([]byte("secret"), 0)
+		_, ok = other.ValidateResumeToken(token)
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("Tampered tokens are rejected", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetResumeSecret([]byte("secret"), 0)
+		ts := NewTestSocket(server)
+		defer ts.Close()
+		token := server.IssueResumeToken(ts.Socket)
+		dot := strings.LastIndexByte(token, '.')
+
+		forged := base64.RawURLEncoding.EncodeToString([]byte(`{"id":"other","rooms":{"":["admin"]}}`))
+		for _, bad := range []string{
+			"",
+			"nodot",
+			forged + token[dot:],
+			token[:dot] + ".AAAA",
+			token[:dot] + ".!!",
+			"!!" + token[dot:],
+		} {
+			_, ok := server.ValidateResumeToken(bad)
+			So(ok, ShouldBeFalse)
+		}
+
+		other, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		_, ok := other.ValidateResumeToken(token)
+		So(ok, ShouldBeFalse)
+		other.SetResumeSecret([]byte("other secret"), 0)
+		_, ok = other.ValidateResumeToken(token)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Tokens older than the max age are rejected", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetResumeSecret([]byte("secret"), 10*time.Millisecond)
+		ts := NewTestSocket(server)
+		defer ts.Close()
+		token := server.IssueResumeToken(ts.Socket)
+		_, ok := server.ValidateResumeToken(token)
+		So(ok, ShouldBeTrue)
+		time.Sleep(20 * time.Millisecond)
+		_, ok = server.ValidateResumeToken(token)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Tokens expire after the default max age without one", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetResumeSecret([]byte("secret"), 0)
+		So(server.resumeMaxAge, ShouldEqual, DefaultResumeMaxAge)
+		sign := func(issued time.Time) string {
+			payload, err := json.Marshal(SessionInfo{Id: "a", Issued: issued})
+			So(err, ShouldBeNil)
+			return base64.RawURLEncoding.EncodeToString(payload) + "." +
+				base64.RawURLEncoding.EncodeToString(server.signResume(payload))
+		}
+		_, ok := server.ValidateResumeToken(sign(time.Now().Add(-DefaultResumeMaxAge / 2)))
+		So(ok, ShouldBeTrue)
+		_, ok = server.ValidateResumeToken(sign(time.Now().Add(-DefaultResumeMaxAge - time.Second)))
+		So(ok, ShouldBeFalse)
+	})
+}
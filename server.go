@@ -1,7 +1,14 @@
 package socketio
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/googollee/go-engine.io"
@@ -10,8 +17,41 @@ import (
 // Server is the server of socket.io.
 type Server struct {
 	*namespace
-	broadcast BroadcastAdaptor
-	eio       *engineio.Server
+	broadcast     BroadcastAdaptor
+	eio           *engineio.Server
+	sockets       map[string]*socket
+	socketsMu     sync.RWMutex
+	closing       bool
+	wg            sync.WaitGroup
+	maxPayload    int64
+	rawIn         func(id string, data []byte)
+	rawOut        func(id string, data []byte)
+	logger        Logger
+	strict        bool
+	recoverPanics bool
+	reconnect     func(so Socket, token string) error
+	writeTimeout  time.Duration
+	workers       int
+	maxAcks       int
+	outgoing      func(nsp, event string, args []interface{}) ([]interface{}, error)
+	joinRoom      func(so Socket, room string)
+	leaveRoom     func(so Socket, room string)
+	dispatched    func(nsp, event string, dur time.Duration, err error)
+	rate          float64
+	burst         int
+	ratePolicy    RateLimitPolicy
+	// maintenance is 1 in maintenance mode, shared with the sockets.
+	maintenance int32
+	// codecs are the codecs clients may select, by name.
+	codecs            map[string]Codec
+	emitBeforeConnect EmitBeforeConnectPolicy
+	trustedProxies    []*net.IPNet
+	queueSize         int
+	queuePolicy       QueueFullPolicy
+	resumeSecret      []byte
+	resumeMaxAge      time.Duration
+	idleTimeout       time.Duration
+	notConnected      NotConnectedEventPolicy
 }
 
 // NewServer returns the server supported given transports. If transports is nil, the server will use ["polling", "websocket"] as default.
@@ -23,6 +63,7 @@ func NewServer(transportNames []string) (*Server, error) {
 	ret := &Server{
 		namespace: newNamespace(newBroadcastDefault()),
 		eio:       eio,
+		sockets:   make(map[string]*socket),
 	}
 	go ret.loop()
 	return ret, nil
@@ -39,18 +80,273 @@ func (s *Server) SetPingInterval(t time.Duration) {
 }
 
 // SetMaxConnection sets the maximum number of connections with clients. Default is 1000.
+// Handshakes over the limit are rejected with an HTTP 503 before the socket
+// of the connection is created. Connections getting past the handshake while
+// the server has the max number of sockets are sent a connect error and
+// closed.
 func (s *Server) SetMaxConnection(n int) {
 	s.eio.SetMaxConnection(n)
 }
 
+// SetMaxPayloadBytes sets the max bytes of a packet received from clients,
+// including its binary attachments. A client sending a larger packet is
+// disconnected with ErrPayloadTooLarge. Default is 0, no limit.
+func (s *Server) SetMaxPayloadBytes(n int64) {
+	s.maxPayload = n
+}
+
+// SetStrictNamespaces sets whether a client sending a packet of an unknown
+// namespace is disconnected, after an error packet. Otherwise, by default,
+// such packets are dropped and connecting the namespace gets an error.
+func (s *Server) SetStrictNamespaces(strict bool) {
+	s.strict = strict
+}
+
+// SetRecoverPanics sets whether a panic of a handler is recovered. If so, the
+// panic is logged and passed as an error to the error handlers of the socket,
+// whose connection is closed, without affecting the other sockets. Default
+// is false, the panic isn't recovered.
+func (s *Server) SetRecoverPanics(recoverPanics bool) {
+	s.recoverPanics = recoverPanics
+}
+
+// SetDispatchWorkers sets the number of goroutines of each socket handling its
+// events, so a slow handler doesn't hold back the events of other names. The
+// events of a name are handled one at a time in the order they're received,
+// while events of different names may be handled, and acked, in any order.
+// Acks and connection packets are still handled as they're read. Default is
+// 0, handling the events one at a time as they're read.
+func (s *Server) SetDispatchWorkers(n int) {
+	s.workers = n
+}
+
+// OnDispatch sets the hook called after the handler of every incoming event,
+// with the namespace, the event, the duration of the handler and its error if
+// any, like the error returned by the handler, its panic, or the error of a
+// middleware. Events aborted by a middleware before the handler, or without
+// handler, aren't reported. It's called by the goroutine which handled the
+// event, so it must be safe for concurrent use with dispatch workers.
+func (s *Server) OnDispatch(f func(nsp, event string, dur time.Duration, err error)) {
+	s.dispatched = f
+}
+
+// SetEmitBeforeConnect sets what happens to the events emitted by Emit or
+// EmitTimeout to a named namespace the client isn't connected to, like pushes
+// from outside of the handlers before the client connects it: they fail with
+// ErrNamespaceNotConnected, or they're buffered and sent once the namespace is
+// connected, right after its connect ack. EmitWithAck always fails. Default is
+// EmitBeforeConnectFail.
+func (s *Server) SetEmitBeforeConnect(policy EmitBeforeConnectPolicy) {
+	s.emitBeforeConnect = policy
+}
+
+// SetNotConnectedEvents sets what happens to the events a client sends to a
+// named namespace it isn't connected to, like after it or the server
+// disconnected the namespace: they're dropped, answered by an error packet, or
+// dispatched to the handlers of the namespace anyway. Default is
+// NotConnectedEventDrop.
+func (s *Server) SetNotConnectedEvents(policy NotConnectedEventPolicy) {
+	s.notConnected = policy
+}
+
+// SetTrustedProxies sets the IPs or CIDRs of the proxies in front of the
+// server, like "10.0.0.0/8", whose X-Forwarded-For header gives the address
+// of the client to Socket.RemoteAddr. Default is none, RemoteAddr returns the
+// remote address of the request.
+func (s *Server) SetTrustedProxies(proxies ...string) error {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return fmt.Errorf("socketio: invalid proxy %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("socketio: invalid proxy %q: %s", p, err)
+		}
+		nets = append(nets, n)
+	}
+	s.trustedProxies = nets
+	return nil
+}
+
+// SetWriteQueue makes each socket queue up to size packets for a goroutine
+// writing them to the connection, so emits don't wait for slow clients. When
+// the queue of a socket is full, the emits wait, fail with ErrQueueFull or
+// drop their packet according to policy, and volatile emits drop it. Priority
+// emits have their own queue of size packets, written before the packets of
+// the other emits waiting. A failed write closes the connection, and the emits
+// return nil once their packet is queued. Default is 0, emits write to the
+// connection themselves.
+func (s *Server) SetWriteQueue(size int, policy QueueFullPolicy) {
+	s.queueSize = size
+	s.queuePolicy = policy
+}
+
+// SetCodecs sets the codecs clients may select by the CodecQueryKey parameter
+// of the handshake, like MessagePack, so both sides agree on the encoding of
+// the packets. Connections selecting another codec are rejected, and those
+// selecting none use the text encoding with json data. Default is none.
+func (s *Server) SetCodecs(codecs ...Codec) {
+	s.codecs = make(map[string]Codec, len(codecs))
+	for _, c := range codecs {
+		s.codecs[c.Name()] = c
+	}
+}
+
+// SetMaxPendingAcks sets the max number of acks a socket waits for, so
+// clients which never ack don't grow its memory. Emitting an event with an ack
+// callback over the limit returns ErrTooManyAcks. Default is 0, no limit.
+func (s *Server) SetMaxPendingAcks(n int) {
+	s.maxAcks = n
+}
+
+// SetWriteTimeout sets the max duration of a write to a client. A client
+// whose write takes longer, like a stalled client, is disconnected with the
+// reason ReasonSlowClient, and the emit returns ErrWriteTimeout. Default is 0,
+// no limit.
+func (s *Server) SetWriteTimeout(d time.Duration) {
+	s.writeTimeout = d
+}
+
+// SetIdleTimeout sets the max duration without packets from a client, like
+// events, acks and namespace connections, before it's disconnected with the
+// reason ReasonIdleTimeout. The engine.io pings don't count, so it catches
+// the clients which keep their transport alive but are no longer used.
+// Default is 0, no limit.
+func (s *Server) SetIdleTimeout(d time.Duration) {
+	s.idleTimeout = d
+}
+
+// SetLogger sets the logger of the sockets. Default logs nothing.
+func (s *Server) SetLogger(l Logger) {
+	s.logger = l
+}
+
+// SetRateLimit limits the events received from each socket to rate per
+// second, with bursts of burst events. The events over the limit are dropped
+// or close the connection according to policy. Default is 0, no limit.
+func (s *Server) SetRateLimit(rate float64, burst int, policy RateLimitPolicy) {
+	s.rate = rate
+	s.burst = burst
+	s.ratePolicy = policy
+}
+
+// OnRawIn registers f to inspect the frames received from clients before
+// decoding. f gets the id of the socket and the frame, which it mustn't
+// modify.
+func (s *Server) OnRawIn(f func(id string, data []byte)) {
+	s.rawIn = f
+}
+
+// OnRawOut registers f to inspect the frames sent to clients after encoding.
+// f gets the id of the socket and the frame, which it mustn't modify.
+func (s *Server) OnRawOut(f func(id string, data []byte)) {
+	s.rawOut = f
+}
+
+// OnAnyOutgoing registers f to intercept the events emitted to clients before
+// they're encoded, like to add tracing ids. f gets the namespace, "" for the
+// default one, the event and its args, without the ack callback. The args it
+// returns replace them, and an error it returns aborts the emit. Events of
+// broadcasts are intercepted once for all the sockets of the room, and an
+// error aborts the broadcast, which returns it.
+func (s *Server) OnAnyOutgoing(f func(nsp, event string, args []interface{}) ([]interface{}, error)) {
+	s.outgoing = f
+}
+
+// OnJoinRoom registers f to be called when a socket joins a room it wasn't in,
+// after the broadcast adaptor joined it. f gets the room as given to Join.
+func (s *Server) OnJoinRoom(f func(so Socket, room string)) {
+	s.joinRoom = f
+}
+
+// OnLeaveRoom registers f to be called when a socket leaves a room it was in,
+// after the broadcast adaptor left it, including the rooms left on
+// disconnection. f gets the room as given to Join.
+func (s *Server) OnLeaveRoom(f func(so Socket, room string)) {
+	s.leaveRoom = f
+}
+
 // GetMaxConnection returns the current max connection
 func (s *Server) GetMaxConnection() int {
 	return s.eio.GetMaxConnection()
 }
 
-// Count returns the current number of connected clients in session
+// Count returns the number of sockets connected to the server, the same
+// registry NamespaceCount and Sockets read.
 func (s *Server) Count() int {
-	return s.eio.Count()
+	s.socketsMu.RLock()
+	defer s.socketsMu.RUnlock()
+	return len(s.sockets)
+}
+
+// Of returns the namespace with given name, creating it if needed. Handlers
+// and middlewares registered on it apply to the sockets connecting after the
+// registration, while connected sockets keep the handlers they started with.
+// Sockets only know the namespaces existing when they connect.
+func (s *Server) Of(name string) Namespace {
+	return s.namespace.Of(name)
+}
+
+// HasNamespace returns whether the namespace nsp is registered, "" or "/" for
+// the default one, which always is.
+func (s *Server) HasNamespace(nsp string) bool {
+	if nsp == "/" {
+		nsp = ""
+	}
+	_, ok := s.namespaces()[nsp]
+	return ok
+}
+
+// NamespaceCount returns the number of sockets connected to the namespace nsp.
+func (s *Server) NamespaceCount(nsp string) int {
+	return len(s.nspSockets(nsp))
+}
+
+// Sockets returns the sockets of the live connections, in their default
+// namespace. It's a snapshot, not updated as clients connect and disconnect.
+func (s *Server) Sockets() []Socket {
+	sockets := s.nspSockets("")
+	ret := make([]Socket, len(sockets))
+	for i, so := range sockets {
+		ret[i] = so
+	}
+	return ret
+}
+
+// ForEachSocket calls f with the socket of each live connection like Sockets,
+// until f returns false. f may disconnect the sockets.
+func (s *Server) ForEachSocket(f func(so Socket) bool) {
+	for _, so := range s.nspSockets("") {
+		if !f(so) {
+			return
+		}
+	}
+}
+
+// nspSockets returns the sockets connected to the namespace nsp.
+func (s *Server) nspSockets(nsp string) []*nspSocket {
+	if nsp == "/" {
+		nsp = ""
+	}
+	s.socketsMu.RLock()
+	defer s.socketsMu.RUnlock()
+	var ret []*nspSocket
+	for _, so := range s.sockets {
+		if ns, ok := so.nsps[nsp]; ok && (nsp == "" || ns.isConnected()) {
+			ret = append(ret, ns)
+		}
+	}
+	return ret
 }
 
 // SetAllowRequest sets the middleware function when a connection is established. If a non-nil value is returned, the connection won't be established. Default will allow all connections.
@@ -83,25 +379,287 @@ func (s *Server) SetAdaptor(adaptor BroadcastAdaptor) {
 	s.namespace = newNamespace(adaptor)
 }
 
+// OnConnection registers f to handle the new sockets, once each after the
+// connection is accepted. It's the handler of the "connection" event of the
+// default namespace.
+func (s *Server) OnConnection(f func(so Socket)) error {
+	return s.OnNamespaceConnection("", f)
+}
+
+// OnNamespaceConnection registers f to handle the sockets connecting to the
+// namespace nsp like OnConnection.
+func (s *Server) OnNamespaceConnection(nsp string, f func(so Socket)) error {
+	return s.Of(nsp).On("connection", f)
+}
+
+// SessionQueryKey is the query parameter of the handshake carrying the
+// session token of a reconnecting client, given to the OnReconnect handler.
+const SessionQueryKey = "session"
+
+// OnReconnect registers f to restore the state of reconnecting clients, like
+// the rooms of their previous socket. It's called with the session token of
+// the handshake query, if any, before the connection handler of the default
+// namespace, so the rooms f joins are those of the default namespace. An error
+// returned by f closes the connection.
+func (s *Server) OnReconnect(f func(so Socket, token string) error) {
+	s.reconnect = f
+}
+
+// OnDisconnect registers f to handle the disconnection of sockets from the
+// namespace nsp. f receives the reason of the disconnection, one of
+// ReasonTransportError, ReasonClientDisconnect, ReasonServerDisconnect,
+// ReasonSlowClient, ReasonServerNamespaceDisconnect, ReasonIdleTimeout or
+// ReasonServerError.
+func (s *Server) OnDisconnect(nsp string, f func(so Socket, reason string)) error {
+	return s.Of(nsp).On("disconnection", f)
+}
+
+// OnConnect registers f to authenticate the sockets connecting to the
+// namespace nsp. f runs before the connection of the namespace is accepted.
+// If f returns an error, the client gets it as a connect_error, the namespace
+// isn't connected and the connection handler isn't called. The default
+// namespace is connected along with the connection, so it's authenticated by
+// SetAllowRequest instead.
+func (s *Server) OnConnect(nsp string, f func(so Socket) error) error {
+	if nsp == "" || nsp == "/" {
+		return errors.New("socketio: use SetAllowRequest to authenticate the default namespace")
+	}
+	ns := s.namespace.Of(nsp).(*namespace)
+	ns.evMu.Lock()
+	ns.auth = f
+	ns.evMu.Unlock()
+	return nil
+}
+
+// OnConnectPayload registers f to return the data of the connect ack of the
+// namespace nsp, "" or "/" for the default one, like the session info of the
+// client, which gets it along with the connection. f runs once the connection
+// is accepted, after the authenticator of OnConnect, and returns nil to send
+// no data.
+func (s *Server) OnConnectPayload(nsp string, f func(so Socket) interface{}) error {
+	ns := s.namespace.Of(nsp).(*namespace)
+	ns.evMu.Lock()
+	ns.connectData = f
+	ns.evMu.Unlock()
+	return nil
+}
+
+// OnError registers f to handle the errors closing the connections of sockets
+// in the namespace nsp.
+func (s *Server) OnError(nsp string, f func(so Socket, err error)) error {
+	return s.Of(nsp).On("error", f)
+}
+
 // ServeHTTP handles http requests.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("sid") == "" && s.isClosing() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Query().Get("sid") == "" && s.isMaintenance() {
+		http.Error(w, errMaintenance.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	s.eio.ServeHTTP(w, r)
 }
 
+// Shutdown stops accepting new connections, disconnects all sockets and waits
+// until their connections are closed or ctx is done, returning ctx.Err() in
+// the latter case. The disconnection handlers are called with
+// ReasonServerDisconnect. The handshakes coming after are answered with an
+// HTTP 503, and the connections engine.io accepted meanwhile are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.socketsMu.Lock()
+	s.closing = true
+	sockets := make([]*socket, 0, len(s.sockets))
+	for _, so := range s.sockets {
+		sockets = append(sockets, so)
+	}
+	s.socketsMu.Unlock()
+
+	for _, so := range sockets {
+		so.close("")
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetMaintenance puts the server in maintenance mode, or out of it. In
+// maintenance, handshakes are rejected with an HTTP 503, and the events of the
+// connected clients are dropped, each answered by an error packet like
+// EmitError. The server can still emit and broadcast to them, like to tell
+// users about the maintenance.
+func (s *Server) SetMaintenance(maintenance bool) {
+	var v int32
+	if maintenance {
+		v = 1
+	}
+	atomic.StoreInt32(&s.maintenance, v)
+}
+
+func (s *Server) isMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+func (s *Server) isClosing() bool {
+	s.socketsMu.RLock()
+	defer s.socketsMu.RUnlock()
+	return s.closing
+}
+
 // BroadcastTo is a server level broadcast function.
 func (s *Server) BroadcastTo(room, message string, args ...interface{}) {
 	s.namespace.BroadcastTo(room, message, args...)
 }
 
+// ErrNamespaceNotFound is returned by BroadcastToNamespace when the namespace
+// isn't registered.
+var ErrNamespaceNotFound = errors.New("socketio: namespace not found")
+
+// BroadcastToNamespace broadcasts an event with given args to the room of the
+// namespace nsp, "" or "/" for the default one, like BroadcastTo of the
+// namespace. It's for pushes from outside of the handlers, like from a
+// message queue consumer.
+func (s *Server) BroadcastToNamespace(nsp, room, event string, args ...interface{}) error {
+	if nsp == "/" {
+		nsp = ""
+	}
+	ns, ok := s.namespaces()[nsp]
+	if !ok {
+		return ErrNamespaceNotFound
+	}
+	return ns.BroadcastTo(room, event, args...)
+}
+
+// Broadcast emits an event to all sockets connected to the namespace nsp.
+func (s *Server) Broadcast(nsp, event string, args ...interface{}) {
+	for _, so := range s.nspSockets(nsp) {
+		so.Emit(event, args...)
+	}
+}
+
+// ErrSocketNotFound is returned by EmitTo when no socket has the id.
+var ErrSocketNotFound = errors.New("socketio: socket not found")
+
+// EmitTo emits an event with given args to the default namespace of the
+// socket with the id.
+func (s *Server) EmitTo(id, event string, args ...interface{}) error {
+	s.socketsMu.RLock()
+	so, ok := s.sockets[id]
+	s.socketsMu.RUnlock()
+	if !ok {
+		return ErrSocketNotFound
+	}
+	return so.namespace("").Emit(event, args...)
+}
+
 func (s *Server) loop() {
 	for {
 		conn, err := s.eio.Accept()
 		if err != nil {
 			return
 		}
-		s := newSocket(conn, s.namespace)
-		go func(s *socket) {
-			s.loop()
-		}(s)
+		if s.isClosing() {
+			// the handshake raced Shutdown.
+			conn.Close()
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn runs the socket of conn until the connection is closed.
+func (s *Server) serveConn(conn engineio.Conn) {
+	s.serveSocket(s.newSocket(conn))
+}
+
+// newSocket returns the socket of the connection with the options of the
+// server.
+func (s *Server) newSocket(conn engineio.Conn) *socket {
+	if s.rawIn != nil || s.rawOut != nil {
+		conn = &rawConn{
+			Conn:  conn,
+			in:    s.rawIn,
+			out:   s.rawOut,
+			limit: s.maxPayload,
+		}
+	}
+	so := newSocket(conn, s.namespace)
+	so.maxPayload = s.maxPayload
+	so.strict = s.strict
+	so.recoverPanics = s.recoverPanics
+	so.reconnect = s.reconnect
+	so.writeTimeout = s.writeTimeout
+	so.idleTimeout = s.idleTimeout
+	so.workers = s.workers
+	so.maxAcks = s.maxAcks
+	so.maintenance = &s.maintenance
+	so.outgoing = s.outgoing
+	so.joinRoom = s.joinRoom
+	so.leaveRoom = s.leaveRoom
+	so.dispatched = s.dispatched
+	so.emitBeforeConnect = s.emitBeforeConnect
+	so.notConnectedEvents = s.notConnected
+	so.trustedProxies = s.trustedProxies
+	if s.logger != nil {
+		so.logger = s.logger
+	}
+	if name := so.Query().Get(CodecQueryKey); name != "" {
+		so.encoder.codec = s.codecs[name]
+	}
+	if s.queueSize > 0 {
+		so.startWriter(s.queueSize, s.queuePolicy)
+	}
+	if s.rate > 0 {
+		so.limiter = newRateLimiter(s.rate, s.burst, s.ratePolicy)
+	}
+	return so
+}
+
+// errTooManyConnections rejects the connections over the max of the server.
+var errTooManyConnections = errors.New("too many connections")
+
+// serveSocket runs the loop of the socket until it's closed.
+func (s *Server) serveSocket(so *socket) {
+	s.socketsMu.Lock()
+	if s.closing {
+		s.socketsMu.Unlock()
+		so.Disconnect()
+		return
+	}
+	reject := errTooManyConnections
+	if s.isMaintenance() {
+		reject = errMaintenance
+	} else if so.Query().Get(CodecQueryKey) != "" && so.encoder.codec == nil {
+		reject = errUnknownCodec
+	} else if len(s.sockets) < s.eio.GetMaxConnection() {
+		reject = nil
+	}
+	if reject != nil {
+		s.socketsMu.Unlock()
+		so.logger.Errorf("socketio: socket %s: rejected: %s", so.Id(), reject)
+		so.sendConnectError("", reject)
+		so.flush()
+		so.Disconnect()
+		return
 	}
+	s.sockets[so.Id()] = so
+	s.wg.Add(1)
+	s.socketsMu.Unlock()
+	defer func() {
+		s.socketsMu.Lock()
+		delete(s.sockets, so.Id())
+		s.socketsMu.Unlock()
+		s.wg.Done()
+	}()
+	so.loop()
 }
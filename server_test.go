@@ -0,0 +1,1206 @@
+package socketio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServerOnDisconnect(t *testing.T) {
+	reasonOf := func(setup func(server *Server), disconnect func(conn *PipeConn, so *socket)) (string, error) {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		if setup != nil {
+			setup(server)
+		}
+		reasons := make(chan string, 1)
+		errs := make(chan error, 1)
+		So(server.OnDisconnect("", func(so Socket, reason string) {
+			reasons <- reason
+		}), ShouldBeNil)
+		So(server.OnError("", func(so Socket, err error) {
+			errs <- err
+		}), ShouldBeNil)
+
+		conn := NewPipeConn("test1")
+		so := server.newSocket(conn)
+		done := make(chan struct{})
+		go func() {
+			so.loop()
+			close(done)
+		}()
+		conn.WaitFrames(1)
+		disconnect(conn, so)
+		<-done
+		select {
+		case err = <-errs:
+		default:
+		}
+		return <-reasons, err
+	}
+
+	Convey("Client disconnect", t, func() {
+		reason, err := reasonOf(nil, func(conn *PipeConn, so *socket) {
+			conn.Send("1")
+		})
+		So(reason, ShouldEqual, ReasonClientDisconnect)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Server disconnect", t, func() {
+		reason, err := reasonOf(nil, func(conn *PipeConn, so *socket) {
+			so.namespace("").Disconnect()
+		})
+		So(reason, ShouldEqual, ReasonServerDisconnect)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Transport closed", t, func() {
+		reason, err := reasonOf(nil, func(conn *PipeConn, so *socket) {
+			conn.Close()
+		})
+		So(reason, ShouldEqual, ReasonTransportError)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Read error", t, func() {
+		reason, err := reasonOf(nil, func(conn *PipeConn, so *socket) {
+			conn.SendBinary([]byte("bad"))
+		})
+		So(reason, ShouldEqual, ReasonTransportError)
+		So(err, ShouldResemble, errors.New("need text package"))
+	})
+
+	Convey("Handler error", t, func() {
+		reason, err := reasonOf(func(server *Server) {
+			server.On("fail", func() error {
+				return errors.New("failed")
+			})
+		}, func(conn *PipeConn, so *socket) {
+			conn.Send(`2["fail"]`)
+		})
+		So(reason, ShouldEqual, ReasonServerError)
+		So(err, ShouldResemble, errors.New("failed"))
+	})
+
+	Convey("Payload too large", t, func() {
+		reason, err := reasonOf(func(server *Server) {
+			server.SetMaxPayloadBytes(8)
+		}, func(conn *PipeConn, so *socket) {
+			conn.Send(`2["too large"]`)
+		})
+		So(reason, ShouldEqual, ReasonServerError)
+		So(err, ShouldEqual, ErrPayloadTooLarge)
+	})
+
+	Convey("Invalid namespace", t, func() {
+		reason, err := reasonOf(func(server *Server) {
+			server.SetStrictNamespaces(true)
+		}, func(conn *PipeConn, so *socket) {
+			conn.Send(`2/typo,["ev"]`)
+		})
+		So(reason, ShouldEqual, ReasonServerError)
+		So(err, ShouldEqual, errInvalidNamespace)
+	})
+
+	Convey("Rate limited", t, func() {
+		reason, err := reasonOf(func(server *Server) {
+			server.SetRateLimit(1, 1, RateLimitDisconnect)
+		}, func(conn *PipeConn, so *socket) {
+			conn.Send(`2["a"]`)
+			conn.Send(`2["b"]`)
+		})
+		So(reason, ShouldEqual, ReasonServerError)
+		So(err, ShouldEqual, ErrRateLimited)
+	})
+}
+
+func TestNamespaceDisconnectReason(t *testing.T) {
+
+	Convey("Client disconnecting a namespace keeps the connection", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		reasons := make(chan string, 2)
+		So(server.OnDisconnect("/chat", func(so Socket, reason string) {
+			reasons <- "/chat " + reason
+		}), ShouldBeNil)
+		So(server.OnDisconnect("", func(so Socket, reason string) {
+			reasons <- reason
+		}), ShouldBeNil)
+
+		conn := NewPipeConn("test1")
+		so := newSocket(conn, server.namespace)
+		done := make(chan struct{})
+		go func() {
+			so.loop()
+			close(done)
+		}()
+		conn.Send("0/chat")
+		conn.WaitFrames(2)
+		conn.Send("1/chat")
+		So(<-reasons, ShouldEqual, "/chat "+ReasonClientDisconnect)
+
+		conn.Close()
+		<-done
+		So(so.namespace("/chat").connected, ShouldBeFalse)
+		So(<-reasons, ShouldEqual, ReasonTransportError)
+		So(reasons, ShouldBeEmpty)
+	})
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func TestServerNamespaceCount(t *testing.T) {
+
+	Convey("Counts sockets per connected namespace", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.Of("/chat")
+		conn1, conn2 := NewPipeConn("a"), NewPipeConn("b")
+		go server.serveConn(conn1)
+		go server.serveConn(conn2)
+		conn2.WaitFrames(1)
+		conn2.Send("0/chat")
+		conn2.WaitFrames(2)
+
+		So(waitFor(func() bool { return server.NamespaceCount("") == 2 }), ShouldBeTrue)
+		So(server.Count(), ShouldEqual, 2)
+		So(server.NamespaceCount("/chat"), ShouldEqual, 1)
+		So(server.NamespaceCount("/"), ShouldEqual, 2)
+		So(server.NamespaceCount("/nope"), ShouldEqual, 0)
+
+		conn2.Close()
+		So(waitFor(func() bool { return server.NamespaceCount("") == 1 }), ShouldBeTrue)
+		So(server.NamespaceCount("/chat"), ShouldEqual, 0)
+		conn1.Close()
+		So(waitFor(func() bool { return server.Count() == 0 }), ShouldBeTrue)
+		So(server.NamespaceCount(""), ShouldEqual, 0)
+	})
+}
+
+func TestServerOf(t *testing.T) {
+
+	Convey("Handlers on a new namespace apply to later connections", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		got := make(chan string, 1)
+		chat := server.Of("/chat")
+		So(chat.Name(), ShouldEqual, "/chat")
+		So(server.Of("/chat"), ShouldEqual, chat)
+		So(chat.On("ev", func(so Socket, msg string) {
+			got <- so.Id() + ":" + msg
+		}), ShouldBeNil)
+
+		conn := NewPipeConn("a")
+		go server.serveConn(conn)
+		conn.Send("0/chat")
+		conn.Send(`2/chat,["ev","x"]`)
+		select {
+		case msg := <-got:
+			So(msg, ShouldEqual, "a:x")
+		case <-time.After(time.Second):
+			So("timeout", ShouldBeEmpty)
+		}
+		conn.Close()
+	})
+}
+
+func TestServerShutdown(t *testing.T) {
+
+	Convey("Shutdown disconnects all sockets and rejects new ones", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.Of("/chat")
+		reasons := make(chan string, 3)
+		So(server.OnDisconnect("", func(so Socket, reason string) {
+			reasons <- reason
+		}), ShouldBeNil)
+		So(server.OnDisconnect("/chat", func(so Socket, reason string) {
+			reasons <- reason
+		}), ShouldBeNil)
+		conn1, conn2 := NewPipeConn("a"), NewPipeConn("b")
+		go server.serveConn(conn1)
+		go server.serveConn(conn2)
+		conn2.WaitFrames(1)
+		conn2.Send("0/chat")
+		conn2.WaitFrames(2)
+		So(waitFor(func() bool { return server.NamespaceCount("") == 2 }), ShouldBeTrue)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		So(server.Shutdown(ctx), ShouldBeNil)
+		So(server.NamespaceCount(""), ShouldEqual, 0)
+		for i := 0; i < 3; i++ {
+			So(<-reasons, ShouldEqual, ReasonServerDisconnect)
+		}
+		So(conn1.Frames(), ShouldResemble, []string{"0", "1"})
+		So(conn2.Frames()[2:], ShouldContain, "1/chat")
+
+		conn3 := NewPipeConn("c")
+		server.serveConn(conn3)
+		So(conn3.Frames(), ShouldBeEmpty)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/socket.io/?EIO=3&transport=polling", nil))
+		So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+	})
+
+	Convey("Shutdown closes the engine.io connections and rejects new ones", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+		handshake := func() int {
+			resp, err := http.Get(ts.URL + "/socket.io/?EIO=3&transport=polling")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		So(handshake(), ShouldEqual, http.StatusOK)
+		So(waitFor(func() bool { return server.NamespaceCount("") == 1 }), ShouldBeTrue)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		So(server.Shutdown(ctx), ShouldBeNil)
+		So(waitFor(func() bool { return server.eio.Count() == 0 }), ShouldBeTrue)
+		So(handshake(), ShouldEqual, http.StatusServiceUnavailable)
+		So(server.eio.Count(), ShouldEqual, 0)
+		So(server.Count(), ShouldEqual, 0)
+		So(server.NamespaceCount(""), ShouldEqual, 0)
+	})
+
+	Convey("Shutdown returns the context error if sockets don't drain", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		release := make(chan struct{})
+		So(server.OnDisconnect("", func(so Socket, reason string) {
+			<-release
+		}), ShouldBeNil)
+		conn := NewPipeConn("a")
+		go server.serveConn(conn)
+		So(waitFor(func() bool { return server.NamespaceCount("") == 1 }), ShouldBeTrue)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		So(server.Shutdown(ctx) == context.DeadlineExceeded, ShouldBeTrue)
+		close(release)
+	})
+}
+
+func TestServerBroadcast(t *testing.T) {
+
+	Convey("Broadcast reaches every socket of the namespace", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.Of("/chat")
+		conns := []*PipeConn{NewPipeConn("a"), NewPipeConn("b"), NewPipeConn("c")}
+		for _, conn := range conns {
+			go server.serveConn(conn)
+			conn.WaitFrames(1)
+		}
+		conns[2].Send("0/chat")
+		conns[2].WaitFrames(2)
+		So(waitFor(func() bool { return server.NamespaceCount("") == 3 }), ShouldBeTrue)
+
+		server.Broadcast("", "news", "hi")
+		server.Broadcast("/chat", "news", "chat")
+		So(conns[0].Frames(), ShouldResemble, []string{"0", `2["news","hi"]`})
+		So(conns[1].Frames(), ShouldResemble, []string{"0", `2["news","hi"]`})
+		So(conns[2].Frames(), ShouldResemble, []string{"0", "0/chat", `2["news","hi"]`, `2/chat,["news","chat"]`})
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+}
+
+func TestServerOnConnect(t *testing.T) {
+
+	Convey("Authenticator accepts or rejects namespace connections", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		So(server.OnConnect("/", func(so Socket) error { return nil }), ShouldNotBeNil)
+		So(server.OnConnect("/admin", func(so Socket) error {
+			return errors.New("not authorized")
+		}), ShouldBeNil)
+		So(server.OnConnect("/chat", func(so Socket) error { return nil }), ShouldBeNil)
+		connected := make(chan string, 2)
+		for _, nsp := range []string{"/admin", "/chat"} {
+			nsp := nsp
+			So(server.Of(nsp).On("connection", func(so Socket) {
+				connected <- nsp
+			}), ShouldBeNil)
+		}
+
+		conn := NewPipeConn("test1")
+		so := newSocket(conn, server.namespace)
+		done := make(chan struct{})
+		go func() {
+			so.loop()
+			close(done)
+		}()
+		conn.Send("0/admin")
+		frames := conn.WaitFrames(2)
+		So(frames[1], ShouldEqual, `4/admin,{"message":"not authorized"}`)
+		So(so.namespace("/admin").isConnected(), ShouldBeFalse)
+
+		conn.Send("0/chat")
+		frames = conn.WaitFrames(3)
+		So(frames[2], ShouldEqual, "0/chat")
+		So(so.namespace("/chat").isConnected(), ShouldBeTrue)
+		So(<-connected, ShouldEqual, "/chat")
+
+		conn.Close()
+		<-done
+		So(connected, ShouldBeEmpty)
+	})
+}
+
+func TestServerMaxPayload(t *testing.T) {
+
+	Convey("Oversized packets close the connection", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetMaxPayloadBytes(64)
+		So(server.On("msg", func(msg string) {}), ShouldBeNil)
+		So(server.On("bin", func(b []byte) {}), ShouldBeNil)
+		errs := make(chan error, 1)
+		So(server.OnError("", func(so Socket, err error) {
+			errs <- err
+		}), ShouldBeNil)
+
+		Convey("Text event", func() {
+			conn := NewPipeConn("test1")
+			go server.serveConn(conn)
+			conn.WaitFrames(1)
+			conn.Send(`2["msg","` + strings.Repeat("x", 128) + `"]`)
+			So(<-errs, ShouldEqual, ErrPayloadTooLarge)
+			<-conn.closed
+		})
+
+		Convey("Binary attachment", func() {
+			conn := NewPipeConn("test2")
+			go server.serveConn(conn)
+			conn.WaitFrames(1)
+			conn.Send(`51-["bin",{"_placeholder":true,"num":0}]`)
+			conn.SendBinary(bytes.Repeat([]byte{1}, 128))
+			So(<-errs, ShouldEqual, ErrPayloadTooLarge)
+			<-conn.closed
+		})
+
+		Convey("Packets within the limit are handled", func() {
+			conn := NewPipeConn("test3")
+			go server.serveConn(conn)
+			conn.WaitFrames(1)
+			conn.Send(`2["msg","x"]`)
+			conn.Send(`51-["bin",{"_placeholder":true,"num":0}]`)
+			conn.SendBinary([]byte{1, 2})
+			conn.Send(`2["ack","x"]`)
+			conn.Close()
+			So(waitFor(func() bool { return server.NamespaceCount("") == 0 }), ShouldBeTrue)
+			So(errs, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestServerEmitTo(t *testing.T) {
+
+	Convey("Emits to a socket by id", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		ids := make(chan string, 1)
+		So(server.On("connection", func(so Socket) {
+			ids <- so.Id()
+		}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		id := <-ids
+		So(waitFor(func() bool { return server.NamespaceCount("") == 1 }), ShouldBeTrue)
+
+		So(server.EmitTo(id, "ev", "data"), ShouldBeNil)
+		So(conn.WaitFrames(2)[1], ShouldEqual, `2["ev","data"]`)
+		So(server.EmitTo("unknown", "ev"), ShouldEqual, ErrSocketNotFound)
+
+		conn.Close()
+		So(waitFor(func() bool { return server.NamespaceCount("") == 0 }), ShouldBeTrue)
+		So(server.EmitTo(id, "ev"), ShouldEqual, ErrSocketNotFound)
+	})
+}
+
+func TestServerOnConnection(t *testing.T) {
+
+	Convey("Connection handlers fire once per socket", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		connected := make(chan string, 4)
+		So(server.OnConnection(func(so Socket) {
+			connected <- so.Id()
+		}), ShouldBeNil)
+		So(server.OnNamespaceConnection("/chat", func(so Socket) {
+			connected <- "/chat " + so.Id()
+		}), ShouldBeNil)
+
+		conn1, conn2 := NewPipeConn("a"), NewPipeConn("b")
+		go server.serveConn(conn1)
+		So(<-connected, ShouldEqual, "a")
+		go server.serveConn(conn2)
+		So(<-connected, ShouldEqual, "b")
+		conn2.Send("0/chat")
+		conn2.Send("0/chat")
+		conn2.Send("0")
+		So(<-connected, ShouldEqual, "/chat b")
+		conn2.Send(`21["sync"]`)
+		conn2.WaitFrames(3)
+
+		conn1.Close()
+		conn2.Close()
+		So(waitFor(func() bool { return server.NamespaceCount("") == 0 }), ShouldBeTrue)
+		So(connected, ShouldBeEmpty)
+	})
+}
+
+func TestServerBroadcastToNamespace(t *testing.T) {
+
+	Convey("Broadcasts to a room of a namespace without a socket", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		joined := make(chan struct{}, 2)
+		So(server.Of("/chat").On("connection", func(so Socket) {
+			so.Join("room")
+			joined <- struct{}{}
+		}), ShouldBeNil)
+		conns := []*PipeConn{NewPipeConn("a"), NewPipeConn("b")}
+		for _, conn := range conns {
+			go server.serveConn(conn)
+			conn.WaitFrames(1)
+			conn.Send("0/chat")
+			<-joined
+		}
+
+		So(server.BroadcastToNamespace("/chat", "room", "ev", "data"), ShouldBeNil)
+		for _, conn := range conns {
+			So(conn.WaitFrames(3)[2], ShouldEqual, `2/chat,["ev","data"]`)
+		}
+		So(server.BroadcastToNamespace("/unknown", "room", "ev"), ShouldEqual, ErrNamespaceNotFound)
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+		So(waitFor(func() bool { return server.NamespaceCount("") == 0 }), ShouldBeTrue)
+	})
+
+	Convey("Handlers broadcast to a room of another namespace", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		joined := make(chan struct{}, 1)
+		So(server.Of("/chat").On("connection", func(so Socket) {
+			so.Join("room1")
+			joined <- struct{}{}
+		}), ShouldBeNil)
+		So(server.On("push", func(so Socket, msg string) error {
+			return so.BroadcastToNamespace("/chat", "room1", "ev", msg)
+		}), ShouldBeNil)
+
+		member := NewPipeConn("a")
+		go server.serveConn(member)
+		defer member.Close()
+		member.WaitFrames(1)
+		member.Send("0/chat")
+		<-joined
+		pusher := NewPipeConn("b")
+		go server.serveConn(pusher)
+		defer pusher.Close()
+		pusher.WaitFrames(1)
+
+		pusher.Send(`2["push","hi"]`)
+		So(member.WaitFrames(3)[2], ShouldEqual, `2/chat,["ev","hi"]`)
+		So(server.BroadcastToNamespace("/", "room1", "ev"), ShouldBeNil)
+		So(server.Of("").BroadcastToNamespace("/chat", "room1", "ev", "ns"), ShouldBeNil)
+		So(member.WaitFrames(4)[3], ShouldEqual, `2/chat,["ev","ns"]`)
+		So(pusher.Frames(), ShouldHaveLength, 1)
+	})
+}
+
+func TestServerOnReconnect(t *testing.T) {
+
+	Convey("Reconnecting clients get the rooms of their session back", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		sessions := map[string][]string{"abc": {"a", "b"}}
+		server.OnReconnect(func(so Socket, token string) error {
+			return so.JoinAll(sessions[token]...)
+		})
+		members := make(chan int, 1)
+		So(server.OnConnection(func(so Socket) {
+			m, _ := so.RoomMembers("b")
+			members <- len(m)
+		}), ShouldBeNil)
+
+		conn := NewPipeConn("test1")
+		conn.request = &http.Request{URL: &url.URL{RawQuery: SessionQueryKey + "=abc"}}
+		go server.serveConn(conn)
+		So(<-members, ShouldEqual, 1)
+		for _, room := range []string{"a", "b"} {
+			m, err := server.RoomMembers(room)
+			So(err, ShouldBeNil)
+			So(len(m), ShouldEqual, 1)
+		}
+
+		other := NewPipeConn("test2")
+		go server.serveConn(other)
+		So(<-members, ShouldEqual, 1)
+
+		conn.Close()
+		other.Close()
+		So(waitFor(func() bool { return server.NamespaceCount("") == 0 }), ShouldBeTrue)
+	})
+}
+
+func TestServerOnAnyOutgoing(t *testing.T) {
+
+	Convey("Outgoing events are rewritten or aborted by the hook", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		errDenied := errors.New("denied")
+		server.OnAnyOutgoing(func(nsp, event string, args []interface{}) ([]interface{}, error) {
+			if event == "secret" {
+				return nil, errDenied
+			}
+			return append(args, map[string]string{"trace": "t1", "nsp": nsp}), nil
+		})
+		emitted := make(chan []error, 1)
+		So(server.OnConnection(func(so Socket) {
+			so.Join("room")
+			emitted <- []error{
+				so.Emit("ev", "data"),
+				so.Emit("secret"),
+				server.BroadcastToNamespace("", "room", "news"),
+				server.BroadcastToNamespace("", "room", "secret"),
+			}
+		}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		So(<-emitted, ShouldResemble, []error{nil, errDenied, nil, errDenied})
+		So(conn.WaitFrames(3), ShouldResemble, []string{
+			"0",
+			`2["ev","data",{"nsp":"","trace":"t1"}]`,
+			`2["news",{"nsp":"","trace":"t1"}]`,
+		})
+		So(conn.Frames(), ShouldHaveLength, 3)
+		conn.Close()
+		So(waitFor(func() bool { return server.NamespaceCount("") == 0 }), ShouldBeTrue)
+	})
+}
+
+func TestServerRoomHooks(t *testing.T) {
+
+	Convey("Room hooks are called as sockets join and leave rooms", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		hooks := make(chan string, 10)
+		server.OnJoinRoom(func(so Socket, room string) {
+			hooks <- "join " + so.Id() + " " + room
+		})
+		server.OnLeaveRoom(func(so Socket, room string) {
+			hooks <- "leave " + so.Id() + " " + room
+		})
+		server.On("enter", func(so Socket) error {
+			if err := so.Join("a"); err != nil {
+				return err
+			}
+			if err := so.Join("a"); err != nil {
+				return err
+			}
+			if err := so.JoinAll("b", "c"); err != nil {
+				return err
+			}
+			if err := so.Leave("b"); err != nil {
+				return err
+			}
+			return so.Leave("none")
+		})
+		ts := NewTestSocket(server)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err = ts.SendWithAck(ctx, "enter")
+		So(err, ShouldBeNil)
+		id := ts.Id()
+		So(ts.Close(), ShouldBeNil)
+		close(hooks)
+		var got []string
+		for hook := range hooks {
+			got = append(got, hook)
+		}
+		So(got, ShouldResemble, []string{
+			"join " + id + " a",
+			"join " + id + " b",
+			"join " + id + " c",
+			"leave " + id + " b",
+			"leave " + id + " a",
+			"leave " + id + " c",
+		})
+	})
+
+	Convey("Room hooks aren't called when the adaptor fails", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.namespace = newNamespace(&failingJoinAdaptor{
+			BroadcastAdaptor: newBroadcastDefault(),
+			fail:             map[string]bool{":room": true},
+		})
+		called := false
+		server.OnJoinRoom(func(so Socket, room string) {
+			called = true
+		})
+		ts := NewTestSocket(server)
+		defer ts.Close()
+		So(ts.Join("room"), ShouldNotBeNil)
+		So(called, ShouldBeFalse)
+	})
+}
+
+func TestServerMaxConnection(t *testing.T) {
+
+	Convey("Handshakes over the max connections are rejected", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetMaxConnection(2)
+		codes := []int{}
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, httptest.NewRequest("GET", "/socket.io/?EIO=3&transport=polling", nil))
+			codes = append(codes, w.Code)
+		}
+		So(codes, ShouldResemble, []int{http.StatusOK, http.StatusOK, http.StatusServiceUnavailable})
+	})
+
+	Convey("Connections over the max sockets are closed with a connect error", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetMaxConnection(2)
+		for i := 0; i < 2; i++ {
+			defer NewTestSocket(server).Close()
+		}
+		So(waitFor(func() bool { return server.NamespaceCount("") == 2 }), ShouldBeTrue)
+		conn := NewPipeConn("c")
+		server.serveConn(conn)
+		So(conn.Frames(), ShouldResemble, []string{`4{"message":"too many connections"}`})
+		So(server.NamespaceCount(""), ShouldEqual, 2)
+	})
+}
+
+func TestServerSockets(t *testing.T) {
+
+	Convey("Sockets of the live connections are visited once", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		ids := map[string]bool{}
+		var sockets []*TestSocket
+		for i := 0; i < 3; i++ {
+			ts := NewTestSocket(server)
+			defer ts.Close()
+			sockets = append(sockets, ts)
+			ids[ts.Id()] = true
+		}
+		So(waitFor(func() bool { return len(server.Sockets()) == 3 }), ShouldBeTrue)
+
+		visited := map[string]int{}
+		server.ForEachSocket(func(so Socket) bool {
+			visited[so.Id()]++
+			return true
+		})
+		So(len(visited), ShouldEqual, 3)
+		for id, n := range visited {
+			So(ids[id], ShouldBeTrue)
+			So(n, ShouldEqual, 1)
+		}
+
+		n := 0
+		server.ForEachSocket(func(so Socket) bool {
+			n++
+			return false
+		})
+		So(n, ShouldEqual, 1)
+
+		So(sockets[0].Close(), ShouldBeNil)
+		for _, so := range server.Sockets() {
+			So(so.Id(), ShouldNotEqual, sockets[0].Id())
+		}
+	})
+}
+
+func TestServerHasNamespace(t *testing.T) {
+
+	Convey("Only registered namespaces exist", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		names := make(chan string, 2)
+		onConnection := func(so Socket) {
+			names <- so.Namespace()
+		}
+		So(server.OnConnection(onConnection), ShouldBeNil)
+		So(server.OnNamespaceConnection("/chat", onConnection), ShouldBeNil)
+		So(server.HasNamespace("/chat"), ShouldBeTrue)
+		So(server.HasNamespace("/nope"), ShouldBeFalse)
+		So(server.HasNamespace(""), ShouldBeTrue)
+		So(server.HasNamespace("/"), ShouldBeTrue)
+
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		defer conn.Close()
+		conn.Send("0/chat")
+		So(<-names, ShouldEqual, "")
+		So(<-names, ShouldEqual, "/chat")
+	})
+}
+
+func TestServerMaintenance(t *testing.T) {
+
+	Convey("Maintenance rejects new clients and events but not broadcasts", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		handled := make(chan string, 2)
+		server.On("ev", func(msg string) {
+			handled <- msg
+		})
+		server.OnConnection(func(so Socket) {
+			so.Join("room")
+		})
+		errFrames := make(chan string, 1)
+		server.OnRawOut(func(id string, data []byte) {
+			if id != "late" && data[0] == '4' {
+				errFrames <- string(data)
+			}
+		})
+		ts := NewTestSocket(server)
+		defer ts.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		So(waitFor(func() bool { return server.NamespaceCount("") == 1 }), ShouldBeTrue)
+
+		server.SetMaintenance(true)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/socket.io/?EIO=3&transport=polling", nil))
+		So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+		conn := NewPipeConn("late")
+		server.serveConn(conn)
+		So(conn.Frames(), ShouldResemble, []string{`4{"message":"server in maintenance"}`})
+
+		So(ts.Send("ev", "dropped"), ShouldBeNil)
+		So(<-errFrames, ShouldEqual, `4{"message":"server in maintenance"}`)
+		So(server.BroadcastToNamespace("", "room", "notice", "down for maintenance"), ShouldBeNil)
+		events, err := ts.WaitEvents(ctx, 1)
+		So(err, ShouldBeNil)
+		So(events, ShouldResemble, []TestEvent{{Name: "notice", Args: []interface{}{"down for maintenance"}, AckId: -1}})
+
+		server.SetMaintenance(false)
+		So(ts.Send("ev", "handled"), ShouldBeNil)
+		So(<-handled, ShouldEqual, "handled")
+		So(handled, ShouldBeEmpty)
+	})
+}
+
+func TestServerOnDispatch(t *testing.T) {
+
+	Convey("OnDispatch reports the duration and the error of handlers", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		type dispatch struct {
+			nsp, event string
+			dur        time.Duration
+			err        error
+		}
+		dispatched := make(chan dispatch, 2)
+		server.OnDispatch(func(nsp, event string, dur time.Duration, err error) {
+			dispatched <- dispatch{nsp, event, dur, err}
+		})
+		server.On("slow", func() {
+			time.Sleep(20 * time.Millisecond)
+		})
+		server.On("fail", func() error {
+			return errors.New("failed")
+		})
+		ts := NewTestSocket(server)
+		defer ts.Close()
+
+		So(ts.Send("slow"), ShouldBeNil)
+		d := <-dispatched
+		So(d.nsp, ShouldEqual, "")
+		So(d.event, ShouldEqual, "slow")
+		So(d.dur, ShouldBeGreaterThanOrEqualTo, 20*time.Millisecond)
+		So(d.err, ShouldBeNil)
+
+		So(ts.Send("fail"), ShouldBeNil)
+		d = <-dispatched
+		So(d.event, ShouldEqual, "fail")
+		So(d.err, ShouldResemble, errors.New("failed"))
+		So(dispatched, ShouldBeEmpty)
+	})
+}
+
+func TestSocketEmitOn(t *testing.T) {
+
+	Convey("Handlers emit to other namespaces of the connection", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.Of("/other")
+		errs := make(chan error, 3)
+		So(server.Of("/chat").On("ping", func(so Socket) {
+			errs <- so.EmitOn("/other", "pong")
+			errs <- so.EmitOn("/nope", "pong")
+			errs <- so.EmitOn("/", "pong", "from chat")
+		}), ShouldBeNil)
+
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		defer conn.Close()
+		conn.Send("0/chat")
+		conn.WaitFrames(2)
+		conn.Send(`2/chat,["ping"]`)
+		So(<-errs, ShouldEqual, ErrNamespaceNotConnected)
+		So(<-errs, ShouldEqual, ErrNamespaceNotConnected)
+		So(<-errs, ShouldBeNil)
+		So(conn.WaitFrames(3), ShouldResemble, []string{"0", "0/chat", `2["pong","from chat"]`})
+	})
+}
+
+func TestServerConnectPayload(t *testing.T) {
+
+	Convey("Connect acks carry the payload of the namespace", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		So(server.OnConnectPayload("/", func(so Socket) interface{} {
+			return map[string]string{"sid": so.Id()}
+		}), ShouldBeNil)
+		So(server.OnConnectPayload("/chat", func(so Socket) interface{} {
+			return nil
+		}), ShouldBeNil)
+		So(server.OnConnectPayload("/room", func(so Socket) interface{} {
+			return []string{so.Namespace()}
+		}), ShouldBeNil)
+
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		defer conn.Close()
+		conn.Send("0/chat")
+		conn.Send("0/room")
+		So(conn.WaitFrames(3), ShouldResemble, []string{`0{"sid":"test1"}`, "0/chat", `0/room,["/room"]`})
+	})
+}
+
+func TestServerEmitBeforeConnect(t *testing.T) {
+	chatOf := func(server *Server, id string) *nspSocket {
+		server.socketsMu.RLock()
+		defer server.socketsMu.RUnlock()
+		return server.sockets[id].namespace("/chat")
+	}
+
+	Convey("Emits before the namespace is connected fail by default", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.Of("/chat")
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		defer conn.Close()
+		conn.WaitFrames(1)
+		chat := chatOf(server, "test1")
+
+		So(chat.Emit("early"), ShouldEqual, ErrNamespaceNotConnected)
+		_, err = chat.EmitWithAck("early")
+		So(err, ShouldEqual, ErrNamespaceNotConnected)
+		So(chat.EmitPriority("early"), ShouldEqual, ErrNamespaceNotConnected)
+		So(chat.Volatile().Emit("early"), ShouldEqual, ErrNamespaceNotConnected)
+		So(chat.Compressed().Emit("early"), ShouldEqual, ErrNamespaceNotConnected)
+		So(chat.EmitError("early"), ShouldEqual, ErrNamespaceNotConnected)
+		conn.Send("0/chat")
+		So(conn.WaitFrames(2), ShouldResemble, []string{"0", "0/chat"})
+		So(chat.Emit("late"), ShouldBeNil)
+		So(conn.WaitFrames(3)[2], ShouldEqual, `2/chat,["late"]`)
+	})
+
+	Convey("Buffered emits are sent after the connect ack", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetEmitBeforeConnect(EmitBeforeConnectBuffer)
+		So(server.OnNamespaceConnection("/chat", func(so Socket) {
+			so.Emit("welcome")
+		}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		defer conn.Close()
+		conn.WaitFrames(1)
+		chat := chatOf(server, "test1")
+
+		So(chat.Emit("early", 1), ShouldBeNil)
+		So(chat.Emit("early", 2), ShouldBeNil)
+		_, err = chat.EmitWithAck("early")
+		So(err, ShouldEqual, ErrNamespaceNotConnected)
+		So(chat.EmitPriority("early", 3), ShouldBeNil)
+		So(chat.Volatile().Emit("early", 4), ShouldBeNil)
+		So(chat.Compressed().Emit("early", 5), ShouldBeNil)
+		So(chat.EmitError("early"), ShouldBeNil)
+		So(conn.Frames(), ShouldResemble, []string{"0"})
+		conn.Send("0/chat")
+		So(conn.WaitFrames(9), ShouldResemble, []string{
+			"0",
+			"0/chat",
+			`2/chat,["early",1]`,
+			`2/chat,["early",2]`,
+			`2/chat,["early",3]`,
+			`2/chat,["early",4]`,
+			`2/chat,["early",5]`,
+			`4/chat,"early"`,
+			`2/chat,["welcome"]`,
+		})
+	})
+}
+
+// localWrapper wraps a local adaptor.
+type localWrapper struct {
+	BroadcastAdaptor
+}
+
+func (w localWrapper) Local() bool {
+	return w.BroadcastAdaptor.(LocalAdaptor).Local()
+}
+
+func TestServerBroadcastToWithAck(t *testing.T) {
+
+	Convey("Broadcasts collect the acks of the room until the timeout", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.OnConnection(func(so Socket) {
+			so.Join("room")
+		})
+		sockets := make([]*TestSocket, 3)
+		for i := range sockets {
+			sockets[i] = NewTestSocket(server)
+			defer sockets[i].Close()
+		}
+		So(waitFor(func() bool { return server.NamespaceCount("") == 3 }), ShouldBeTrue)
+
+		type result struct {
+			acks [][]interface{}
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			acks, err := server.BroadcastToWithAck("room", "ping", 200*time.Millisecond, "hi")
+			done <- result{acks, err}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		var events []TestEvent
+		for _, ts := range sockets {
+			evs, err := ts.WaitEvents(ctx, 1)
+			So(err, ShouldBeNil)
+			So(evs[0].Name, ShouldEqual, "ping")
+			So(evs[0].Args, ShouldResemble, []interface{}{"hi"})
+			events = append(events, evs[0])
+		}
+		So(sockets[0].Ack(events[0], "pong", 0.0), ShouldBeNil)
+		So(sockets[1].Ack(events[1], "pong", 1.0), ShouldBeNil)
+
+		r := <-done
+		So(r.err, ShouldResemble, &AckError{Errors: map[string]error{sockets[2].Id(): ErrAckTimeout}})
+		So(len(r.acks), ShouldEqual, 2)
+		So(r.acks, ShouldContain, []interface{}{"pong", 0.0})
+		So(r.acks, ShouldContain, []interface{}{"pong", 1.0})
+		// the late ack is dropped.
+		So(sockets[2].Ack(events[2], "late"), ShouldBeNil)
+	})
+
+	Convey("Broadcasts tell the sockets disconnected before acking", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		// a wrapper of the default adaptor collects the acks as well.
+		server.SetAdaptor(localWrapper{NewLocalBroadcastAdaptor()})
+		server.OnConnection(func(so Socket) {
+			so.Join("room")
+		})
+		acked := NewTestSocket(server)
+		defer acked.Close()
+		closed := NewTestSocket(server)
+		So(waitFor(func() bool { return server.NamespaceCount("") == 2 }), ShouldBeTrue)
+
+		type result struct {
+			acks [][]interface{}
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			acks, err := server.BroadcastToWithAck("room", "ping", time.Second)
+			done <- result{acks, err}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		evs, err := acked.WaitEvents(ctx, 1)
+		So(err, ShouldBeNil)
+		So(acked.Ack(evs[0], "pong"), ShouldBeNil)
+		_, err = closed.WaitEvents(ctx, 1)
+		So(err, ShouldBeNil)
+		id := closed.Id()
+		So(closed.Close(), ShouldBeNil)
+
+		r := <-done
+		So(r.err, ShouldResemble, &AckError{Errors: map[string]error{id: ErrSocketClosed}})
+		So(r.err.Error(), ShouldEqual, "socketio: broadcast not acked by "+id+": socketio: socket closed")
+		So(r.acks, ShouldResemble, [][]interface{}{{"pong"}})
+	})
+
+	Convey("Broadcasts with acks fail with adaptors relaying to other nodes", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetAdaptor(&FakeBroadcastAdaptor{})
+		acks, err := server.BroadcastToWithAck("room", "ping", time.Second)
+		So(err, ShouldEqual, ErrAdaptorNotLocal)
+		So(acks, ShouldBeNil)
+	})
+}
+
+func TestServerReservedRooms(t *testing.T) {
+
+	Convey("The empty room is reserved", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		ts1 := NewTestSocket(server)
+		defer ts1.Close()
+		ts2 := NewTestSocket(server)
+		defer ts2.Close()
+		So(waitFor(func() bool { return server.NamespaceCount("") == 2 }), ShouldBeTrue)
+
+		So(ts1.Join(""), ShouldEqual, ErrReservedRoom)
+		_, err = ts1.JoinNew("")
+		So(err, ShouldEqual, ErrReservedRoom)
+		So(ts1.JoinAll("room", ""), ShouldEqual, ErrReservedRoom)
+		So(ts1.Rooms(), ShouldBeEmpty)
+
+		So(ts1.Join("room"), ShouldBeNil)
+		So(ts1.JoinAll("a", "b"), ShouldBeNil)
+		So(ts1.Join("user:"+ts2.Id()), ShouldBeNil)
+		So(ts1.Rooms(), ShouldResemble, []string{"a", "b", "room", "user:" + ts2.Id()})
+	})
+
+	Convey("Rooms named like socket ids are like any other", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		ts1 := NewTestSocket(server)
+		defer ts1.Close()
+		ts2 := NewTestSocket(server)
+		defer ts2.Close()
+		So(waitFor(func() bool { return server.NamespaceCount("") == 2 }), ShouldBeTrue)
+
+		So(ts1.Join(ts2.Id()), ShouldBeNil)
+		So(ts1.Rooms(), ShouldResemble, []string{ts2.Id()})
+		// ts2 isn't in the room of its id.
+		server.BroadcastTo(ts2.Id(), "ev")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		events, err := ts1.WaitEvents(ctx, 1)
+		So(err, ShouldBeNil)
+		So(events[0].Name, ShouldEqual, "ev")
+		time.Sleep(10 * time.Millisecond)
+		So(ts2.Events(), ShouldBeEmpty)
+	})
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+
+	Convey("Idle clients are disconnected while active ones survive", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetIdleTimeout(50 * time.Millisecond)
+		disconnected := make(chan string, 2)
+		So(server.OnDisconnect("", func(so Socket, reason string) {
+			disconnected <- so.Id() + " " + reason
+		}), ShouldBeNil)
+
+		idle := NewPipeConn("idle")
+		go server.serveConn(idle)
+		defer idle.Close()
+		active := NewPipeConn("active")
+		go server.serveConn(active)
+		defer active.Close()
+		idle.WaitFrames(1)
+		active.WaitFrames(1)
+
+		for i := 0; i < 20; i++ {
+			active.Send(`2["tick"]`)
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(<-disconnected, ShouldEqual, "idle "+ReasonIdleTimeout)
+		So(server.NamespaceCount(""), ShouldEqual, 1)
+		So(server.Sockets()[0].Id(), ShouldEqual, "active")
+		So(disconnected, ShouldBeEmpty)
+
+		So(<-disconnected, ShouldEqual, "active "+ReasonIdleTimeout)
+	})
+}
+
+func TestServerNotConnectedEvents(t *testing.T) {
+	run := func(policy NotConnectedEventPolicy) ([]string, []string) {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetNotConnectedEvents(policy)
+		got := make(chan string, 2)
+		So(server.Of("/chat").On("ev", func(msg string) {
+			got <- msg
+		}), ShouldBeNil)
+		So(server.On("sync", func() {}), ShouldBeNil)
+
+		conn := NewPipeConn("test1")
+		go server.serveConn(conn)
+		defer conn.Close()
+		conn.WaitFrames(1)
+		conn.Send("0/chat")
+		conn.WaitFrames(2)
+		conn.Send(`2/chat,["ev","connected"]`)
+		conn.Send("1/chat")
+		conn.Send(`2/chat,["ev","disconnected"]`)
+		conn.Send(`21["sync"]`)
+		frames := conn.WaitFrames(3)
+		for len(frames) > 0 && frames[len(frames)-1] != "31[]" {
+			frames = conn.WaitFrames(len(frames) + 1)
+		}
+		close(got)
+		var msgs []string
+		for msg := range got {
+			msgs = append(msgs, msg)
+		}
+		return msgs, frames[2:]
+	}
+
+	Convey("Events of a disconnected namespace are dropped", t, func() {
+		msgs, frames := run(NotConnectedEventDrop)
+		So(msgs, ShouldResemble, []string{"connected"})
+		So(frames, ShouldResemble, []string{"31[]"})
+	})
+
+	Convey("Events of a disconnected namespace are answered by an error", t, func() {
+		msgs, frames := run(NotConnectedEventError)
+		So(msgs, ShouldResemble, []string{"connected"})
+		So(frames, ShouldResemble, []string{`4/chat,{"message":"namespace not connected"}`, "31[]"})
+	})
+
+	Convey("Events of a disconnected namespace are dispatched", t, func() {
+		msgs, frames := run(NotConnectedEventDispatch)
+		So(msgs, ShouldResemble, []string{"connected", "disconnected"})
+		So(frames, ShouldResemble, []string{"31[]"})
+	})
+}
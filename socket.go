@@ -1,8 +1,17 @@
 package socketio
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/googollee/go-engine.io"
 )
@@ -13,49 +22,264 @@ type Socket interface {
 	// Id returns the session id of socket.
 	Id() string
 
-	// Rooms returns the rooms name joined now.
+	// Namespace returns the name of the namespace of the socket, "" for the
+	// default one.
+	Namespace() string
+
+	// Rooms returns the names of the rooms joined now, as given to Join.
 	Rooms() []string
 
-	// Request returns the first http request when established connection.
+	// Request returns the first http request when established connection. It's
+	// a clone, which handlers may change.
 	Request() *http.Request
 
+	// RemoteAddr returns the address of the client, as given by the trusted
+	// proxies of the server if any.
+	RemoteAddr() string
+
+	// ClientCert returns the first certificate presented by the client over
+	// TLS, if any.
+	ClientCert() (*x509.Certificate, bool)
+
+	// Transport returns the name of the engine.io transport of the
+	// connection, like "polling" or "websocket". With the connections of
+	// engine.io, it's the transport of the handshake, unaware of upgrades.
+	Transport() string
+
+	// Query returns the query parameters of the handshake request. It's
+	// never nil.
+	Query() url.Values
+
+	// Set stores the value with the key on the connection, like the user
+	// of the socket. It's shared by all namespaces of the connection.
+	Set(key string, value interface{})
+
+	// Get returns the value stored with the key by Set, and whether there
+	// is one.
+	Get(key string) (interface{}, bool)
+
+	// IsConnected returns whether the connection is open and the namespace
+	// of the socket connected. Emitting to a closed connection returns
+	// ErrSocketClosed.
+	IsConnected() bool
+
+	// Context returns the context of the connection. It is cancelled when the
+	// connection is closed.
+	Context() context.Context
+
 	// On registers the function f to handle an event.
 	On(event string, f interface{}) error
 
-	// Emit emits an event with given args.
+	// Off unregisters the handler of an event.
+	Off(event string)
+
+	// RemoveAll unregisters the handlers of all events.
+	RemoveAll()
+
+	// OnAny registers f to handle the events without a handler.
+	OnAny(f func(so Socket, event string, args ...interface{}))
+
+	// Emit emits an event with given args. It is safe for concurrent use.
 	Emit(event string, args ...interface{}) error
 
-	// Join joins the room.
+	// EmitOn emits an event with given args like Emit, to the namespace nsp
+	// of the same connection.
+	EmitOn(nsp, event string, args ...interface{}) error
+
+	// EmitWithAck emits an event with given args, returning the Ack to wait
+	// for the ack of the client.
+	EmitWithAck(event string, args ...interface{}) (*Ack, error)
+
+	// EmitAndWait emits an event with given args and waits for the ack of the
+	// client, or for ctx to be done. It fails with ErrWaitInHandler while a
+	// handler of the socket runs on its loop, like the event handlers
+	// without SetDispatchWorkers, as the loop can't read the ack meanwhile.
+	EmitAndWait(ctx context.Context, event string, args ...interface{}) ([]interface{}, error)
+
+	// EmitBurst emits the events in order under a single write lock, each
+	// as its own message.
+	EmitBurst(events []Event) error
+
+	// EmitRaw emits an event encoded by EncodeEvent for the namespace.
+	EmitRaw(ev *RawEvent) error
+
+	// EmitError sends an error packet with the payload to the client.
+	EmitError(payload interface{}) error
+
+	// EmitPriority emits an event with given args ahead of the events waiting
+	// for the connection.
+	EmitPriority(event string, args ...interface{}) error
+
+	// Volatile returns a VolatileEmitter of the socket, whose events are
+	// dropped when the connection is busy.
+	Volatile() *VolatileEmitter
+
+	// Compressed returns a CompressedEmitter of the socket, whose events the
+	// transport is hinted to compress. The hint is a no-op unless the
+	// connection is a CompressWriter, which those of engine.io aren't.
+	Compressed() *CompressedEmitter
+
+	// EmitTimeout emits an event with given args, expecting the last arg to
+	// be an ack callback which expires after timeout, or when the socket is
+	// disconnected first.
+	EmitTimeout(event string, timeout time.Duration, args ...interface{}) error
+
+	// Join joins the room. The empty room is reserved and fails with
+	// ErrReservedRoom.
 	Join(room string) error
 
+	// JoinNew joins the room, returning whether the socket wasn't in it.
+	JoinNew(room string) (bool, error)
+
+	// JoinAll joins all rooms, or none of them if one fails.
+	JoinAll(rooms ...string) error
+
 	// Leave leaves the room.
 	Leave(room string) error
 
+	// LeaveAll leaves all rooms, returning the rooms left.
+	LeaveAll() ([]string, error)
+
+	// LeaveMatching leaves the rooms with the prefix, returning the rooms
+	// left.
+	LeaveMatching(prefix string) ([]string, error)
+
+	// RoomMembers returns the sockets currently in the room.
+	RoomMembers(room string) ([]Socket, error)
+
 	// Disconnect disconnect the socket.
 	Disconnect()
 
+	// DisconnectWithReason disconnects the socket like Disconnect, sending the
+	// reason to the client.
+	DisconnectWithReason(reason string)
+
 	// BroadcastTo broadcasts an event to the room with given args.
 	BroadcastTo(room, event string, args ...interface{}) error
+
+	// BroadcastToNamespace broadcasts an event to the room of the namespace
+	// nsp, except this socket.
+	BroadcastToNamespace(nsp, room, event string, args ...interface{}) error
+
+	// BroadcastToRooms broadcasts an event to the rooms with given args,
+	// once per socket.
+	BroadcastToRooms(rooms []string, event string, args ...interface{}) error
+
+	// BroadcastToSample broadcasts an event to a random fraction of the room,
+	// except this socket.
+	BroadcastToSample(room, event string, fraction float64, args ...interface{}) error
+
+	// BroadcastToWithAck broadcasts an event to the room, except this socket,
+	// and returns the acks of the sockets until timeout.
+	BroadcastToWithAck(room, event string, timeout time.Duration, args ...interface{}) ([][]interface{}, error)
+
+	// To returns a Broadcaster emitting to the room, except this socket.
+	To(room string) *Broadcaster
+
+	// BroadcastToExcept broadcasts an event to the room with given args,
+	// excluding the except socket.
+	BroadcastToExcept(room, event string, except Socket, args ...interface{}) error
 }
 
 type socket struct {
+	// lastActivity is when the last packet of the client was decoded, in
+	// unix nanoseconds. It's first for the alignment of its atomic accesses.
+	lastActivity int64
 	// shouldn't need protection as its write only access by socket.loop once
 	// during socket creation.
-	nsps   map[string]*nspSocket
-	conn   engineio.Conn
-	id     int
-	mu     sync.Mutex
-	acks   map[int]*caller
-	acksmu sync.Mutex
+	nsps    map[string]*nspSocket
+	conn    engineio.Conn
+	encoder *encoder
+	// writing serializes writes, which volatile emits can try without
+	// waiting and priority emits get ahead of the others.
+	writing writeLock
+	// queue queues the packets for a writer goroutine if not nil.
+	queue *outQueue
+	// compress is set while writing a packet whose messages the transport is
+	// hinted to compress. It's guarded by writing.
+	compress bool
+	// id is the next ack id, guarded by acksmu. It's shared by all namespaces
+	// of the connection, so the ids in acks are unique across namespaces.
+	id        int
+	acks      map[int]*caller
+	ackTimers map[int]*time.Timer
+	// ackSockets are the namespaces of the pending acks, whose callbacks get
+	// ErrSocketClosed on disconnection.
+	ackSockets map[int]*nspSocket
+	// maintenance points to the maintenance flag of the server if not nil.
+	maintenance *int32
+	// maxAcks is the max number of acks pending, 0 for no limit.
+	maxAcks   int
+	acksmu    sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	query     url.Values
+	queryOnce sync.Once
+	// maxPayload is the max bytes of incoming packets, 0 for no limit.
+	maxPayload int64
+	// limiter limits the incoming events if not nil.
+	limiter *rateLimiter
+	// strict makes packets of unknown namespaces close the connection.
+	strict bool
+	// recoverPanics turns panics of handlers into errors.
+	recoverPanics bool
+	// trustedProxies are the proxies whose X-Forwarded-For header is
+	// trusted.
+	trustedProxies []*net.IPNet
+	// emitBeforeConnect is what happens to the emits to named namespaces
+	// before they're connected.
+	emitBeforeConnect EmitBeforeConnectPolicy
+	// notConnectedEvents is what happens to the events of the client to
+	// named namespaces it isn't connected to.
+	notConnectedEvents NotConnectedEventPolicy
+	// writeTimeout is the max duration of a write, 0 for no limit.
+	writeTimeout time.Duration
+	// slow is set to 1 when a write times out.
+	slow int32
+	// idleTimeout is the max duration without packets of the client, 0 for
+	// no limit.
+	idleTimeout time.Duration
+	// idle is set to 1 when the client is disconnected for being idle.
+	idle int32
+	// broken is set to 1 when a write to the connection fails, leaving the
+	// packet being written partly sent.
+	broken int32
+	// outgoing is the OnAnyOutgoing hook of the server if not nil.
+	outgoing func(nsp, event string, args []interface{}) ([]interface{}, error)
+	// reconnect restores the state of a reconnecting client if not nil.
+	reconnect func(so Socket, token string) error
+	// workers is the number of goroutines handling the events, 0 to handle
+	// them in the loop.
+	workers int
+	// handling is set to 1 while the loop runs handlers, which can't wait for
+	// the acks of the client as the loop reads them.
+	handling int32
+	// failed passes the error of a handler run by a worker to the loop.
+	failed chan error
+	// dispatched is the OnDispatch hook of the server if not nil.
+	dispatched func(nsp, event string, dur time.Duration, err error)
+	// joinRoom and leaveRoom are the room hooks of the server if not nil.
+	joinRoom  func(so Socket, room string)
+	leaveRoom func(so Socket, room string)
+	attrs     map[string]interface{}
+	attrsMu   sync.RWMutex
+	logger    Logger
 }
 
 func newSocket(conn engineio.Conn, ns *namespace) *socket {
 	nss := map[string]*nspSocket{}
 	ret := &socket{
-		conn: conn,
-		acks: make(map[int]*caller),
+		conn:       conn,
+		logger:     nopLogger{},
+		acks:       make(map[int]*caller),
+		ackTimers:  make(map[int]*time.Timer),
+		ackSockets: make(map[int]*nspSocket),
+		failed:     make(chan error, 1),
 	}
-	for k, v := range ns.root {
+	ret.touch()
+	ret.encoder = newEncoder(connWriter{ret})
+	ret.ctx, ret.cancel = context.WithCancel(context.Background())
+	for k, v := range ns.namespaces() {
 		nss[k] = newNspSocket(ret, v.baseHandler)
 	}
 	ret.nsps = nss
@@ -66,86 +290,742 @@ func (s *socket) Id() string {
 	return s.conn.Id()
 }
 
+// Request returns a copy of the handshake request, so handlers changing it,
+// like its headers or URL, don't change the request kept by the connection.
 func (s *socket) Request() *http.Request {
-	return s.conn.Request()
+	r := s.conn.Request()
+	if r == nil {
+		return nil
+	}
+	ret := new(http.Request)
+	*ret = *r
+	if r.URL != nil {
+		u := *r.URL
+		ret.URL = &u
+	}
+	if r.Header != nil {
+		ret.Header = make(http.Header, len(r.Header))
+		for k, v := range r.Header {
+			ret.Header[k] = append([]string(nil), v...)
+		}
+	}
+	return ret
+}
+
+// RemoteAddr returns the remote address of the handshake request. If it's a
+// trusted proxy of the server, it returns the IP of the client found in the
+// X-Forwarded-For header instead: the last one which isn't a trusted proxy,
+// as the client may forge the ones before.
+func (s *socket) RemoteAddr() string {
+	r := s.conn.Request()
+	if r == nil {
+		return ""
+	}
+	if len(s.trustedProxies) == 0 {
+		return r.RemoteAddr
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.isTrustedProxy(host) {
+		return r.RemoteAddr
+	}
+	var hops []string
+	for _, h := range r.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		for _, hop := range strings.Split(h, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		return r.RemoteAddr
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		host = hops[i]
+		if !s.isTrustedProxy(host) {
+			break
+		}
+	}
+	return host
+}
+
+func (s *socket) isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientCert returns the first peer certificate of the TLS connection of the
+// handshake request. It returns false when the connection isn't TLS or the
+// client presented no certificate.
+func (s *socket) ClientCert() (*x509.Certificate, bool) {
+	r := s.conn.Request()
+	if r == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, false
+	}
+	return r.TLS.PeerCertificates[0], true
+}
+
+// Transporter is implemented by the engine.io conns telling their current
+// transport, which may change when the conn is upgraded. None of the conns of
+// go-engine.io v1.0.1 implement it: it's for the wrappers of the conn or
+// future engine.io versions telling their transport.
+type Transporter interface {
+	Transport() string
+}
+
+// Transport returns the transport of the conn if it's a Transporter. As
+// engine.io conns don't tell it, it's otherwise the transport of the handshake
+// request, unaware of upgrades to websocket.
+func (s *socket) Transport() string {
+	conn := s.conn
+	if raw, ok := conn.(*rawConn); ok {
+		conn = raw.Conn
+	}
+	if t, ok := conn.(Transporter); ok {
+		return t.Transport()
+	}
+	return s.Query().Get("transport")
+}
+
+// Query parses the query of the handshake request once and caches it.
+func (s *socket) Query() url.Values {
+	s.queryOnce.Do(func() {
+		if r := s.conn.Request(); r != nil && r.URL != nil {
+			s.query = r.URL.Query()
+		} else {
+			s.query = url.Values{}
+		}
+	})
+	return s.query
+}
+
+// Set stores the value with the key on the connection.
+func (s *socket) Set(key string, value interface{}) {
+	s.attrsMu.Lock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+	s.attrsMu.Unlock()
+}
+
+// Get returns the value stored with the key, and whether there is one.
+func (s *socket) Get(key string) (interface{}, bool) {
+	s.attrsMu.RLock()
+	defer s.attrsMu.RUnlock()
+	v, ok := s.attrs[key]
+	return v, ok
+}
+
+func (s *socket) Context() context.Context {
+	return s.ctx
 }
 
 func (s *socket) Disconnect() {
+	s.cancel()
 	s.conn.Close()
 }
 
+// close sends disconnect packets of the connected namespaces to the client,
+// with the reason unless it's empty, then closes the connection.
+func (s *socket) close(reason string) {
+	for _, ns := range s.nsps {
+		if ns.name == "" || ns.isConnected() {
+			ns.sendDisconnect(reason)
+		}
+	}
+	s.flush()
+	s.Disconnect()
+}
+
+// namespace returns the namespace nsp of the socket, nil if the server has
+// no such namespace. The packets of unknown namespaces aren't handled by the
+// default one, which would hide the typos of the clients.
 func (s *socket) namespace(nsp string) *nspSocket {
-	n := s.nsps[nsp]
-	if n == nil {
-		// fallback to default namespace
-		n = s.nsps[""]
+	return s.nsps[nsp]
+}
+
+// encode writes the packet to the connection. Writes are serialized so the
+// frames of concurrent packets, like their attachments, don't interleave.
+func (s *socket) encode(p packet) error {
+	return s.encodeLane(p, false, false)
+}
+
+// encodeLane writes the packet like encode, ahead of the packets waiting for
+// the connection if priority is set, hinting the transport to compress its
+// messages if compress is set.
+func (s *socket) encodeLane(p packet, priority, compress bool) error {
+	if s.ctx.Err() != nil || s.isBroken() {
+		return ErrSocketClosed
+	}
+	if s.queue != nil {
+		frames, err := s.encodeFrames(p)
+		if err != nil {
+			return err
+		}
+		for _, f := range frames {
+			f.compress = compress
+		}
+		_, err = s.enqueue(frames, priority, false)
+		return err
+	}
+	s.writing.lock(priority)
+	err := s.write(func() error {
+		s.compress = compress
+		defer func() {
+			s.compress = false
+		}()
+		return s.encoder.Encode(p)
+	})
+	if err != nil {
+		s.logger.Errorf("socketio: socket %s: encode packet: %s", s.Id(), err)
+		return err
+	}
+	return nil
+}
+
+// ErrWriteTimeout is returned when a write to the connection takes longer
+// than the write timeout of the server. The socket is then disconnected.
+var ErrWriteTimeout = errors.New("socketio: write timeout")
+
+// write calls w, which writes to the connection holding the write semaphore,
+// and releases the semaphore when w returns. If w takes longer than the write
+// timeout, the client is disconnected as a slow client and ErrWriteTimeout is
+// returned, while w is left to fail on the closed connection.
+func (s *socket) write(w func() error) error {
+	if s.writeTimeout <= 0 {
+		defer s.writing.unlock()
+		return w()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- w()
+		s.writing.unlock()
+	}()
+	t := time.NewTimer(s.writeTimeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+	}
+	atomic.StoreInt32(&s.slow, 1)
+	s.Disconnect()
+	return ErrWriteTimeout
+}
+
+// touch records the activity of the client.
+func (s *socket) touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// reapIdle disconnects the client when it sends no packet for the idle
+// timeout, until the socket is closed.
+func (s *socket) reapIdle() {
+	t := time.NewTimer(s.idleTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActivity)))
+		if idle < s.idleTimeout {
+			t.Reset(s.idleTimeout - idle)
+			continue
+		}
+		s.logger.Debugf("socketio: socket %s: idle for %s", s.Id(), idle)
+		atomic.StoreInt32(&s.idle, 1)
+		s.Disconnect()
+		return
+	}
+}
+
+// connWriter is the frame writer of the encoder of a socket. A failed write
+// may leave a packet partly sent, like a text frame without its attachments,
+// so it marks the socket broken, and later writes fail with ErrSocketClosed
+// rather than writing frames the client can't decode.
+type connWriter struct {
+	s *socket
+}
+
+func (w connWriter) NextWriter(t engineio.MessageType) (io.WriteCloser, error) {
+	fw, err := nextWriter(w.s.conn, t, w.s.compress)
+	if err != nil {
+		w.s.setBroken()
+		return nil, err
 	}
-	return n
+	return connFrameWriter{fw, w.s}, nil
+}
+
+// connFrameWriter is a frame writer of the connection of s, marking s broken
+// when it fails.
+type connFrameWriter struct {
+	io.WriteCloser
+	s *socket
+}
+
+func (w connFrameWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if err != nil {
+		w.s.setBroken()
+	}
+	return n, err
+}
+
+func (w connFrameWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if err != nil {
+		w.s.setBroken()
+	}
+	return err
+}
+
+func (s *socket) setBroken() {
+	atomic.StoreInt32(&s.broken, 1)
+}
+
+func (s *socket) isBroken() bool {
+	return atomic.LoadInt32(&s.broken) == 1
+}
+
+// tryEncode writes the packet like encode unless another packet is being
+// written, returning whether it was written.
+func (s *socket) tryEncode(p packet) (bool, error) {
+	if s.ctx.Err() != nil || s.isBroken() {
+		return false, ErrSocketClosed
+	}
+	if s.queue != nil {
+		frames, err := s.encodeFrames(p)
+		if err != nil {
+			return false, err
+		}
+		return s.enqueue(frames, false, true)
+	}
+	if !s.writing.tryLock() {
+		return false, nil
+	}
+	if err := s.write(func() error { return s.encoder.Encode(p) }); err != nil {
+		s.logger.Errorf("socketio: socket %s: encode packet: %s", s.Id(), err)
+		return true, err
+	}
+	return true, nil
+}
+
+// errMaintenance answers the handshakes and events of clients while the server
+// is in maintenance.
+var errMaintenance = errors.New("server in maintenance")
+
+func (s *socket) isMaintenance() bool {
+	return s.maintenance != nil && atomic.LoadInt32(s.maintenance) == 1
+}
+
+// NotConnectedEventPolicy is what happens to the events the client sends to a
+// named namespace it isn't connected to, like after disconnecting it.
+type NotConnectedEventPolicy int
+
+const (
+	// NotConnectedEventDrop drops the events, without ack.
+	NotConnectedEventDrop NotConnectedEventPolicy = iota
+	// NotConnectedEventError drops the events, each answered by an error
+	// packet like EmitError.
+	NotConnectedEventError
+	// NotConnectedEventDispatch dispatches the events to the handlers of the
+	// namespace like when it's connected.
+	NotConnectedEventDispatch
+)
+
+// errNotConnected answers the events of namespaces the client isn't
+// connected to, with the NotConnectedEventError policy.
+var errNotConnected = errors.New("namespace not connected")
+
+// ErrSocketClosed is returned when sending to a socket whose connection is
+// closed.
+var ErrSocketClosed = errors.New("socketio: socket closed")
+
+// errInvalidNamespace rejects the connection of an unknown namespace, with the
+// message of the reference server.
+var errInvalidNamespace = errors.New("Invalid namespace")
+
+// sendConnectError rejects the connection of the namespace nsp with err, which
+// the client gets as a connect_error.
+func (s *socket) sendConnectError(nsp string, err error) error {
+	p := packet{
+		Type: _ERROR,
+		Id:   -1,
+		NSP:  nsp,
+		Data: map[string]string{"message": err.Error()},
+	}
+	return s.encode(p)
+}
+
+// ackTimeout unregisters the ack id if it is still waiting for c and notifies
+// c of the timeout.
+func (s *socket) ackTimeout(so Socket, id int, c *caller) {
+	if s.removeAck(id, c) {
+		s.logger.Debugf("socketio: socket %s: ack %d timed out", s.Id(), id)
+		c.CallError(so, ErrAckTimeout)
+	}
+}
+
+// ErrTooManyAcks is returned when emitting an event with an ack callback while
+// the socket has the max number of acks pending set by
+// Server.SetMaxPendingAcks.
+var ErrTooManyAcks = errors.New("socketio: too many pending acks")
+
+// addAck registers c for the ack of a packet of the namespace so and returns
+// its id. Ids increase and wrap around to 0 after the max int, skipping the ids
+// still waiting for their ack, so the ids of pending acks are unique.
+func (s *socket) addAck(so *nspSocket, c *caller) (int, error) {
+	s.acksmu.Lock()
+	defer s.acksmu.Unlock()
+	if s.maxAcks > 0 && len(s.acks) >= s.maxAcks {
+		return -1, ErrTooManyAcks
+	}
+	for {
+		id := s.id
+		s.id++
+		if s.id < 0 {
+			s.id = 0
+		}
+		if _, ok := s.acks[id]; !ok {
+			s.acks[id] = c
+			s.ackSockets[id] = so
+			return id, nil
+		}
+	}
+}
+
+// removeAck unregisters the ack id if it is still waiting for c, returning
+// whether it was.
+func (s *socket) removeAck(id int, c *caller) bool {
+	s.acksmu.Lock()
+	defer s.acksmu.Unlock()
+	if s.acks[id] != c {
+		return false
+	}
+	delete(s.acks, id)
+	delete(s.ackSockets, id)
+	if t, ok := s.ackTimers[id]; ok {
+		t.Stop()
+		delete(s.ackTimers, id)
+	}
+	return true
+}
+
+// cancelAcks unregisters the pending acks, stopping their expiry timers, and
+// calls their callbacks taking an error with ErrSocketClosed.
+func (s *socket) cancelAcks() {
+	s.acksmu.Lock()
+	acks, sockets := s.acks, s.ackSockets
+	s.acks = make(map[int]*caller)
+	s.ackSockets = make(map[int]*nspSocket)
+	for id, t := range s.ackTimers {
+		t.Stop()
+		delete(s.ackTimers, id)
+	}
+	s.acksmu.Unlock()
+	for id, c := range acks {
+		so := sockets[id]
+		if so == nil {
+			so = s.namespace("")
+		}
+		c.CallError(so, ErrSocketClosed)
+	}
+}
+
+// Reasons passed to the disconnection handlers, like
+//
+//	so.On("disconnection", func(so Socket, reason string) {
+//	    if reason == ReasonTransportError {
+//	        ...
+//	    }
+//	})
+const (
+	// ReasonTransportError is given when the connection is broken or closed
+	// by the transport.
+	ReasonTransportError = "transport error"
+	// ReasonClientDisconnect is given when the client disconnects the
+	// namespace.
+	ReasonClientDisconnect = "client namespace disconnect"
+	// ReasonServerDisconnect is given when the server calls Disconnect.
+	ReasonServerDisconnect = "server disconnect"
+	// ReasonServerNamespaceDisconnect is given when the server calls
+	// Disconnect of a namespace other than the default one.
+	ReasonServerNamespaceDisconnect = "server namespace disconnect"
+	// ReasonSlowClient is given when a write to the client times out.
+	ReasonSlowClient = "slow client"
+	// ReasonIdleTimeout is given when the client sends no packet for the
+	// idle timeout of the server.
+	ReasonIdleTimeout = "idle timeout"
+	// ReasonServerError is given when the server closes the connection for a
+	// protocol or policy error of the client, like ErrPayloadTooLarge,
+	// ErrRateLimited or an invalid namespace, or for the error of a handler.
+	// The error is passed to the error handlers first.
+	ReasonServerError = "server error"
+)
+
+// sendAck sends the ack of the event p with ret, if the client asks for one.
+func (s *socket) sendAck(p *packet, ret []interface{}) error {
+	if p.Type != _EVENT && p.Type != _BINARY_EVENT || p.Id < 0 {
+		return nil
+	}
+	if ret == nil {
+		ret = []interface{}{}
+	}
+	// Encode makes it a _BINARY_ACK if ret holds binary data.
+	return s.encode(packet{
+		Type: _ACK,
+		Id:   p.Id,
+		NSP:  p.NSP,
+		Data: ret,
+	})
+}
+
+// fail closes the connection for the error of a handler run by a worker, which
+// the loop returns.
+func (s *socket) fail(err error) {
+	select {
+	case s.failed <- err:
+		s.conn.Close()
+	default:
+	}
+}
+
+// onLoop runs f, running handlers on the loop, so EmitAndWait fails with
+// ErrWaitInHandler meanwhile rather than waiting for an ack the loop can't
+// read.
+func (s *socket) onLoop(f func() error) error {
+	atomic.StoreInt32(&s.handling, 1)
+	defer atomic.StoreInt32(&s.handling, 0)
+	return f()
 }
 
 func (s *socket) loop() (err error) {
+	clientDisconnect := false
+	// serverError is set when err is an error of the packets of the client or
+	// of a handler, rather than of the transport.
+	serverError := false
+	var d *dispatcher
+	if s.workers > 0 {
+		d = newDispatcher(s.workers)
+	}
 	defer func() {
+		reason := ReasonTransportError
+		if clientDisconnect {
+			reason = ReasonClientDisconnect
+		} else if atomic.LoadInt32(&s.slow) == 1 {
+			reason = ReasonSlowClient
+		} else if atomic.LoadInt32(&s.idle) == 1 {
+			reason = ReasonIdleTimeout
+		} else if s.ctx.Err() != nil {
+			// cancelled by Disconnect
+			reason = ReasonServerDisconnect
+		} else if serverError && !s.isBroken() {
+			reason = ReasonServerError
+		}
+		s.cancel()
+		if d != nil {
+			// the handlers running finish before the disconnection ones.
+			d.close()
+		}
+		s.cancelAcks()
 		for k, v := range s.nsps {
-			if v.name != "" && !v.connected {
+			if v.name != "" && !v.isConnected() {
 				continue
 			}
-			v.LeaveAll()
-			// trigger disconnect event on all namespaces
-			p := packet{
-				Type: _DISCONNECT,
-				Id:   -1,
-				NSP:  k,
+			if (reason == ReasonTransportError || reason == ReasonServerError) && err != nil && err != io.EOF {
+				p := packet{
+					Type: _ERROR,
+					Id:   -1,
+					NSP:  k,
+					Data: []interface{}{err},
+				}
+				v.onPacket(nil, &p)
 			}
-			v.onPacket(nil, &p)
-			v.connected = false
+			// trigger disconnect event on all namespaces
+			v.onDisconnect(reason)
+		}
+		s.conn.Close()
+		if s.queue != nil {
+			<-s.queue.done
 		}
 	}()
 
-	p := packet{
-		Type: _CONNECT,
-		Id:   -1,
+	if s.idleTimeout > 0 {
+		go s.reapIdle()
+	}
+	if token := s.Query().Get(SessionQueryKey); token != "" && s.reconnect != nil {
+		if err = s.onLoop(func() error {
+			return s.reconnect(s.namespace(""), token)
+		}); err != nil {
+			serverError = true
+			return
+		}
 	}
-	encoder := newEncoder(s.conn)
-	if err = encoder.Encode(p); err != nil {
+	// the default namespace is connected along with the connection. Like the
+	// other namespaces, its connection handler returns before the packets of
+	// the client are read.
+	if err = s.onLoop(s.namespace("").connect); err != nil {
+		serverError = true
 		return
 	}
-	s.namespace("").onPacket(nil, &p) // use default namespace (server's)
 	for {
 		decoder := newDecoder(s.conn)
+		decoder.limit = s.maxPayload
+		decoder.codec = s.encoder.codec
 		var p packet
 		if err = decoder.Decode(&p); err != nil {
+			select {
+			case err = <-s.failed:
+				// the connection was closed by the error of a handler.
+				serverError = true
+				return
+			default:
+			}
+			serverError = err == ErrPayloadTooLarge
+			if err != io.EOF {
+				s.logger.Errorf("socketio: socket %s: decode packet: %s", s.Id(), err)
+			}
 			return
 		}
+		s.touch()
+		if p.NSP == "/" {
+			p.NSP = ""
+		}
 		ns := s.namespace(p.NSP)
-		var ret []interface{}
-		ret, err = ns.onPacket(decoder, &p)
-		if err != nil {
+		if ns == nil && s.strict {
+			// a protocol error, like a typo in the namespace of the client.
+			if err = s.sendConnectError(p.NSP, errInvalidNamespace); err != nil {
+				return
+			}
+			err = errInvalidNamespace
+			serverError = true
 			return
 		}
-		switch p.Type {
-		case _CONNECT:
-			ns.sendConnect()
-		case _BINARY_EVENT:
-			fallthrough
-		case _EVENT:
-			if p.Id >= 0 {
-				p := packet{
-					Type: _ACK,
-					Id:   p.Id,
-					NSP:  p.NSP,
-					Data: ret,
-				}
-				encoder := newEncoder(s.conn)
-				if err = encoder.Encode(p); err != nil {
+		if ns == nil {
+			// unknown namespaces are rejected, and their packets dropped.
+			s.logger.Debugf("socketio: socket %s: packet of unknown namespace %q dropped", s.Id(), p.NSP)
+			if err = decoder.Discard(&p); err != nil {
+				return
+			}
+			if p.Type == _CONNECT {
+				if err = s.sendConnectError(p.NSP, errInvalidNamespace); err != nil {
 					return
 				}
 			}
-		case _DISCONNECT:
+			continue
+		}
+		if p.Type == _DISCONNECT {
 			if ns.name == "" {
+				// disconnection of default namespace is dispatched on exit.
+				clientDisconnect = true
 				return nil
 			}
-			ns.LeaveAll()
-			ns.connected = false
+			ns.onDisconnect(ReasonClientDisconnect)
+			continue
+		}
+		if p.Type == _CONNECT {
+			if err = decoder.Close(); err != nil {
+				return
+			}
+			if ns.isConnected() {
+				continue
+			}
+			if ns.auth != nil {
+				if authErr := s.onLoop(func() error { return ns.auth(ns) }); authErr != nil {
+					if err = s.sendConnectError(ns.name, authErr); err != nil {
+						return
+					}
+					continue
+				}
+			}
+			if err = s.onLoop(ns.connect); err != nil {
+				serverError = true
+				return
+			}
+			continue
+		}
+		if (p.Type == _EVENT || p.Type == _BINARY_EVENT) && ns.name != "" &&
+			s.notConnectedEvents != NotConnectedEventDispatch && !ns.isConnected() {
+			s.logger.Debugf("socketio: socket %s: event of not connected namespace %q dropped", s.Id(), ns.name)
+			if err = decoder.Discard(&p); err != nil {
+				return
+			}
+			if s.notConnectedEvents == NotConnectedEventError {
+				if err = ns.sendError(errNotConnected); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		if (p.Type == _EVENT || p.Type == _BINARY_EVENT) && s.isMaintenance() {
+			if err = decoder.Discard(&p); err != nil {
+				return
+			}
+			if err = ns.sendError(errMaintenance); err != nil {
+				return
+			}
+			continue
+		}
+		if s.limiter != nil && (p.Type == _EVENT || p.Type == _BINARY_EVENT) && !s.limiter.allow(time.Now()) {
+			if s.limiter.policy == RateLimitDisconnect {
+				err = ErrRateLimited
+				serverError = true
+				return
+			}
+			if err = decoder.Discard(&p); err != nil {
+				return
+			}
+			continue
+		}
+		if d != nil && (p.Type == _EVENT || p.Type == _BINARY_EVENT) {
+			event := decoder.Message()
+			var run func() ([]interface{}, error)
+			if run, err = ns.prepare(decoder, &p); err != nil {
+				s.logger.Errorf("socketio: socket %s: handle packet: %s", s.Id(), err)
+				serverError = true
+				return
+			}
+			if run != nil {
+				p := p
+				d.dispatch(event, func() {
+					ret, err := run()
+					if err != nil {
+						s.logger.Errorf("socketio: socket %s: handle packet: %s", s.Id(), err)
+					} else {
+						err = s.sendAck(&p, ret)
+					}
+					if err != nil {
+						s.fail(err)
+					}
+				})
+			}
+			continue
+		}
+		var ret []interface{}
+		err = s.onLoop(func() (err error) {
+			ret, err = ns.onPacket(decoder, &p)
+			return
+		})
+		if err != nil {
+			s.logger.Errorf("socketio: socket %s: handle packet: %s", s.Id(), err)
+			serverError = true
+			return
+		}
+		if err = s.sendAck(&p, ret); err != nil {
+			return
 		}
 	}
 }
@@ -0,0 +1,484 @@
+package socketio
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googollee/go-engine.io"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSocketContext(t *testing.T) {
+
+	Convey("Context is cancelled when the connection closes", t, func() {
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		So(socketInstance.Context().Err(), ShouldBeNil)
+
+		conn.Close()
+		<-done
+		So(socketInstance.Context().Err(), ShouldNotBeNil)
+	})
+
+	Convey("Context is cancelled by Disconnect", t, func() {
+		socketInstance := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{}))
+		ns := socketInstance.namespace("")
+		ns.Disconnect()
+		select {
+		case <-ns.Context().Done():
+		case <-time.After(time.Second):
+		}
+		So(ns.Context().Err(), ShouldNotBeNil)
+	})
+}
+
+func TestSocketQuery(t *testing.T) {
+
+	Convey("Query returns the handshake query parameters", t, func() {
+		conn := NewPipeConn("test1")
+		conn.request = &http.Request{URL: &url.URL{RawQuery: "token=abc&room=1&room=2"}}
+		ns := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		So(ns.Query().Get("token"), ShouldEqual, "abc")
+		So(ns.Query()["room"], ShouldResemble, []string{"1", "2"})
+	})
+
+	Convey("Query is empty without a query string", t, func() {
+		ns := newSocket(&FakeSockConnection{}, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		So(ns.Query(), ShouldNotBeNil)
+		So(ns.Query(), ShouldBeEmpty)
+	})
+}
+
+// transportConn is a conn telling its transport.
+type transportConn struct {
+	*PipeConn
+	transport string
+}
+
+func (c transportConn) Transport() string {
+	return c.transport
+}
+
+func TestSocketTransport(t *testing.T) {
+
+	Convey("Transport returns the transport of the conn", t, func() {
+		conn := transportConn{NewPipeConn("test1"), "websocket"}
+		ns := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		So(ns.Transport(), ShouldEqual, "websocket")
+
+		ns = newSocket(&rawConn{Conn: conn}, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		So(ns.Transport(), ShouldEqual, "websocket")
+	})
+
+	Convey("Transport falls back to the transport of the handshake request", t, func() {
+		conn := NewPipeConn("test1")
+		conn.request = &http.Request{URL: &url.URL{RawQuery: "EIO=3&transport=polling"}}
+		ns := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		So(ns.Transport(), ShouldEqual, "polling")
+	})
+}
+
+func TestSocketClientCert(t *testing.T) {
+
+	Convey("ClientCert returns the first peer certificate", t, func() {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+		conn := NewPipeConn("test1")
+		conn.request = &http.Request{TLS: &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert, {}},
+		}}
+		ns := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		got, ok := ns.ClientCert()
+		So(ok, ShouldBeTrue)
+		So(got.Subject.CommonName, ShouldEqual, "client")
+	})
+
+	Convey("ClientCert returns false without a client certificate", t, func() {
+		conn := NewPipeConn("test1")
+		ns := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		_, ok := ns.ClientCert()
+		So(ok, ShouldBeFalse)
+
+		conn = NewPipeConn("test1")
+		conn.request = &http.Request{TLS: &tls.ConnectionState{}}
+		ns = newSocket(conn, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		_, ok = ns.ClientCert()
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestSocketRequest(t *testing.T) {
+
+	Convey("Changing the request doesn't change the one of the connection", t, func() {
+		conn := NewPipeConn("test1")
+		conn.request = httptest.NewRequest("GET", "/socket.io/?EIO=3&transport=polling&token=a", nil)
+		conn.request.Header.Set("X-User", "bob")
+		ns := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{})).namespace("")
+		r := ns.Request()
+		r.Header.Set("X-User", "eve")
+		r.URL.RawQuery = "token=b"
+		So(conn.request.Header.Get("X-User"), ShouldEqual, "bob")
+		So(ns.Request().Header.Get("X-User"), ShouldEqual, "bob")
+		So(ns.Query().Get("token"), ShouldEqual, "a")
+		So(ns.Transport(), ShouldEqual, "polling")
+	})
+}
+
+func TestSocketRemoteAddr(t *testing.T) {
+
+	Convey("The client address comes from X-Forwarded-For of trusted proxies", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		remoteAddr := func(addr string, forwarded ...string) string {
+			conn := NewPipeConn("test1")
+			conn.request = httptest.NewRequest("GET", "/socket.io/", nil)
+			conn.request.RemoteAddr = addr
+			for _, f := range forwarded {
+				conn.request.Header.Add("X-Forwarded-For", f)
+			}
+			return server.newSocket(conn).namespace("").RemoteAddr()
+		}
+		So(remoteAddr("10.0.0.1:1234", "203.0.113.7"), ShouldEqual, "10.0.0.1:1234")
+
+		So(server.SetTrustedProxies("10.0.0.0/8", "192.0.2.1"), ShouldBeNil)
+		So(remoteAddr("10.0.0.1:1234", "203.0.113.7"), ShouldEqual, "203.0.113.7")
+		So(remoteAddr("10.0.0.1:1234", "198.51.100.1, 203.0.113.7", "192.0.2.1"), ShouldEqual, "203.0.113.7")
+		So(remoteAddr("10.0.0.1:1234", "192.0.2.1"), ShouldEqual, "192.0.2.1")
+		So(remoteAddr("10.0.0.1:1234"), ShouldEqual, "10.0.0.1:1234")
+		So(remoteAddr("198.51.100.1:1234", "203.0.113.7"), ShouldEqual, "198.51.100.1:1234")
+
+		So(server.SetTrustedProxies("nope"), ShouldNotBeNil)
+		So(server.SetTrustedProxies("10.0.0.0/33"), ShouldNotBeNil)
+	})
+}
+
+func TestSocketConnect(t *testing.T) {
+
+	Convey("Connection handlers fire once per namespace after the connect packet", t, func() {
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		connected := make(chan string, 4)
+		for _, nsp := range []string{"", "/chat"} {
+			nsp := nsp
+			So(root.Of(nsp).On("connection", func(so Socket) {
+				connected <- nsp
+				so.Emit("welcome")
+			}), ShouldBeNil)
+		}
+
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, root)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		So(<-connected, ShouldEqual, "")
+		conn.Send("0/chat")
+		So(<-connected, ShouldEqual, "/chat")
+		conn.Send("0/chat")
+		conn.Send("0")
+		conn.Send(`2["ping"]`)
+		conn.Close()
+		<-done
+
+		So(connected, ShouldBeEmpty)
+		So(conn.Frames(), ShouldResemble, []string{
+			"0", `2["welcome"]`, "0/chat", `2/chat,["welcome"]`,
+		})
+	})
+}
+
+func TestSocketUnknownNamespace(t *testing.T) {
+
+	Convey("Connecting an unknown namespace gets an error", t, func() {
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		got := make(chan string, 1)
+		So(root.On("ev", func(msg string) {
+			got <- msg
+		}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, root)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.Send("0/nonexistent")
+		conn.Send(`2/nonexistent,["ev","dropped"]`)
+		conn.Send(`2/,["ev","default"]`)
+		So(<-got, ShouldEqual, "default")
+		conn.Close()
+		<-done
+
+		So(conn.Frames(), ShouldResemble, []string{
+			"0", `4/nonexistent,{"message":"Invalid namespace"}`,
+		})
+		So(got, ShouldBeEmpty)
+	})
+}
+
+func TestSocketStrictNamespaces(t *testing.T) {
+
+	Convey("Packets of unknown namespaces close strict sockets", t, func() {
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		socketInstance.strict = true
+		So(socketInstance.namespace("/nonexistent"), ShouldBeNil)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- socketInstance.loop()
+		}()
+		conn.Send(`2/nonexistent,["ev","dropped"]`)
+		So(<-errc, ShouldEqual, errInvalidNamespace)
+		So(conn.Frames(), ShouldResemble, []string{
+			"0", `4/nonexistent,{"message":"Invalid namespace"}`,
+		})
+	})
+
+	Convey("Strict sockets failing to send the connect error return its error", t, func() {
+		conn := &failingConn{PipeConn: NewPipeConn("test1"), left: 1}
+		socketInstance := newSocket(conn, newNamespace(&FakeBroadcastAdaptor{}))
+		socketInstance.strict = true
+		errc := make(chan error, 1)
+		go func() {
+			errc <- socketInstance.loop()
+		}()
+		conn.Send(`2/nonexistent,["ev","dropped"]`)
+		So(<-errc, ShouldEqual, io.ErrShortWrite)
+	})
+
+	Convey("Packets of unknown namespaces are dropped if lenient", t, func() {
+		ns := newNamespace(&FakeBroadcastAdaptor{})
+		var got []string
+		So(ns.On("ev", func(msg string) string {
+			got = append(got, msg)
+			return msg
+		}), ShouldBeNil)
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, ns)
+		So(socketInstance.namespace("/nonexistent"), ShouldBeNil)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- socketInstance.loop()
+		}()
+		conn.Send(`2/nonexistent,1["ev","dropped"]`)
+		conn.Send(`22["ev","handled"]`)
+		So(conn.WaitFrames(2), ShouldResemble, []string{"0", `32["handled"]`})
+		So(got, ShouldResemble, []string{"handled"})
+		conn.Close()
+		So(<-errc, ShouldEqual, io.EOF)
+	})
+}
+
+func TestSocketConnectionOrder(t *testing.T) {
+
+	Convey("Events are dispatched after the connection handler returns", t, func() {
+		root := newNamespace(newBroadcastDefault())
+		for _, nsp := range []string{"", "/chat"} {
+			So(root.Of(nsp).On("connection", func(so Socket) {
+				time.Sleep(10 * time.Millisecond)
+				so.Join("room")
+			}), ShouldBeNil)
+			So(root.Of(nsp).On("ev", func(so Socket) int {
+				members, _ := so.RoomMembers("room")
+				return len(members)
+			}), ShouldBeNil)
+		}
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, root)
+		conn.Send(`21["ev"]`)
+		conn.Send("0/chat")
+		conn.Send(`2/chat,2["ev"]`)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		frames := conn.WaitFrames(4)
+		So(frames, ShouldResemble, []string{"0", "31[1]", "0/chat", "3/chat,2[1]"})
+		conn.Close()
+		<-done
+	})
+}
+
+func TestSocketAttributes(t *testing.T) {
+
+	Convey("Values set on connection are read by event handlers", t, func() {
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		root.Of("/chat")
+		So(root.On("connection", func(so Socket) {
+			so.Set("user", "alice")
+		}), ShouldBeNil)
+		got := make(chan interface{}, 2)
+		So(root.Of("/chat").On("ev", func(so Socket) {
+			user, _ := so.Get("user")
+			_, ok := so.Get("missing")
+			got <- user
+			got <- ok
+		}), ShouldBeNil)
+
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, root)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.Send("0/chat")
+		conn.Send(`2/chat,["ev"]`)
+		So(<-got, ShouldEqual, "alice")
+		So(<-got, ShouldEqual, false)
+		conn.Close()
+		<-done
+	})
+}
+
+func TestSocketClosed(t *testing.T) {
+
+	Convey("Emitting after disconnection returns ErrSocketClosed", t, func() {
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		root.Of("/chat")
+		conn := NewPipeConn("test1")
+		socketInstance := newSocket(conn, root)
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		so, chat := socketInstance.namespace(""), socketInstance.namespace("/chat")
+		conn.Send("0/chat")
+		conn.WaitFrames(2)
+		So(so.IsConnected(), ShouldBeTrue)
+		So(chat.IsConnected(), ShouldBeTrue)
+
+		so.Disconnect()
+		<-done
+		So(so.IsConnected(), ShouldBeFalse)
+		So(chat.IsConnected(), ShouldBeFalse)
+		So(so.Emit("ev"), ShouldEqual, ErrSocketClosed)
+		So(chat.Emit("ev", func() {}), ShouldEqual, ErrSocketClosed)
+		So(so.Volatile().Emit("ev"), ShouldEqual, ErrSocketClosed)
+		So(socketInstance.acks, ShouldBeEmpty)
+	})
+}
+
+// stalledConn blocks the writes once stalled, until it's closed.
+type stalledConn struct {
+	*PipeConn
+	stalled chan struct{}
+}
+
+func (c stalledConn) NextWriter(t engineio.MessageType) (io.WriteCloser, error) {
+	select {
+	case <-c.stalled:
+		<-c.closed
+		return nil, io.ErrClosedPipe
+	default:
+	}
+	return c.PipeConn.NextWriter(t)
+}
+
+func TestSocketWriteTimeout(t *testing.T) {
+
+	Convey("Stalled clients are disconnected after the write timeout", t, func() {
+		root := newNamespace(&FakeBroadcastAdaptor{})
+		reasons := make(chan string, 1)
+		So(root.On("disconnection", func(so Socket, reason string) {
+			reasons <- reason
+		}), ShouldBeNil)
+		conn := stalledConn{NewPipeConn("test1"), make(chan struct{})}
+		socketInstance := newSocket(conn, root)
+		socketInstance.writeTimeout = 20 * time.Millisecond
+		done := make(chan struct{})
+		go func() {
+			socketInstance.loop()
+			close(done)
+		}()
+		conn.WaitFrames(1)
+		close(conn.stalled)
+
+		ns := socketInstance.namespace("")
+		So(ns.Emit("ev"), ShouldEqual, ErrWriteTimeout)
+		<-done
+		So(<-reasons, ShouldEqual, ReasonSlowClient)
+		So(ns.Emit("ev"), ShouldEqual, ErrSocketClosed)
+	})
+}
+
+func TestSocketDispatchWorkers(t *testing.T) {
+
+	Convey("A slow handler doesn't hold back the events of other names", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetDispatchWorkers(4)
+		release := make(chan struct{})
+		server.On("slow", func() string {
+			<-release
+			return "slow"
+		})
+		var mu sync.Mutex
+		var seq []int
+		server.On("seq", func(i int) int {
+			mu.Lock()
+			seq = append(seq, i)
+			mu.Unlock()
+			return i
+		})
+		ts := NewTestSocket(server)
+		defer ts.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		slow := make(chan []interface{}, 1)
+		go func() {
+			args, _ := ts.SendWithAck(ctx, "slow")
+			slow <- args
+		}()
+		for i := 0; i < 5; i++ {
+			So(ts.Send("seq", i), ShouldBeNil)
+		}
+		args, err := ts.SendWithAck(ctx, "seq", 5)
+		So(err, ShouldBeNil)
+		So(args, ShouldResemble, []interface{}{float64(5)})
+		mu.Lock()
+		So(seq, ShouldResemble, []int{0, 1, 2, 3, 4, 5})
+		mu.Unlock()
+		So(slow, ShouldBeEmpty)
+
+		close(release)
+		So(<-slow, ShouldResemble, []interface{}{"slow"})
+	})
+
+	Convey("Errors of handlers close the connection", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.SetDispatchWorkers(2)
+		errFailed := errors.New("failed")
+		server.On("fail", func() error {
+			return errFailed
+		})
+		errs := make(chan error, 1)
+		So(server.OnError("", func(so Socket, err error) {
+			errs <- err
+		}), ShouldBeNil)
+		ts := NewTestSocket(server)
+		defer ts.Close()
+		So(ts.Send("fail"), ShouldBeNil)
+		So(<-errs, ShouldEqual, errFailed)
+	})
+}
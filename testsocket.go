@@ -0,0 +1,319 @@
+package socketio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/googollee/go-engine.io"
+)
+
+// ErrTestSocketClosed is returned by the methods of a closed TestSocket.
+var ErrTestSocketClosed = errors.New("socketio: test socket closed")
+
+var testSocketId int64
+
+// TestEvent is an event emitted by the server to a TestSocket.
+type TestEvent struct {
+	Name string
+	Args []interface{}
+	// AckId is the id to ack the event with, -1 if the server doesn't wait
+	// for an ack.
+	AckId int
+}
+
+// TestSocket is a client of the default namespace of a server, connected by
+// an in-memory connection, to unit test handlers without a network. The
+// server sees it like any client, with its options, hooks and middlewares.
+type TestSocket struct {
+	// Socket is the socket of the server, as given to the handlers.
+	Socket
+	conn   *testConn
+	served chan struct{}
+	read   chan struct{}
+
+	mu      sync.Mutex
+	events  []TestEvent
+	changed chan struct{}
+	acks    map[int]chan []interface{}
+	ackId   int
+}
+
+// NewTestSocket connects a TestSocket to the server s. It must be closed by
+// Close.
+func NewTestSocket(s *Server) *TestSocket {
+	conn := &testConn{
+		id: fmt.Sprintf("test%d", atomic.AddInt64(&testSocketId, 1)),
+		request: &http.Request{
+			Method:     "GET",
+			URL:        &url.URL{Path: "/socket.io/"},
+			Header:     make(http.Header),
+			RemoteAddr: "pipe",
+		},
+		in:   make(chan *batchFrame, 100),
+		out:  make(chan *batchFrame, 100),
+		done: make(chan struct{}),
+	}
+	so := s.newSocket(conn)
+	t := &TestSocket{
+		Socket:  so.namespace(""),
+		conn:    conn,
+		served:  make(chan struct{}),
+		read:    make(chan struct{}),
+		changed: make(chan struct{}),
+		acks:    make(map[int]chan []interface{}),
+	}
+	go func() {
+		defer close(t.served)
+		s.serveSocket(so)
+	}()
+	go t.readLoop()
+	return t
+}
+
+// Send sends an event with given args to the server, like a client emit.
+func (t *TestSocket) Send(event string, args ...interface{}) error {
+	return t.send(packet{
+		Type: _EVENT,
+		Id:   -1,
+		Data: append([]interface{}{event}, args...),
+	})
+}
+
+// SendWithAck sends an event with given args to the server, and waits for its
+// ack or for ctx to be done. The args of the ack are decoded like
+// json.Unmarshal into interface{} values.
+func (t *TestSocket) SendWithAck(ctx context.Context, event string, args ...interface{}) ([]interface{}, error) {
+	c := make(chan []interface{}, 1)
+	t.mu.Lock()
+	id := t.ackId
+	t.ackId++
+	t.acks[id] = c
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.acks, id)
+		t.mu.Unlock()
+	}()
+	err := t.send(packet{
+		Type: _EVENT,
+		Id:   id,
+		Data: append([]interface{}{event}, args...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case args := <-c:
+		return args, nil
+	case <-t.read:
+		return nil, ErrTestSocketClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ack sends the ack of the event ev with given args to the server.
+func (t *TestSocket) Ack(ev TestEvent, args ...interface{}) error {
+	if ev.AckId < 0 {
+		return fmt.Errorf("socketio: event %q has no ack", ev.Name)
+	}
+	return t.send(packet{
+		Type: _ACK,
+		Id:   ev.AckId,
+		Data: args,
+	})
+}
+
+// Events returns the events emitted by the server so far.
+func (t *TestSocket) Events() []TestEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TestEvent(nil), t.events...)
+}
+
+// WaitEvents waits until the server emitted at least n events, and returns
+// the events. It returns ctx.Err() if ctx is done first.
+func (t *TestSocket) WaitEvents(ctx context.Context, n int) ([]TestEvent, error) {
+	for {
+		t.mu.Lock()
+		events := append([]TestEvent(nil), t.events...)
+		changed := t.changed
+		t.mu.Unlock()
+		if len(events) >= n {
+			return events, nil
+		}
+		select {
+		case <-changed:
+		case <-t.read:
+			return events, ErrTestSocketClosed
+		case <-ctx.Done():
+			return events, ctx.Err()
+		}
+	}
+}
+
+// Close closes the connection and waits for the server to be done with the
+// socket.
+func (t *TestSocket) Close() error {
+	t.conn.Close()
+	<-t.served
+	<-t.read
+	return nil
+}
+
+func (t *TestSocket) send(p packet) error {
+	w := &batchWriter{}
+	if err := newEncoder(w).Encode(p); err != nil {
+		return err
+	}
+	select {
+	case <-t.conn.done:
+		return ErrTestSocketClosed
+	default:
+	}
+	for _, f := range w.frames {
+		select {
+		case t.conn.in <- f:
+		case <-t.conn.done:
+			return ErrTestSocketClosed
+		}
+	}
+	return nil
+}
+
+// readLoop decodes the packets written by the server until the connection is
+// closed.
+func (t *TestSocket) readLoop() {
+	defer close(t.read)
+	decoder := newDecoder(testReader{t.conn})
+	for {
+		var p packet
+		if err := decoder.Decode(&p); err != nil {
+			return
+		}
+		var args []interface{}
+		switch p.Type {
+		case _EVENT, _BINARY_EVENT, _ACK, _BINARY_ACK:
+			p.Data = &args
+			if err := decoder.DecodeData(&p); err != nil {
+				return
+			}
+		default:
+			if err := decoder.Discard(&p); err != nil {
+				return
+			}
+			continue
+		}
+		t.mu.Lock()
+		if p.Type == _ACK {
+			if c, ok := t.acks[p.Id]; ok {
+				c <- args
+			}
+		} else if p.Type == _EVENT {
+			t.events = append(t.events, TestEvent{
+				Name:  decoder.Message(),
+				Args:  args,
+				AckId: p.Id,
+			})
+			close(t.changed)
+			t.changed = make(chan struct{})
+		}
+		t.mu.Unlock()
+	}
+}
+
+// testConn is the in-memory engineio.Conn of a TestSocket. The frames of the
+// client are read from in, and the frames of the server are written to out.
+type testConn struct {
+	id      string
+	request *http.Request
+	in      chan *batchFrame
+	out     chan *batchFrame
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func (c *testConn) Id() string {
+	return c.id
+}
+
+func (c *testConn) Request() *http.Request {
+	return c.request
+}
+
+func (c *testConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+func (c *testConn) NextReader() (engineio.MessageType, io.ReadCloser, error) {
+	select {
+	case f := <-c.in:
+		return f.t, ioutil.NopCloser(&f.Buffer), nil
+	case <-c.done:
+		return engineio.MessageText, nil, io.EOF
+	}
+}
+
+func (c *testConn) NextWriter(t engineio.MessageType) (io.WriteCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, io.ErrClosedPipe
+	}
+	return &testWriter{conn: c, f: &batchFrame{t: t}}, nil
+}
+
+// testWriter passes its frame to the client when closed.
+type testWriter struct {
+	conn *testConn
+	f    *batchFrame
+}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *testWriter) Close() error {
+	w.conn.mu.Lock()
+	defer w.conn.mu.Unlock()
+	if w.conn.closed {
+		return io.ErrClosedPipe
+	}
+	w.conn.out <- w.f
+	return nil
+}
+
+// testReader reads the frames written by the server, until the connection is
+// closed and they are all read.
+type testReader struct {
+	conn *testConn
+}
+
+func (r testReader) NextReader() (engineio.MessageType, io.ReadCloser, error) {
+	select {
+	case f := <-r.conn.out:
+		return f.t, ioutil.NopCloser(&f.Buffer), nil
+	case <-r.conn.done:
+	}
+	select {
+	case f := <-r.conn.out:
+		return f.t, ioutil.NopCloser(&f.Buffer), nil
+	default:
+		return engineio.MessageText, nil, io.EOF
+	}
+}
@@ -0,0 +1,103 @@
+package socketio
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTestSocket(t *testing.T) {
+
+	Convey("Test sockets reach the handlers of the server", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		server.On("echo", func(so Socket, msg string) {
+			so.Emit("echo", msg, []byte{1, 2})
+		})
+		server.On("sum", func(a, b int) int {
+			return a + b
+		})
+		ts := NewTestSocket(server)
+		defer ts.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		So(ts.Send("echo", "hi"), ShouldBeNil)
+		events, err := ts.WaitEvents(ctx, 1)
+		So(err, ShouldBeNil)
+		So(events, ShouldResemble, []TestEvent{{Name: "echo", Args: []interface{}{"hi", "AQI="}, AckId: -1}})
+
+		args, err := ts.SendWithAck(ctx, "sum", 1, 2)
+		So(err, ShouldBeNil)
+		So(args, ShouldResemble, []interface{}{float64(3)})
+	})
+
+	Convey("Events of the server are acked by the test socket", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		ts := NewTestSocket(server)
+		defer ts.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		a, err := ts.EmitWithAck("ask", "name?")
+		So(err, ShouldBeNil)
+		events, err := ts.WaitEvents(ctx, 1)
+		So(err, ShouldBeNil)
+		So(events[0].AckId, ShouldBeGreaterThanOrEqualTo, 0)
+		So(ts.Ack(events[0], "bob"), ShouldBeNil)
+		args, err := a.Wait(ctx)
+		So(err, ShouldBeNil)
+		So(args, ShouldResemble, []interface{}{"bob"})
+
+		So(ts.Emit("note"), ShouldBeNil)
+		events, err = ts.WaitEvents(ctx, 2)
+		So(err, ShouldBeNil)
+		So(ts.Ack(events[1]), ShouldNotBeNil)
+	})
+
+	Convey("Closing the test socket disconnects it", t, func() {
+		server, err := NewServer(nil)
+		So(err, ShouldBeNil)
+		disconnected := make(chan string, 1)
+		server.On("disconnection", func(so Socket, reason string) {
+			disconnected <- reason
+		})
+		ts := NewTestSocket(server)
+		So(ts.Close(), ShouldBeNil)
+		So(<-disconnected, ShouldEqual, ReasonTransportError)
+		So(ts.Send("ev"), ShouldEqual, ErrTestSocketClosed)
+		_, err = ts.SendWithAck(context.Background(), "ev")
+		So(err, ShouldEqual, ErrTestSocketClosed)
+	})
+}
+
+func ExampleNewTestSocket() {
+	server, err := NewServer(nil)
+	if err != nil {
+		panic(err)
+	}
+	server.On("greet", func(so Socket, name string) string {
+		so.Emit("greeting", "hello "+name)
+		return "ok"
+	})
+
+	ts := NewTestSocket(server)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ack, err := ts.SendWithAck(ctx, "greet", "bob")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(ack)
+	for _, ev := range ts.Events() {
+		fmt.Println(ev.Name, ev.Args)
+	}
+	// Output:
+	// [ok]
+	// greeting [hello bob]
+}
@@ -0,0 +1,59 @@
+package socketio
+
+import "sync"
+
+// writeLock is the semaphore serializing the writes of a socket. Writers
+// waiting for it get it in order, the priority writers before the others.
+type writeLock struct {
+	mu   sync.Mutex
+	busy bool
+	// high and low are the priority and normal writers waiting, in order.
+	high []chan struct{}
+	low  []chan struct{}
+}
+
+// lock waits for the lock, ahead of the normal writers if priority is set.
+func (l *writeLock) lock(priority bool) {
+	l.mu.Lock()
+	if !l.busy {
+		l.busy = true
+		l.mu.Unlock()
+		return
+	}
+	c := make(chan struct{})
+	if priority {
+		l.high = append(l.high, c)
+	} else {
+		l.low = append(l.low, c)
+	}
+	l.mu.Unlock()
+	<-c
+}
+
+// tryLock takes the lock if it's free, returning whether it did.
+func (l *writeLock) tryLock() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.busy {
+		return false
+	}
+	l.busy = true
+	return true
+}
+
+// unlock hands the lock over to the next writer waiting, if any.
+func (l *writeLock) unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var c chan struct{}
+	switch {
+	case len(l.high) > 0:
+		c, l.high = l.high[0], l.high[1:]
+	case len(l.low) > 0:
+		c, l.low = l.low[0], l.low[1:]
+	default:
+		l.busy = false
+		return
+	}
+	close(c)
+}